@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nuid"
+)
+
+type Attachment = chitchat.Attachment
+
+type Thumbnail = chitchat.Thumbnail
+
+// Default attachments limits.
+const (
+	// Maximum file size, 10MB.
+	defaultAttachmentSize = 10 << 20
+
+	// Room for caption and multipart headers in upload request.
+	attachmentFormOverhead = maxMessageSize + 4096
+
+	// Maximum length of file name.
+	maxAttachmentName = 255
+)
+
+// Attachment ids are nuids, anything else is not found.
+var attachmentIdRe = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+// AttachmentConfig limit uploaded files.
+type AttachmentConfig struct {
+	// Maximum file size in bytes.
+	MaxSize int64
+
+	// Allowed MIME types, "image/*" allows all images.
+	Types []string
+}
+
+// DefaultAttachmentConfig allow media, plain text, PDF and zip files.
+var DefaultAttachmentConfig = AttachmentConfig{
+	MaxSize: defaultAttachmentSize,
+	Types:   []string{"image/*", "video/*", "audio/*", "text/plain", "application/pdf", "application/zip"},
+}
+
+// ParseAttachmentConfig override default config with max size and comma separated types if they set,
+// eg. "1048576" and "image/*,application/pdf".
+func ParseAttachmentConfig(maxSize, types string) (AttachmentConfig, error) {
+	config := DefaultAttachmentConfig
+
+	if len(maxSize) > 0 {
+		size, err := strconv.ParseInt(maxSize, 10, 64)
+		if err != nil || size < 1 {
+			return config, fmt.Errorf("invalid attachment max size %q", maxSize)
+		}
+
+		config.MaxSize = size
+	}
+
+	if len(types) > 0 {
+		config.Types = nil
+
+		for _, t := range strings.Split(types, ",") {
+			t = strings.TrimSpace(t)
+			if len(t) == 0 {
+				continue
+			}
+
+			if !strings.Contains(t, "/") {
+				return config, fmt.Errorf("invalid attachment type %q", t)
+			}
+
+			config.Types = append(config.Types, t)
+		}
+	}
+
+	return config, nil
+}
+
+// Allowed check if MIME type match one of allowed types.
+func (c AttachmentConfig) Allowed(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+
+	for _, t := range c.Types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// attachmentKey of the file in BlobStore, files are grouped by channel.
+func attachmentKey(channel, id string) string {
+	return channel + "/" + id
+}
+
+// attachmentMetaKey of the Attachment JSON in BlobStore.
+func attachmentMetaKey(channel, id string) string {
+	return attachmentKey(channel, id) + ".json"
+}
+
+// detectMimeType sniff file content, file extension is used only for unknown content.
+// File is rewinded after.
+func detectMimeType(file io.ReadSeeker, name string) (string, error) {
+	head := make([]byte, 512)
+
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	mimeType := http.DetectContentType(head[:n])
+	if mimeType == "application/octet-stream" {
+		if byExt := mime.TypeByExtension(filepath.Ext(name)); len(byExt) > 0 {
+			mimeType = byExt
+		}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	return mimeType, err
+}
+
+// imageSize decode image dimensions, zeros for unknown formats.
+// File is rewinded after.
+func imageSize(file io.ReadSeeker) (int, int, error) {
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		config = image.Config{}
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	return config.Width, config.Height, err
+}
+
+// inlineTypes could be shown in browser, other files are always downloaded.
+// SVG and HTML are not here, they could run scripts.
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// NewChannelAttachmentMessage build new attachment ChannelMessage with optional caption.
+func NewChannelAttachmentMessage(user *User, sentAt time.Time, text string, attachment *Attachment) ChannelMessage {
+	return ChannelMessage{
+		Id:         nuid.Next(),
+		Type:       chitchat.TypeAttachment,
+		FromUser:   user,
+		SentAt:     sentAt,
+		Text:       text,
+		Attachment: attachment,
+	}
+}
+
+// attachmentHandler upload files to the channel and serve them to channel members.
+type attachmentHandler struct {
+	// Channel events
+	store *Storage
+
+	// Uploaded files
+	blobs BlobStore
+
+	// Files limits
+	config AttachmentConfig
+
+	// Caption limits
+	limits MessageLimits
+
+	// Previews generation, disabled if nil
+	thumbnails *ThumbnailWorker
+}
+
+// NewAttachmentHandler build attachments handler.
+func NewAttachmentHandler(store *Storage, blobs BlobStore, config AttachmentConfig, limits MessageLimits, thumbnails *ThumbnailWorker) *attachmentHandler {
+	return &attachmentHandler{
+		store:      store,
+		blobs:      blobs,
+		config:     config,
+		limits:     limits,
+		thumbnails: thumbnails,
+	}
+}
+
+// Upload store multipart "file" with optional "text" caption and publish attachment message to the channel.
+func (h attachmentHandler) Upload(c echo.Context) error {
+	auth := ExtactAuth(c)
+	req := c.Request()
+
+	tooBig := echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("File is too big, maximum is %d bytes", h.config.MaxSize))
+
+	if req.ContentLength > h.config.MaxSize+attachmentFormOverhead {
+		return tooBig
+	}
+
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, h.config.MaxSize+attachmentFormOverhead)
+
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
+
+	file, header, err := req.FormFile("file")
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return tooBig
+		}
+
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "File can't be blank")
+	}
+	defer file.Close()
+
+	if header.Size > h.config.MaxSize {
+		return tooBig
+	}
+
+	text := c.FormValue("text")
+	if err := h.limits.Check(auth.Channel, text); err != nil {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	mimeType, err := detectMimeType(file, header.Filename)
+	if err != nil {
+		return err
+	}
+
+	if !h.config.Allowed(mimeType) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, fmt.Sprintf("File type %s is not allowed", mimeType))
+	}
+
+	name := filepath.Base(header.Filename)
+	if len(name) > maxAttachmentName {
+		name = name[len(name)-maxAttachmentName:]
+	}
+
+	attachment := &Attachment{
+		Id:       nuid.Next(),
+		Name:     name,
+		Size:     header.Size,
+		MimeType: mimeType,
+	}
+	attachment.URL = "/attachments/" + attachment.Id
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if attachment.Width, attachment.Height, err = imageSize(file); err != nil {
+			return err
+		}
+	}
+
+	ctx := req.Context()
+
+	if err := h.blobs.Put(ctx, attachmentKey(auth.Channel, attachment.Id), file, header.Size, mimeType); err != nil {
+		return err
+	}
+
+	if err := SaveAttachment(ctx, h.blobs, auth.Channel, attachment); err != nil {
+		DeleteAttachment(h.blobs, auth.Channel, attachment.Id)
+		return err
+	}
+
+	msg := NewChannelAttachmentMessage(auth.User, time.Now(), text, attachment)
+
+	if err := h.store.Broker.Publish(auth.Channel, EventMessage, msg); err != nil {
+		c.Logger().Errorf("Publish error: %v", err)
+
+		// Nobody would see the file without the message
+		DeleteAttachment(h.blobs, auth.Channel, attachment.Id)
+
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrMessageNotSent.Error())
+	}
+
+	// Previews are generated by ThumbnailWorker, message without them is already sent
+	if attachment.Width > 0 && h.thumbnails != nil {
+		if err := h.thumbnails.Enqueue(auth.Channel, attachment.Id); err != nil {
+			c.Logger().Errorf("Thumbnail enqueue error: %v", err)
+		}
+	}
+
+	return c.JSON(http.StatusCreated, msg)
+}
+
+// Download serve attachment of the current channel, members of other channels get 404.
+func (h attachmentHandler) Download(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	attachment, err := h.findAttachment(c, auth)
+	if err != nil {
+		return err
+	}
+
+	file, err := h.blobs.Get(c.Request().Context(), attachmentKey(auth.Channel, attachment.Id))
+	if err == ErrBlobNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	disposition := "attachment"
+	if mediaType, _, _ := mime.ParseMediaType(attachment.MimeType); inlineTypes[mediaType] {
+		disposition = "inline"
+	}
+
+	res := c.Response().Header()
+	res.Set(echo.HeaderContentDisposition, mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Name}))
+	res.Set(echo.HeaderContentLength, strconv.FormatInt(attachment.Size, 10))
+	res.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	res.Set("Cache-Control", "private, max-age=86400")
+
+	return c.Stream(http.StatusOK, attachment.MimeType, file)
+}
+
+// DownloadThumbnail serve image attachment preview, see ThumbnailWorker.
+func (h attachmentHandler) DownloadThumbnail(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	attachment, err := h.findAttachment(c, auth)
+	if err != nil {
+		return err
+	}
+
+	size, err := strconv.Atoi(c.Param("size"))
+	if err != nil || !hasThumbnail(attachment, size) {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnail not found")
+	}
+
+	file, err := h.blobs.Get(c.Request().Context(), thumbnailKey(auth.Channel, attachment.Id, size))
+	if err == ErrBlobNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, "Thumbnail not found")
+	}
+
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	res := c.Response().Header()
+	res.Set(echo.HeaderXContentTypeOptions, "nosniff")
+	res.Set("Cache-Control", "private, max-age=86400")
+
+	return c.Stream(http.StatusOK, "image/jpeg", file)
+}
+
+// findAttachment of the current channel by id param, banned users get 403.
+func (h attachmentHandler) findAttachment(c echo.Context, auth *Auth) (*Attachment, error) {
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if banned {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
+
+	id := c.Param("id")
+	if !attachmentIdRe.MatchString(id) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+	}
+
+	attachment, err := LoadAttachment(c.Request().Context(), h.blobs, auth.Channel, id)
+	if err == ErrBlobNotFound {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Attachment not found")
+	}
+
+	return attachment, err
+}
+
+// hasThumbnail check if thumbnail of the size is generated.
+func hasThumbnail(attachment *Attachment, size int) bool {
+	suffix := fmt.Sprintf("/thumbnails/%d", size)
+
+	for _, thumbnail := range attachment.Thumbnails {
+		if strings.HasSuffix(thumbnail.URL, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadAttachment JSON from BlobStore.
+func LoadAttachment(ctx context.Context, blobs BlobStore, channel, id string) (*Attachment, error) {
+	meta, err := blobs.Get(ctx, attachmentMetaKey(channel, id))
+	if err != nil {
+		return nil, err
+	}
+	defer meta.Close()
+
+	attachment := &Attachment{}
+	if err := json.NewDecoder(meta).Decode(attachment); err != nil {
+		return nil, err
+	}
+
+	return attachment, nil
+}
+
+// SaveAttachment JSON to BlobStore, next to the file.
+func SaveAttachment(ctx context.Context, blobs BlobStore, channel string, attachment *Attachment) error {
+	meta, err := json.Marshal(attachment)
+	if err != nil {
+		return err
+	}
+
+	return blobs.Put(ctx, attachmentMetaKey(channel, attachment.Id), bytes.NewReader(meta), int64(len(meta)), echo.MIMEApplicationJSON)
+}
+
+// DeleteAttachment remove file and its metadata, eg. when attachment message isn't sent.
+// Request could be already canceled, so it's not used.
+func DeleteAttachment(blobs BlobStore, channel, id string) error {
+	ctx := context.Background()
+
+	if err := blobs.Delete(ctx, attachmentKey(channel, id)); err != nil {
+		return err
+	}
+
+	return blobs.Delete(ctx, attachmentMetaKey(channel, id))
+}
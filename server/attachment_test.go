@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAttachmentConfig(t *testing.T) {
+	config, err := ParseAttachmentConfig("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultAttachmentConfig, config)
+
+	config, err = ParseAttachmentConfig("1024", "image/*, application/pdf")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), config.MaxSize)
+	assert.Equal(t, []string{"image/*", "application/pdf"}, config.Types)
+
+	_, err = ParseAttachmentConfig("-1", "")
+	assert.NotNil(t, err)
+
+	_, err = ParseAttachmentConfig("", "pdf")
+	assert.NotNil(t, err)
+}
+
+func TestAttachmentConfigAllowed(t *testing.T) {
+	config := AttachmentConfig{Types: []string{"image/*", "text/plain"}}
+
+	assert.True(t, config.Allowed("image/png"))
+	assert.True(t, config.Allowed("text/plain; charset=utf-8"))
+	assert.False(t, config.Allowed("text/html; charset=utf-8"))
+	assert.False(t, config.Allowed("application/pdf"))
+	assert.False(t, config.Allowed("imagepng"))
+}
+
+func TestDetectMimeType(t *testing.T) {
+	mimeType, err := detectMimeType(strings.NewReader("panic: runtime error"), "trace.txt")
+	assert.Nil(t, err)
+	assert.Equal(t, "text/plain; charset=utf-8", mimeType)
+
+	// Content wins over extension
+	mimeType, _ = detectMimeType(strings.NewReader("<html><script></script></html>"), "cat.png")
+	assert.Equal(t, "text/html; charset=utf-8", mimeType)
+
+	// Extension is used for unknown content
+	mimeType, _ = detectMimeType(bytes.NewReader([]byte{0, 1, 2}), "song.mp3")
+	assert.Equal(t, "audio/mpeg", mimeType)
+}
+
+func TestImageSize(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 640, 480)))
+
+	file := bytes.NewReader(buf.Bytes())
+
+	width, height, err := imageSize(file)
+	assert.Nil(t, err)
+	assert.Equal(t, 640, width)
+	assert.Equal(t, 480, height)
+
+	// File is rewinded
+	mimeType, _ := detectMimeType(file, "")
+	assert.Equal(t, "image/png", mimeType)
+}
+
+func TestUploadNotSent(t *testing.T) {
+	dir := t.TempDir()
+
+	blobs, err := NewDiskBlobStore(dir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store := NewMemoryStorage()
+	store.Broker = failingBroker{store.Broker}
+
+	h := NewAttachmentHandler(store, blobs, DefaultAttachmentConfig, DefaultMessageLimits, nil)
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	file, _ := form.CreateFormFile("file", "notes.txt")
+	file.Write([]byte("Winter is coming"))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/attachments", body)
+	req.Header.Set(echo.HeaderContentType, form.FormDataContentType())
+
+	c, _ := testContext(req, NewUser("Jon Snow", ""))
+
+	err = h.Upload(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*echo.HTTPError).Code)
+	}
+
+	// File and metadata are removed
+	var files []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+
+		return nil
+	})
+	assert.Empty(t, files)
+}
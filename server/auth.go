@@ -1,10 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"net/mail"
 	"time"
 
+	"github.com/faustman/chitchat/server/chitchat"
 	"github.com/golang-jwt/jwt"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -12,17 +14,8 @@ import (
 
 const AuthExpiresInHours = 72
 
-// Auth represents current JWT auth.
-type Auth struct {
-	// Current User.
-	User *User `json:"user"`
-
-	// Current channel.
-	Channel string `json:"channel"`
-
-	// Rest JWT headers.
-	jwt.StandardClaims
-}
+// Auth represents current JWT auth, shared with clients.
+type Auth = chitchat.Auth
 
 // authHandler resposible for all auth stuff.
 type authHandler struct {
@@ -71,6 +64,11 @@ func (a authHandler) Create(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Channel can't be blank")
 	}
 
+	// Channel is a part of stream subjects and bucket names
+	if !chitchat.ValidChannel(channel) {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("Channel can contain only letters, digits, dashes and underscores, up to %d characters", chitchat.MaxChannelLength))
+	}
+
 	if len(email) > 0 {
 		// TODO: extact to helper
 		_, err := mail.ParseAddress(email)
@@ -80,26 +78,40 @@ func (a authHandler) Create(c echo.Context) error {
 		}
 	}
 
-	claims := &Auth{
-		NewUser(name, email),
-		channel,
-		jwt.StandardClaims{
-			Issuer:    "chitchat",
-			ExpiresAt: time.Now().Add(time.Hour * AuthExpiresInHours).Unix(),
-		},
+	t, err := a.NewToken(NewUser(name, email), channel)
+	if err != nil {
+		return err
 	}
 
+	return c.JSON(http.StatusCreated, echo.Map{
+		"token": t,
+	})
+}
+
+// NewToken sign new JWT token for user in channel.
+func (a authHandler) NewToken(user *User, channel string) (string, error) {
+	claims := chitchat.NewAuth(user, channel, time.Hour*AuthExpiresInHours)
+
 	// For production purpose better to use RS256 Signing Method instead
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
-	t, err := token.SignedString(a.SigningKey)
-	if err != err {
-		return err
-	}
+	return token.SignedString(a.SigningKey)
+}
 
-	return c.JSON(http.StatusCreated, echo.Map{
-		"token": t,
+// ParseToken parse and validate JWT token outside of echo, eg. for gRPC calls.
+func (a authHandler) ParseToken(t string) (*Auth, error) {
+	token, err := jwt.ParseWithClaims(t, &Auth{}, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+
+		return a.SigningKey, nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return token.Claims.(*Auth), nil
 }
 
 // Get /auth will return valid auth object.
@@ -164,6 +164,20 @@ func TestCreateAuthChannelValidation(t *testing.T) {
 	if assert.Error(t, err) {
 		assert.Equal(t, err.Error(), "code=422, message=Channel can't be blank")
 	}
+
+	// Channel is a part of stream subjects
+	for _, channel := range []string{"general.*", "general chat", "CHITCHAT.>", strings.Repeat("a", 65)} {
+		authForm.Set("channel", channel)
+
+		req := httptest.NewRequest(http.MethodPost, "/auth", strings.NewReader(authForm.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		c := e.NewContext(req, httptest.NewRecorder())
+
+		err := h.Create(c)
+		if assert.Error(t, err, channel) {
+			assert.Equal(t, http.StatusUnprocessableEntity, err.(*echo.HTTPError).Code)
+		}
+	}
 }
 func TestCreateAuthEmailValidation(t *testing.T) {
 	authForm := url.Values{}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/nats-io/nats.go"
+)
+
+// ErrBlobNotFound is returned by BlobStore when there is no blob with given key.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keep uploaded files, keys are slash separated paths, eg. "lobby/<id>".
+type BlobStore interface {
+	// Put store size bytes from reader under the key.
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+
+	// Get open blob for reading, caller should close it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+
+	// Delete blob, missing blob is not an error.
+	Delete(ctx context.Context, key string) error
+}
+
+// NewBlobStore build blob store by URL:
+//   - "nats" - JetStream Object Store, default, only with NATS storage
+//   - "file:///var/lib/chitchat" - local directory
+//   - "s3://access:secret@localhost:9000/bucket?secure=false" - S3 compatible storage, eg. MinIO
+func NewBlobStore(js *JetStream, storeURL string) (BlobStore, error) {
+	if len(storeURL) == 0 || storeURL == "nats" {
+		if js == nil {
+			return nil, errors.New("nats blob store requires NATS storage, set ATTACHMENT_STORE")
+		}
+
+		return NewObjectBlobStore(js)
+	}
+
+	u, err := url.Parse(storeURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid blob store URL %q: %w", storeURL, err)
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewDiskBlobStore(u.Host + u.Path)
+	case "s3":
+		bucket := strings.Trim(u.Path, "/")
+		if len(bucket) == 0 {
+			return nil, fmt.Errorf("invalid blob store URL %q: bucket is missing", storeURL)
+		}
+
+		secret, _ := u.User.Password()
+
+		return NewS3BlobStore(u.Host, u.User.Username(), secret, bucket, u.Query().Get("secure") != "false")
+	}
+
+	return nil, fmt.Errorf("unsupported blob store %q", u.Scheme)
+}
+
+// objectBlobStore keep blobs in JetStream Object Store, so no extra infrastructure needed.
+type objectBlobStore struct {
+	obs nats.ObjectStore
+}
+
+// NewObjectBlobStore create if not exists attachments bucket.
+func NewObjectBlobStore(js *JetStream) (*objectBlobStore, error) {
+	obs, err := js.ObjectBucket(&nats.ObjectStoreConfig{
+		Bucket: chitchat.AttachmentsBucket,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &objectBlobStore{obs: obs}, nil
+}
+
+func (s *objectBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	meta := &nats.ObjectMeta{
+		Name:    key,
+		Headers: nats.Header{"Content-Type": []string{contentType}},
+	}
+
+	_, err := s.obs.Put(meta, r, nats.Context(ctx))
+
+	return err
+}
+
+func (s *objectBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	result, err := s.obs.Get(key, nats.Context(ctx))
+	if err == nats.ErrObjectNotFound {
+		return nil, ErrBlobNotFound
+	}
+
+	return result, err
+}
+
+func (s *objectBlobStore) Delete(ctx context.Context, key string) error {
+	if err := s.obs.Delete(key); err != nil && err != nats.ErrObjectNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// diskBlobStore keep blobs as files in local directory, suitable for single server.
+type diskBlobStore struct {
+	dir string
+}
+
+// NewDiskBlobStore create directory if not exists.
+func NewDiskBlobStore(dir string) (*diskBlobStore, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	return &diskBlobStore{dir: dir}, nil
+}
+
+// path of the blob file, keys with ".." or absolute ones are rejected.
+func (s *diskBlobStore) path(key string) (string, error) {
+	if !fs.ValidPath(key) {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
+
+func (s *diskBlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+
+	// Write to temp file first, so readers never see partial blob
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *diskBlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+
+	return f, err
+}
+
+func (s *diskBlobStore) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// s3BlobStore keep blobs in S3 compatible bucket.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3BlobStore connect to S3 endpoint and create bucket if not exists.
+func NewS3BlobStore(endpoint, accessKey, secretKey, bucket string, secure bool) (*s3BlobStore, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if err := client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+			return nil, err
+		}
+	}
+
+	return &s3BlobStore{client: client, bucket: bucket}, nil
+}
+
+func (s *s3BlobStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, r, size, minio.PutObjectOptions{ContentType: contentType})
+
+	return err
+}
+
+func (s *s3BlobStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	// GetObject is lazy, Stat make the request to check if object exists
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, ErrBlobNotFound
+		}
+
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func (s *s3BlobStore) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskBlobStore(t *testing.T) {
+	store, err := NewBlobStore(nil, "file://"+t.TempDir())
+	assert.Nil(t, err)
+
+	ctx := context.Background()
+
+	err = store.Put(ctx, "lobby/file", strings.NewReader("hello"), 5, "text/plain")
+	assert.Nil(t, err)
+
+	r, err := store.Get(ctx, "lobby/file")
+	assert.Nil(t, err)
+
+	data, _ := io.ReadAll(r)
+	r.Close()
+	assert.Equal(t, "hello", string(data))
+
+	assert.Nil(t, store.Delete(ctx, "lobby/file"))
+	assert.Nil(t, store.Delete(ctx, "lobby/file"))
+
+	_, err = store.Get(ctx, "lobby/file")
+	assert.Equal(t, ErrBlobNotFound, err)
+
+	err = store.Put(ctx, "../file", strings.NewReader("hello"), 5, "text/plain")
+	assert.NotNil(t, err)
+}
+
+func TestNewBlobStoreInvalid(t *testing.T) {
+	_, err := NewBlobStore(nil, "ftp://localhost/files")
+	assert.NotNil(t, err)
+
+	_, err = NewBlobStore(nil, "s3://key:secret@localhost:9000")
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+)
+
+// JetStreamConfig of all streams and buckets kept by the server.
+type JetStreamConfig struct {
+	// Replicas of the shared stream, jobs stream and buckets, channel streams have own ones, see StreamConfig.
+	Replicas int
+
+	// Storage of all streams and buckets.
+	Storage nats.StorageType
+
+	// Heartbeats and TTL of presence buckets.
+	Presence PresenceConfig
+}
+
+// DefaultJetStreamConfig keep everything on disk without replicas.
+var DefaultJetStreamConfig = JetStreamConfig{Replicas: 1, Storage: nats.FileStorage, Presence: DefaultPresenceConfig}
+
+// ParseJetStreamConfig override default config with replicas and storage type ("file" or "memory") if they set.
+func ParseJetStreamConfig(replicas, storage string) (JetStreamConfig, error) {
+	config := DefaultJetStreamConfig
+
+	if len(replicas) > 0 {
+		n, err := strconv.Atoi(replicas)
+		if err != nil || n < 1 || n > 5 {
+			return config, fmt.Errorf("invalid JetStream replicas %q", replicas)
+		}
+
+		config.Replicas = n
+	}
+
+	switch storage {
+	case "", "file":
+	case "memory":
+		config.Storage = nats.MemoryStorage
+	default:
+		return config, fmt.Errorf("invalid JetStream storage %q", storage)
+	}
+
+	return config, nil
+}
+
+// JetStream context with streams and buckets created or updated to the desired config.
+// Each stream is checked once per process and bucket handles are kept, so requests don't hit JetStream API for them.
+type JetStream struct {
+	nats.JetStreamContext
+
+	nc      *nats.Conn
+	streams StreamConfig
+	config  JetStreamConfig
+	logger  echo.Logger
+
+	mu sync.Mutex
+
+	// Streams in desired state
+	ready map[string]bool
+
+	// Bucket handles by name
+	buckets map[string]nats.KeyValue
+	objects map[string]nats.ObjectStore
+}
+
+// bootstrap create or update streams and buckets needed from the start, so config drift is reported right away.
+func (js *JetStream) bootstrap() error {
+	if js.streams.Topology == TopologyChannel {
+		// Shared stream subjects overlap with channel streams ones
+		if _, err := js.StreamInfo(StreamName); err == nil {
+			return fmt.Errorf("stream %s exists, move channels out of it with chitchatctl migrate-streams", StreamName)
+		}
+	} else {
+		// Default Retention policy: LimitsPolicy
+		err := js.Stream(&nats.StreamConfig{
+			Name:     StreamName,
+			Subjects: []string{StreamName + ".*.*"},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := js.Stream(jobsStreamConfig()); err != nil {
+		return err
+	}
+
+	if _, err := js.BansBucket(); err != nil {
+		return err
+	}
+
+	_, err := js.RetentionBucket()
+
+	return err
+}
+
+// Stream create the stream or update it to the desired config, once per process.
+// Replicas and storage are taken from JetStreamConfig if they aren't set.
+func (js *JetStream) Stream(config *nats.StreamConfig) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if js.ready[config.Name] {
+		return nil
+	}
+
+	desired := *config
+	js.withDefaults(&desired)
+
+	if err := js.reconcile(desired); err != nil {
+		return fmt.Errorf("stream %s: %w", config.Name, err)
+	}
+
+	js.ready[config.Name] = true
+
+	return nil
+}
+
+// StreamReady report whether the stream was already brought to desired state by Stream.
+func (js *JetStream) StreamReady(name string) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	return js.ready[name]
+}
+
+// Bucket return KeyValue bucket created or updated to the config, handle is kept for the life of the process.
+func (js *JetStream) Bucket(config *nats.KeyValueConfig) (nats.KeyValue, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if kv, ok := js.buckets[config.Bucket]; ok {
+		return kv, nil
+	}
+
+	cfg := *config
+	cfg.Replicas, cfg.Storage = js.config.Replicas, js.config.Storage
+
+	kv, err := js.KeyValue(cfg.Bucket)
+	if err == nats.ErrBucketNotFound {
+		kv, err = js.CreateKeyValue(&cfg)
+	} else if err == nil {
+		history := int64(cfg.History)
+		if history == 0 {
+			history = 1
+		}
+
+		// Bucket is a stream, only limits set by the server are compared
+		err = js.reconcile(nats.StreamConfig{
+			Name:              "KV_" + cfg.Bucket,
+			MaxAge:            cfg.TTL,
+			MaxMsgsPerSubject: history,
+			Replicas:          cfg.Replicas,
+			Storage:           cfg.Storage,
+		})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("bucket %s: %w", cfg.Bucket, err)
+	}
+
+	js.buckets[cfg.Bucket] = kv
+
+	return kv, nil
+}
+
+// ObjectBucket return Object Store bucket created or updated to the config, handle is kept for the life of the process.
+func (js *JetStream) ObjectBucket(config *nats.ObjectStoreConfig) (nats.ObjectStore, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	if obs, ok := js.objects[config.Bucket]; ok {
+		return obs, nil
+	}
+
+	cfg := *config
+	cfg.Replicas, cfg.Storage = js.config.Replicas, js.config.Storage
+
+	obs, err := js.ObjectStore(cfg.Bucket)
+	if err == nats.ErrStreamNotFound {
+		obs, err = js.CreateObjectStore(&cfg)
+	} else if err == nil {
+		err = js.reconcile(nats.StreamConfig{
+			Name:     "OBJ_" + cfg.Bucket,
+			MaxAge:   cfg.TTL,
+			Replicas: cfg.Replicas,
+			Storage:  cfg.Storage,
+		})
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("object bucket %s: %w", cfg.Bucket, err)
+	}
+
+	js.objects[cfg.Bucket] = obs
+
+	return obs, nil
+}
+
+// Channels with channel streams or presence buckets.
+func (js *JetStream) Channels() map[string]bool {
+	channels := make(map[string]bool)
+
+	for name := range js.StreamNames() {
+		// KeyValue buckets are backed by "KV_<bucket>" streams
+		if bucket := strings.TrimPrefix(name, "KV_"); bucket != name && strings.HasSuffix(bucket, "-presence") {
+			channels[strings.TrimSuffix(bucket, "-presence")] = true
+		} else if strings.HasPrefix(name, chitchat.ChannelStreamPrefix) {
+			channels[strings.TrimPrefix(name, chitchat.ChannelStreamPrefix)] = true
+		}
+	}
+
+	return channels
+}
+
+// PresenceBucket with connections of users online in the channel, ones without heartbeats expire.
+// The last put is kept with delete marker, so replicas see when left connection was joined, see presentAt.
+func (js *JetStream) PresenceBucket(channel string) (nats.KeyValue, error) {
+	return js.Bucket(&nats.KeyValueConfig{Bucket: chitchat.PresenceBucket(channel), TTL: js.config.Presence.TTL, History: 2})
+}
+
+// BansBucket with banned users of all channels.
+func (js *JetStream) BansBucket() (nats.KeyValue, error) {
+	return js.Bucket(&nats.KeyValueConfig{Bucket: chitchat.BansBucket})
+}
+
+// RetentionBucket with history retention policies of all channels.
+func (js *JetStream) RetentionBucket() (nats.KeyValue, error) {
+	return js.Bucket(&nats.KeyValueConfig{Bucket: chitchat.RetentionBucket})
+}
+
+// withDefaults set replicas and storage of the stream config from JetStreamConfig.
+func (js *JetStream) withDefaults(config *nats.StreamConfig) {
+	if config.Replicas == 0 {
+		config.Replicas = js.config.Replicas
+	}
+
+	config.Storage = js.config.Storage
+}
+
+// reconcile create the stream or update it to the desired config, drift is logged.
+// Storage and retention policy can't be changed, stream should be recreated for them.
+func (js *JetStream) reconcile(desired nats.StreamConfig) error {
+	info, err := js.StreamInfo(desired.Name)
+	if err == nats.ErrStreamNotFound {
+		_, err = js.AddStream(&desired)
+
+		return err
+	}
+
+	if err != nil {
+		return err
+	}
+
+	drift := streamDrift(info.Config, desired)
+	if len(drift) == 0 {
+		return nil
+	}
+
+	if info.Config.Storage != desired.Storage || info.Config.Retention != desired.Retention {
+		return fmt.Errorf("config drift can't be fixed without recreating the stream: %s", strings.Join(drift, ", "))
+	}
+
+	js.logger.Warnf("JetStream stream %s config drift, updating: %s", desired.Name, strings.Join(drift, ", "))
+
+	config := info.Config
+	config.MaxAge = desired.MaxAge
+	config.Replicas = desired.Replicas
+	config.NoAck = desired.NoAck
+
+	if len(desired.Subjects) > 0 {
+		config.Subjects = desired.Subjects
+	}
+
+	if desired.MaxBytes != 0 {
+		config.MaxBytes = desired.MaxBytes
+	}
+
+	if desired.MaxMsgsPerSubject != 0 {
+		config.MaxMsgsPerSubject = desired.MaxMsgsPerSubject
+	}
+
+	// Duplicates window can't be longer than messages are kept
+	if config.MaxAge > 0 && config.Duplicates > config.MaxAge {
+		config.Duplicates = config.MaxAge
+	}
+
+	_, err = js.UpdateStream(&config)
+
+	return err
+}
+
+// streamDrift describe differences of the stream config from the desired one.
+// Only fields set by the server are compared, zero subjects and byte or per subject limits are not.
+func streamDrift(actual, desired nats.StreamConfig) []string {
+	var drift []string
+
+	diff := func(field string, got, want interface{}) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			drift = append(drift, fmt.Sprintf("%s is %v, want %v", field, got, want))
+		}
+	}
+
+	if len(desired.Subjects) > 0 {
+		diff("subjects", actual.Subjects, desired.Subjects)
+	}
+
+	diff("retention", actual.Retention, desired.Retention)
+	diff("storage", actual.Storage, desired.Storage)
+	diff("replicas", actual.Replicas, desired.Replicas)
+	diff("max age", actual.MaxAge, desired.MaxAge)
+	diff("no ack", actual.NoAck, desired.NoAck)
+
+	if desired.MaxBytes != 0 {
+		diff("max bytes", actual.MaxBytes, desired.MaxBytes)
+	}
+
+	if desired.MaxMsgsPerSubject != 0 {
+		diff("max messages per subject", actual.MaxMsgsPerSubject, desired.MaxMsgsPerSubject)
+	}
+
+	return drift
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseJetStreamConfig(t *testing.T) {
+	config, err := ParseJetStreamConfig("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultJetStreamConfig, config)
+
+	config, err = ParseJetStreamConfig("3", "memory")
+	assert.NoError(t, err)
+	assert.Equal(t, JetStreamConfig{Replicas: 3, Storage: nats.MemoryStorage, Presence: DefaultPresenceConfig}, config)
+
+	_, err = ParseJetStreamConfig("0", "")
+	assert.Error(t, err)
+
+	_, err = ParseJetStreamConfig("", "disk")
+	assert.Error(t, err)
+}
+
+func TestStreamConfigDrift(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	nc, err := nats.Connect(embedded.URL())
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer nc.Close()
+
+	jsc, _ := nc.JetStream()
+
+	// Streams of previous versions were created without publish acks
+	_, err = jsc.AddStream(&nats.StreamConfig{Name: StreamName, Subjects: []string{StreamName + ".*.*"}, NoAck: true})
+	assert.NoError(t, err)
+
+	// Bucket handles were created with each request
+	_, err = jsc.CreateKeyValue(&nats.KeyValueConfig{Bucket: chitchat.PresenceBucket("general"), TTL: time.Hour})
+	assert.NoError(t, err)
+
+	js, err := NewStream(nc, DefaultStreamConfig, DefaultJetStreamConfig, log.New("test"))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	info, err := jsc.StreamInfo(StreamName)
+	if assert.NoError(t, err) {
+		assert.False(t, info.Config.NoAck)
+	}
+
+	store := NewJetStreamStorage(js)
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(NewUser("Jon Snow", ""), time.Now(), "Winter is coming")))
+
+	presence, err := js.PresenceBucket("general")
+	assert.NoError(t, err)
+
+	info, err = jsc.StreamInfo("KV_" + chitchat.PresenceBucket("general"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, DefaultPresenceConfig.TTL, info.Config.MaxAge)
+	}
+
+	// Handle is kept
+	cached, _ := js.PresenceBucket("general")
+	assert.Equal(t, presence, cached)
+
+	// Storage can't be changed without recreating streams
+	_, err = NewStream(nc, DefaultStreamConfig, JetStreamConfig{Replicas: 1, Storage: nats.MemoryStorage}, log.New("test"))
+	assert.ErrorContains(t, err, "storage")
+}
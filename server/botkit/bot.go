@@ -0,0 +1,195 @@
+// Package botkit is a small SDK for building ChitChat bots.
+//
+//	bot := botkit.New("http://localhost:8080", "Echo Bot", "lobby")
+//
+//	bot.OnMessage(func(b *botkit.Bot, msg botkit.ChannelMessage) {
+//		b.Reply(msg, msg.Text)
+//	})
+//
+//	bot.OnCommand("ping", func(b *botkit.Bot, cmd botkit.Command) {
+//		b.Send("pong")
+//	})
+//
+//	log.Fatal(bot.Run(context.Background()))
+package botkit
+
+import (
+	"context"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/faustman/chitchat/server/client"
+)
+
+// ErrNotConnected returned when bot try to send message without connection.
+var ErrNotConnected = client.ErrNotConnected
+
+// MessageHandler handle channel events.
+// Handlers are called one by one from the connection read loop.
+type MessageHandler func(b *Bot, msg ChannelMessage)
+
+// CommandHandler handle commands routed to the bot.
+type CommandHandler func(b *Bot, cmd Command)
+
+// Bot is a channel member driven by handlers.
+type Bot struct {
+	// Bot name, email and channel used for authentication.
+	Name    string
+	Email   string
+	Channel string
+
+	// Authorized bot user, available after Run.
+	User *User
+
+	// API client, could be tuned before Run.
+	Client *client.Client
+
+	// Logger for connection issues.
+	Logger *log.Logger
+
+	// Bot own messages are skipped by default.
+	HandleOwnMessages bool
+
+	onMessage []MessageHandler
+	onJoin    []MessageHandler
+	onLeave   []MessageHandler
+	commands  map[string]CommandHandler
+
+	conn *client.Conn
+}
+
+// New build new Bot.
+func New(serverURL, name, channel string) *Bot {
+	return &Bot{
+		Name:     name,
+		Channel:  channel,
+		Client:   client.New(serverURL),
+		Logger:   log.New(os.Stderr, "botkit: ", log.LstdFlags),
+		commands: make(map[string]CommandHandler),
+	}
+}
+
+// OnMessage register handler for text messages.
+func (b *Bot) OnMessage(h MessageHandler) {
+	b.onMessage = append(b.onMessage, h)
+}
+
+// OnJoin register handler for users joining the channel.
+func (b *Bot) OnJoin(h MessageHandler) {
+	b.onJoin = append(b.onJoin, h)
+}
+
+// OnLeave register handler for users leaving the channel.
+func (b *Bot) OnLeave(h MessageHandler) {
+	b.onLeave = append(b.onLeave, h)
+}
+
+// OnCommand register handler for slash command routed to bots, eg. "deploy" for "/deploy prod".
+func (b *Bot) OnCommand(name string, h CommandHandler) {
+	b.commands[strings.ToLower(strings.TrimPrefix(name, "/"))] = h
+}
+
+// Run connect bot to the channel and handle events until context is done.
+// Connection is restored automatically, missed messages are fetched from history.
+func (b *Bot) Run(ctx context.Context) error {
+	auth, err := b.Client.Login(ctx, b.Name, b.Email, b.Channel)
+	if err != nil {
+		return err
+	}
+
+	b.User = auth.User
+	b.conn = b.Client.Connect(ctx)
+
+	for event := range b.conn.Events() {
+		switch event.Type {
+		case client.EventMessage:
+			b.dispatch(event.Message)
+		case client.EventDisconnected:
+			b.Logger.Printf("connection lost: %v", event.Err)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// Send text message to the channel.
+// Leading slash is escaped, use Command to run slash commands.
+func (b *Bot) Send(text string) error {
+	if strings.HasPrefix(text, "/") {
+		text = "/" + text
+	}
+
+	return b.write(text)
+}
+
+// Reply to the message author.
+func (b *Bot) Reply(msg ChannelMessage, text string) error {
+	if msg.FromUser == nil {
+		return b.Send(text)
+	}
+
+	return b.Send("@" + msg.FromUser.Name + " " + text)
+}
+
+// Me send action message, eg. "/me waves".
+func (b *Bot) Me(text string) error {
+	return b.Command("me " + text)
+}
+
+// Command run slash command, eg. "topic Release day".
+func (b *Bot) Command(cmd string) error {
+	return b.write("/" + strings.TrimPrefix(cmd, "/"))
+}
+
+// Messages fetch channel history, starting from time if it's not zero.
+func (b *Bot) Messages(ctx context.Context, start time.Time) ([]ChannelMessage, error) {
+	return b.Client.Messages(ctx, start)
+}
+
+// Users fetch channel members online.
+func (b *Bot) Users(ctx context.Context) ([]User, error) {
+	return b.Client.Users(ctx)
+}
+
+// dispatch message to registered handlers.
+func (b *Bot) dispatch(msg ChannelMessage) {
+	if !b.HandleOwnMessages && msg.FromUser != nil && b.User != nil && msg.FromUser.Id == b.User.Id {
+		return
+	}
+
+	switch msg.Type {
+	case chitchat.TypeMessage:
+		for _, h := range b.onMessage {
+			h(b, msg)
+		}
+	case chitchat.TypeJoin:
+		for _, h := range b.onJoin {
+			h(b, msg)
+		}
+	case chitchat.TypeLeave:
+		for _, h := range b.onLeave {
+			h(b, msg)
+		}
+	case chitchat.TypeCommand:
+		cmd, ok := parseCommand(msg)
+		if !ok {
+			return
+		}
+
+		if h, ok := b.commands[cmd.Name]; ok {
+			h(b, cmd)
+		}
+	}
+}
+
+// write text frame to the channel.
+func (b *Bot) write(text string) error {
+	if b.conn == nil {
+		return ErrNotConnected
+	}
+
+	return b.conn.Send(text)
+}
@@ -0,0 +1,112 @@
+package botkit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+var botUser = &User{Id: "bot", Name: "Bot"}
+
+// fakeServer emulate ChitChat API, sending events to the bot and collecting bot messages.
+func fakeServer(t *testing.T, events []ChannelMessage, received chan string) *httptest.Server {
+	upgrader := websocket.Upgrader{}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			assert.Equal(t, "Bot", r.FormValue("name"))
+			assert.Equal(t, "lobby", r.FormValue("channel"))
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"user": botUser, "channel": "lobby"})
+	})
+
+	mux.HandleFunc("/channel", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.URL.Query().Get("token"))
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		for _, event := range events {
+			ws.WriteJSON(event)
+		}
+
+		for {
+			_, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			received <- string(data)
+		}
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func TestBotHandlers(t *testing.T) {
+	alice := &User{Id: "alice", Name: "Alice"}
+	now := time.Now()
+
+	events := []ChannelMessage{
+		{Type: "join", FromUser: alice, SentAt: now},
+		{Type: "message", FromUser: botUser, SentAt: now.Add(1 * time.Millisecond), Text: "own message"},
+		{Type: "message", FromUser: alice, SentAt: now.Add(2 * time.Millisecond), Text: "hello"},
+		{Type: "command", FromUser: alice, SentAt: now.Add(3 * time.Millisecond), Text: "/deploy prod"},
+	}
+
+	received := make(chan string, 10)
+
+	server := fakeServer(t, events, received)
+	defer server.Close()
+
+	bot := New(server.URL, "Bot", "lobby")
+
+	var joined []string
+
+	bot.OnJoin(func(b *Bot, msg ChannelMessage) {
+		joined = append(joined, msg.FromUser.Name)
+	})
+
+	bot.OnMessage(func(b *Bot, msg ChannelMessage) {
+		b.Reply(msg, msg.Text)
+	})
+
+	bot.OnCommand("/deploy", func(b *Bot, cmd Command) {
+		assert.Equal(t, []string{"prod"}, cmd.Args)
+		assert.Equal(t, alice, cmd.FromUser)
+
+		b.Send("/deploying " + cmd.Text)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go bot.Run(ctx)
+
+	assert.Equal(t, "@Alice hello", <-received)
+	assert.Equal(t, "//deploying prod", <-received)
+	assert.Equal(t, []string{"Alice"}, joined)
+	assert.Equal(t, botUser, bot.User)
+}
+
+func TestBotSendWithoutConnection(t *testing.T) {
+	bot := New("http://localhost", "Bot", "lobby")
+
+	assert.Equal(t, ErrNotConnected, bot.Send("hello"))
+}
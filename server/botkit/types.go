@@ -0,0 +1,49 @@
+package botkit
+
+import (
+	"strings"
+
+	"github.com/faustman/chitchat/server/chitchat"
+)
+
+// User is a channel member.
+type User = chitchat.User
+
+// ChannelMessage is an event received from the channel.
+type ChannelMessage = chitchat.ChannelMessage
+
+// Command routed to the bot, eg. "/deploy prod".
+type Command struct {
+	// Command name without leading slash.
+	Name string
+
+	// Arguments splitted by whitespaces.
+	Args []string
+
+	// Raw arguments string.
+	Text string
+
+	// Command issuer.
+	FromUser *User
+}
+
+// parseCommand from "command" message text.
+func parseCommand(msg ChannelMessage) (Command, bool) {
+	if !strings.HasPrefix(msg.Text, "/") {
+		return Command{}, false
+	}
+
+	name, text, _ := strings.Cut(msg.Text[1:], " ")
+	if len(name) == 0 {
+		return Command{}, false
+	}
+
+	text = strings.TrimSpace(text)
+
+	return Command{
+		Name:     strings.ToLower(name),
+		Args:     strings.Fields(text),
+		Text:     text,
+		FromUser: msg.FromUser,
+	}, true
+}
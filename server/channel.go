@@ -1,37 +1,28 @@
 package main
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/faustman/chitchat/server/chitchat"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
-	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
 )
 
-var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		// For dev purpose only: if u want to skip origin checking
-		// CheckOrigin: func(r *http.Request) bool { return true },
-	}
-)
+// ChannelMessage unsing for communication in channel, shared with clients.
+type ChannelMessage = chitchat.ChannelMessage
 
-// ChannelMessage unsing for communication in channel.
-type ChannelMessage struct {
-	Type     string    `json:"type"`
-	FromUser *User     `json:"from_user"`
-	SentAt   time.Time `json:"sent_at"`
-	Text     string    `json:"text,omitempty"`
-}
-
-// NewChannelMessage build new text ChannelMessage.
+// NewChannelMessage build new text ChannelMessage with unique id.
 func NewChannelMessage(user *User, sentAt time.Time, text string) ChannelMessage {
 	return ChannelMessage{
-		Type:     "message",
+		Id:       nuid.Next(),
+		Type:     chitchat.TypeMessage,
 		FromUser: user,
 		SentAt:   sentAt,
 		Text:     text,
@@ -41,7 +32,7 @@ func NewChannelMessage(user *User, sentAt time.Time, text string) ChannelMessage
 // NewChannelMessage build new join ChannelMessage.
 func NewChannelJoinMessage(user *User, sentAt time.Time) ChannelMessage {
 	return ChannelMessage{
-		Type:     "join",
+		Type:     chitchat.TypeJoin,
 		FromUser: user,
 		SentAt:   sentAt,
 	}
@@ -50,45 +41,206 @@ func NewChannelJoinMessage(user *User, sentAt time.Time) ChannelMessage {
 // NewChannelMessage build new leave ChannelMessage.
 func NewChannelLeaveMessage(user *User, sentAt time.Time) ChannelMessage {
 	return ChannelMessage{
-		Type:     "leave",
+		Type:     chitchat.TypeLeave,
+		FromUser: user,
+		SentAt:   sentAt,
+	}
+}
+
+// NewChannelActionMessage build new action ChannelMessage, eg. "/me waves".
+func NewChannelActionMessage(user *User, sentAt time.Time, text string) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeAction,
+		FromUser: user,
+		SentAt:   sentAt,
+		Text:     text,
+	}
+}
+
+// NewChannelTopicMessage build new topic ChannelMessage.
+func NewChannelTopicMessage(user *User, sentAt time.Time, topic string) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeTopic,
+		FromUser: user,
+		SentAt:   sentAt,
+		Text:     topic,
+	}
+}
+
+// NewChannelNickMessage build new nick ChannelMessage, text contains previous user name.
+func NewChannelNickMessage(user *User, sentAt time.Time, oldName string) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeNick,
+		FromUser: user,
+		SentAt:   sentAt,
+		Text:     oldName,
+	}
+}
+
+// NewChannelKickMessage build new kick ChannelMessage.
+func NewChannelKickMessage(user *User, sentAt time.Time, target *User) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeKick,
+		FromUser: user,
+		SentAt:   sentAt,
+		Target:   target,
+	}
+}
+
+// NewChannelCommandMessage build new command ChannelMessage for bots, text contains raw command.
+func NewChannelCommandMessage(user *User, sentAt time.Time, cmd Command) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeCommand,
 		FromUser: user,
 		SentAt:   sentAt,
+		Text:     strings.TrimSpace("/" + cmd.Name + " " + cmd.Text),
+	}
+}
+
+// NewChannelEphemeralMessage build new ephemeral ChannelMessage, visible only for one consumer.
+func NewChannelEphemeralMessage(sentAt time.Time, text string) ChannelMessage {
+	return ChannelMessage{
+		Type:   chitchat.TypeEphemeral,
+		SentAt: sentAt,
+		Text:   text,
+	}
+}
+
+// NewChannelErrorMessage build new error ChannelMessage, it's sent only to the user which caused it.
+func NewChannelErrorMessage(sentAt time.Time, text string) ChannelMessage {
+	return ChannelMessage{
+		Type:   chitchat.TypeError,
+		SentAt: sentAt,
+		Text:   text,
+	}
+}
+
+// NewChannelTypingMessage build new typing ChannelMessage, it's never stored in the stream.
+func NewChannelTypingMessage(user *User, sentAt time.Time) ChannelMessage {
+	return ChannelMessage{
+		Type:     chitchat.TypeTyping,
+		FromUser: user,
+		SentAt:   sentAt,
+	}
+}
+
+// NewChannelMessageEditedMessage build new message_edited ChannelMessage with new text of the message.
+func NewChannelMessageEditedMessage(user *User, sentAt time.Time, id, text string) ChannelMessage {
+	return ChannelMessage{
+		Id:       id,
+		Type:     chitchat.TypeMessageEdited,
+		FromUser: user,
+		SentAt:   sentAt,
+		Text:     text,
+	}
+}
+
+// NewChannelMessageDeletedMessage build new message_deleted ChannelMessage.
+func NewChannelMessageDeletedMessage(user *User, sentAt time.Time, id string) ChannelMessage {
+	return ChannelMessage{
+		Id:       id,
+		Type:     chitchat.TypeMessageDeleted,
+		FromUser: user,
+		SentAt:   sentAt,
+	}
+}
+
+// NewChannelSentMessage build new sent ChannelMessage, it's sent only to the author once message is stored.
+func NewChannelSentMessage(sentAt time.Time, id, clientId string, seq uint64) ChannelMessage {
+	return ChannelMessage{
+		Id:       id,
+		Type:     chitchat.TypeSent,
+		SentAt:   sentAt,
+		ClientId: clientId,
+		Seq:      seq,
+	}
+}
+
+// ErrMessageNotSent is replied when message is not stored, so client could retry it.
+var ErrMessageNotSent = errors.New("Message is not sent, try again")
+
+// clientMessageId of the message sent with client id, retries get the same id, so it's used as dedup key.
+func clientMessageId(channel, userId, clientId string) string {
+	hash := sha256.Sum256([]byte(channel + "\x00" + userId + "\x00" + clientId))
+
+	return hex.EncodeToString(hash[:11])
+}
+
+// SendMessage publish text message of the user and wait until it's stored.
+// Messages with the same client id are stored once, returned message has its stream Seq and ClientId.
+func SendMessage(store *Storage, channel string, user *User, text, clientId string) (ChannelMessage, bool, error) {
+	msg := NewChannelMessage(user, time.Now(), text)
+
+	opts := PublishOptions{}
+	if len(clientId) > 0 {
+		msg.Id = clientMessageId(channel, user.Id, clientId)
+		opts.DedupKey = msg.Id
+	}
+
+	ack, err := store.Broker.PublishAck(channel, EventMessage, msg, opts)
+	if err != nil {
+		return msg, false, err
 	}
+
+	msg.ClientId, msg.Seq = clientId, ack.Seq
+
+	return msg, ack.Duplicate, nil
 }
 
 // channelHandler handle channel stuff.
 type channelHandler struct {
-	// NATS JetStream context
-	stream nats.JetStreamContext
+	// Channel events, history and presence
+	store *Storage
 
 	// Consumers hub
 	hub *ConsumersHub
+
+	// Slash commands
+	commands *CommandsRegistry
+
+	// Long-polling sessions
+	polls *LongPollHub
+
+	// WebSocket configuration
+	wsConfig WSConfig
+	upgrader websocket.Upgrader
 }
 
 // NewChannelHandler build new channelHandler.
-func NewChannelHandler(stream nats.JetStreamContext, hub *ConsumersHub) *channelHandler {
+func NewChannelHandler(store *Storage, hub *ConsumersHub, commands *CommandsRegistry, polls *LongPollHub, wsConfig WSConfig) *channelHandler {
 	return &channelHandler{
-		stream: stream,
-		hub:    hub,
+		store:    store,
+		hub:      hub,
+		commands: commands,
+		polls:    polls,
+		wsConfig: wsConfig,
+		upgrader: NewUpgrader(wsConfig),
 	}
 }
 
 // Listen to incoming websocket connection and register new consumer.
+// With "batch" query param several events could be sent in one frame, see wsTransport.
 func (h channelHandler) Listen(c echo.Context) error {
-	// Upgrade to ws
-	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	auth := ExtactAuth(c)
+
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
 	if err != nil {
 		return err
 	}
 
-	auth := ExtactAuth(c)
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
+
+	batch, _ := strconv.ParseBool(c.QueryParam("batch"))
 
-	presence, err := GetPresenceBucket(h.stream, auth.Channel)
+	// Upgrade to ws
+	ws, err := h.upgrader.Upgrade(c.Response(), c.Request(), nil)
 	if err != nil {
 		return err
 	}
 
-	consumer := NewConsumer(auth.Channel, auth.User, ws, h.hub, h.stream, presence, c.Logger())
+	consumer := NewConsumer(auth.Channel, auth.User, NewWSTransport(ws, h.wsConfig, batch), h.hub, h.store, h.commands, c.Logger())
 
 	consumer.Register()
 
@@ -101,83 +253,129 @@ func (h channelHandler) Listen(c echo.Context) error {
 func (h channelHandler) GetMessages(c echo.Context) error {
 	auth := ExtactAuth(c)
 
-	opts := []nats.SubOpt{nats.OrderedConsumer()}
+	query := MessageQuery{}
 
 	st := c.QueryParam("start_time")
 
 	// fetch("/messages?token=" + token + "&start_time=" + Math.round(1658877495926 / 1000)).then((r) => r.json()).then(console.log).catch(console.error)
+	// Or with sub-second precision: "/messages?start_time=2022-07-26T23:18:15.926Z"
 	if len(st) > 0 {
-		unix, err := strconv.ParseInt(st, 10, 64)
-		if err != nil {
-			return err
+		if unix, err := strconv.ParseInt(st, 10, 64); err == nil {
+			query.Since = time.Unix(unix, 0)
+		} else if since, err := time.Parse(time.RFC3339Nano, st); err == nil {
+			query.Since = since
+		} else {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid start_time")
 		}
+	}
 
-		opts = append(opts, nats.StartTime(time.Unix(unix, 0)))
+	// Paging back in history: "/messages?before=<id>&limit=50"
+	query.Before = c.QueryParam("before")
+
+	if l := c.QueryParam("limit"); len(l) > 0 {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid limit")
+		}
+
+		query.Limit = limit
 	}
 
-	sub, err := h.stream.SubscribeSync(MessageSubject(auth.Channel), opts...)
+	messages, err := h.store.Messages.Messages(auth.Channel, query)
 	if err != nil {
 		return err
 	}
 
-	info, err := h.stream.StreamInfo(StreamName)
+	return c.JSON(http.StatusCreated, echo.Map{
+		"messages": messages,
+	})
+}
+
+// ownMessage find message by id param, it should be sent by current user.
+func (h channelHandler) ownMessage(c echo.Context, action string) (*ChannelMessage, error) {
+	auth := ExtactAuth(c)
+
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// We need to know how much to iterate until the end
-	lastSeq := info.State.LastSeq
 
-	// Geeting all messages from the stream
-	var messages []ChannelMessage
+	if banned {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
 
-	for i := uint64(0); i < lastSeq; i++ {
-		m, err := sub.NextMsg(1 * time.Second)
+	msg, err := h.store.Messages.Message(auth.Channel, c.Param("id"))
+	if errors.Is(err, ErrMessageNotFound) {
+		return nil, echo.NewHTTPError(http.StatusNotFound, "Message not found")
+	}
 
-		if err == nil {
-			msg := ChannelMessage{}
+	if err != nil {
+		return nil, err
+	}
 
-			if err := json.Unmarshal(m.Data, &msg); err != nil {
-				return err
-			}
+	if msg.FromUser == nil || msg.FromUser.Id != auth.User.Id {
+		return nil, echo.NewHTTPError(http.StatusForbidden, "You can "+action+" only your messages")
+	}
 
-			messages = append(messages, msg)
-		} else {
-			break
-		}
+	return msg, nil
+}
+
+// EditMessage replace text of own message, message_edited is sent to the channel.
+func (h channelHandler) EditMessage(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	text := c.FormValue("text")
+	if len(strings.TrimSpace(text)) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Text can't be blank")
 	}
 
-	sub.Unsubscribe()
+	if err := h.hub.limits.Check(auth.Channel, text); err != nil {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
 
-	return c.JSON(http.StatusCreated, echo.Map{
-		"messages": messages,
-	})
+	msg, err := h.ownMessage(c, "edit")
+	if err != nil {
+		return err
+	}
+
+	edit := NewChannelMessageEditedMessage(auth.User, time.Now(), msg.Id, text)
+
+	if err := h.store.Broker.Publish(auth.Channel, EventMessage, edit); err != nil {
+		c.Logger().Errorf("Publish error: %v", err)
+
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrMessageNotSent.Error())
+	}
+
+	applyEdit(msg, edit)
+
+	return c.JSON(http.StatusOK, msg)
 }
 
-// GetUsers from channel presence store
-func (h channelHandler) GetUsers(c echo.Context) error {
+// DeleteMessage remove own message from history, message_deleted is sent to the channel.
+func (h channelHandler) DeleteMessage(c echo.Context) error {
 	auth := ExtactAuth(c)
 
-	presence, err := GetPresenceBucket(h.stream, auth.Channel)
+	msg, err := h.ownMessage(c, "delete")
 	if err != nil {
 		return err
 	}
 
-	var users []User
+	if err := h.store.Broker.Publish(auth.Channel, EventMessage, NewChannelMessageDeletedMessage(auth.User, time.Now(), msg.Id)); err != nil {
+		c.Logger().Errorf("Publish error: %v", err)
 
-	uids, _ := presence.Keys()
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrMessageNotSent.Error())
+	}
 
-	for _, uid := range uids {
-		entry, err := presence.Get(uid)
-		if err != nil {
-			return err
-		}
+	return c.NoContent(http.StatusNoContent)
+}
 
-		user := User{}
-		if err := json.Unmarshal(entry.Value(), &user); err != nil {
-			return err
-		}
+// GetUsers from channel presence store
+func (h channelHandler) GetUsers(c echo.Context) error {
+	auth := ExtactAuth(c)
 
-		users = append(users, user)
+	users, err := h.store.Presence.Users(auth.Channel)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusCreated, echo.Map{
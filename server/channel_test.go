@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testChannelHandler build channel handler on top of the storage.
+func testChannelHandler(store *Storage) *channelHandler {
+	hub := NewConsumersHub(DefaultSendQueueConfig, DefaultMessageLimits)
+
+	return NewChannelHandler(store, hub, NewCommandsRegistry(nil, nil), NewLongPollHub(store), DefaultWSConfig)
+}
+
+// testContext build request context authenticated as user in "general" channel.
+func testContext(req *http.Request, user *User) (echo.Context, *httptest.ResponseRecorder) {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+	c.Set("token", &jwt.Token{Claims: &Auth{User: user, Channel: "general"}})
+
+	return c, rec
+}
+
+// receive events until timeout.
+func receive(events chan Event, n int) []Event {
+	var received []Event
+
+	timeout := time.After(time.Second)
+
+	for len(received) < n {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		case <-timeout:
+			return received
+		}
+	}
+
+	return received
+}
+
+func TestPostMessage(t *testing.T) {
+	testPostMessage(t, NewMemoryStorage())
+}
+
+// testPostMessage check that posted message is delivered to subscribers and stored, same for all storages.
+func testPostMessage(t *testing.T, store *Storage) {
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	events := make(chan Event, 1)
+	_, err := store.Broker.Subscribe("general", SubscribeOptions{}, chanHandler(events))
+	assert.NoError(t, err)
+
+	form := url.Values{"text": {"Winter is coming"}}
+	req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	c, rec := testContext(req, user)
+
+	if assert.NoError(t, h.PostMessage(c)) {
+		assert.Equal(t, http.StatusCreated, rec.Code)
+
+		received := receive(events, 1)
+		if assert.Len(t, received, 1) {
+			assert.Equal(t, EventMessage, received[0].Kind)
+			assert.Contains(t, string(received[0].Data), "Winter is coming")
+		}
+	}
+
+	messages, err := store.Messages.Messages("general", MessageQuery{})
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "Winter is coming", messages[0].Text)
+		assert.Equal(t, user.Id, messages[0].FromUser.Id)
+	}
+}
+
+func TestSendMessageDedup(t *testing.T) {
+	testSendMessageDedup(t, NewMemoryStorage())
+}
+
+// testSendMessageDedup check that retried message is stored once and acked with the same sequence, same for all storages.
+func testSendMessageDedup(t *testing.T, store *Storage) {
+	user := NewUser("Jon Snow", "")
+
+	msg, duplicate, err := SendMessage(store, "general", user, "Winter is coming", "retry-1")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.False(t, duplicate)
+	assert.NotZero(t, msg.Seq)
+	assert.Equal(t, "retry-1", msg.ClientId)
+
+	retry, duplicate, err := SendMessage(store, "general", user, "Winter is coming", "retry-1")
+	if assert.NoError(t, err) {
+		assert.True(t, duplicate)
+		assert.Equal(t, msg.Id, retry.Id)
+		assert.Equal(t, msg.Seq, retry.Seq)
+	}
+
+	// Other keys and plain messages are stored as usual
+	other, duplicate, err := SendMessage(store, "general", user, "Winter is coming", "retry-2")
+	if assert.NoError(t, err) {
+		assert.False(t, duplicate)
+		assert.NotEqual(t, msg.Id, other.Id)
+	}
+
+	_, duplicate, err = SendMessage(store, "general", user, "Winter is coming", "")
+	assert.NoError(t, err)
+	assert.False(t, duplicate)
+
+	messages, err := store.Messages.Messages("general", MessageQuery{})
+	if assert.NoError(t, err) && assert.Len(t, messages, 3) {
+		assert.Equal(t, msg.Id, messages[0].Id)
+		assert.Empty(t, messages[0].ClientId)
+	}
+}
+
+func TestParseOutgoingMessage(t *testing.T) {
+	out := ParseOutgoingMessage([]byte(`{"text":"Winter is coming","client_id":"retry-1"}`))
+	assert.Equal(t, "Winter is coming", out.Text)
+	assert.Equal(t, "retry-1", out.ClientId)
+
+	// Plain text, even if it looks like JSON
+	for _, text := range []string{"Winter is coming", `{"text":"Winter is coming"}`, "{oops"} {
+		out = ParseOutgoingMessage([]byte(text))
+		assert.Equal(t, text, out.Text)
+		assert.Empty(t, out.ClientId)
+	}
+}
+
+func TestPostMessageBanned(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	store.Bans.(*memoryStore).Ban("general", user.Id)
+
+	form := url.Values{"text": {"Winter is coming"}}
+	req := httptest.NewRequest(http.MethodPost, "/messages", strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	c, _ := testContext(req, user)
+
+	err := h.PostMessage(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	assert.Len(t, messages, 0)
+}
+
+func TestGetMessages(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(1000, 0), "old"))
+	store.Broker.Publish("general", EventPresence, NewChannelJoinMessage(user, time.Unix(2000, 0)))
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(3000, 0), "new"))
+	store.Broker.Publish("lobby", EventMessage, NewChannelMessage(user, time.Unix(3000, 0), "other"))
+
+	c, rec := testContext(httptest.NewRequest(http.MethodGet, "/messages?start_time=2000", nil), user)
+
+	if assert.NoError(t, h.GetMessages(c)) {
+		res := struct {
+			Messages []ChannelMessage `json:"messages"`
+		}{}
+
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+		if assert.Len(t, res.Messages, 1) {
+			assert.Equal(t, "new", res.Messages[0].Text)
+		}
+	}
+}
+
+func TestGetMessagesSubsecond(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(1000, 100), "old"))
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(1000, 500), "new"))
+
+	start := time.Unix(1000, 500).UTC().Format(time.RFC3339Nano)
+	c, rec := testContext(httptest.NewRequest(http.MethodGet, "/messages?start_time="+url.QueryEscape(start), nil), user)
+
+	if assert.NoError(t, h.GetMessages(c)) {
+		res := struct {
+			Messages []ChannelMessage `json:"messages"`
+		}{}
+
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+		if assert.Len(t, res.Messages, 1) {
+			assert.Equal(t, "new", res.Messages[0].Text)
+		}
+	}
+
+	c, _ = testContext(httptest.NewRequest(http.MethodGet, "/messages?start_time=yesterday", nil), user)
+
+	err := h.GetMessages(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusBadRequest, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestGetUsers(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	// Second connection of the same user doesn't join again
+	first := Join(store, "general", user)
+	assert.True(t, first.Joined())
+
+	second := Join(store, "general", user)
+	assert.False(t, second.Joined())
+
+	c, rec := testContext(httptest.NewRequest(http.MethodGet, "/users", nil), user)
+
+	if assert.NoError(t, h.GetUsers(c)) {
+		res := struct {
+			Users []User `json:"users"`
+		}{}
+
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+
+		if assert.Len(t, res.Users, 1) {
+			assert.Equal(t, "Jon Snow", res.Users[0].Name)
+		}
+	}
+
+	assert.False(t, second.Leave())
+	assert.True(t, first.Leave())
+
+	// Only the first leave counts
+	assert.False(t, first.Leave())
+
+	users, err := store.Presence.Users("general")
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+}
+
+func TestSubscribeStartSeq(t *testing.T) {
+	store := NewMemoryStorage()
+	user := NewUser("Jon Snow", "")
+
+	for _, text := range []string{"one", "two", "three"} {
+		store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), text))
+	}
+
+	events := make(chan Event, 8)
+	sub, err := store.Broker.Subscribe("general", SubscribeOptions{StartSeq: 2}, chanHandler(events))
+	assert.NoError(t, err)
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "four"))
+	sub.Unsubscribe()
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "five"))
+
+	var seqs []uint64
+	for len(events) > 0 {
+		seqs = append(seqs, (<-events).Seq)
+	}
+
+	assert.Equal(t, []uint64{2, 3, 4}, seqs)
+}
+
+func TestEditMessage(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	msg := NewChannelMessage(user, time.Now(), "Winter is comming")
+	store.Broker.Publish("general", EventMessage, msg)
+
+	edit := func(user *User, id, text string) (*httptest.ResponseRecorder, error) {
+		form := url.Values{"text": {text}}
+		req := httptest.NewRequest(http.MethodPatch, "/messages/"+id, strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+		c, rec := testContext(req, user)
+		c.SetParamNames("id")
+		c.SetParamValues(id)
+
+		return rec, h.EditMessage(c)
+	}
+
+	_, err := edit(NewUser("Arya Stark", ""), msg.Id, "Winter is here")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+
+	_, err = edit(user, "missing", "Winter is here")
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusNotFound, err.(*echo.HTTPError).Code)
+	}
+
+	rec, err := edit(user, msg.Id, "Winter is coming")
+	if assert.NoError(t, err) {
+		assert.Equal(t, http.StatusOK, rec.Code)
+	}
+
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Winter is coming", messages[0].Text)
+		assert.NotNil(t, messages[0].EditedAt)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	msg := NewChannelMessage(user, time.Now(), "Winter is coming")
+	store.Broker.Publish("general", EventMessage, msg)
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "You know nothing"))
+
+	c, rec := testContext(httptest.NewRequest(http.MethodDelete, "/messages/"+msg.Id, nil), user)
+	c.SetParamNames("id")
+	c.SetParamValues(msg.Id)
+
+	if assert.NoError(t, h.DeleteMessage(c)) {
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	}
+
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "You know nothing", messages[0].Text)
+	}
+}
+
+// failingBroker fail all publishes, eg. when NATS is down.
+type failingBroker struct {
+	Broker
+}
+
+func (b failingBroker) Publish(channel, kind string, msg ChannelMessage) error {
+	return errors.New("nats: timeout")
+}
+
+func (b failingBroker) PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error) {
+	return PublishAck{}, errors.New("nats: timeout")
+}
+
+func TestEditDeleteMessageNotSent(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	msg := NewChannelMessage(user, time.Now(), "Winter is coming")
+	store.Broker.Publish("general", EventMessage, msg)
+
+	store.Broker = failingBroker{store.Broker}
+
+	form := url.Values{"text": {"Winter is here"}}
+	req := httptest.NewRequest(http.MethodPatch, "/messages/"+msg.Id, strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	c, _ := testContext(req, user)
+	c.SetParamNames("id")
+	c.SetParamValues(msg.Id)
+
+	err := h.EditMessage(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*echo.HTTPError).Code)
+	}
+
+	c, _ = testContext(httptest.NewRequest(http.MethodDelete, "/messages/"+msg.Id, nil), user)
+	c.SetParamNames("id")
+	c.SetParamValues(msg.Id)
+
+	err = h.DeleteMessage(c)
+	if assert.Error(t, err) {
+		assert.Equal(t, http.StatusServiceUnavailable, err.(*echo.HTTPError).Code)
+	}
+
+	// Nothing is changed
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Winter is coming", messages[0].Text)
+	}
+}
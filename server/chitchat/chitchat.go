@@ -0,0 +1,162 @@
+// Package chitchat contains ChitChat wire types shared by the server and clients.
+package chitchat
+
+import (
+	"crypto/md5"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+)
+
+// Channel message types.
+const (
+	TypeMessage    = "message"
+	TypeJoin       = "join"
+	TypeLeave      = "leave"
+	TypeAction     = "action"
+	TypeTopic      = "topic"
+	TypeNick       = "nick"
+	TypeKick       = "kick"
+	TypeCommand    = "command"
+	TypeEphemeral  = "ephemeral"
+	TypeTyping     = "typing"
+	TypeError      = "error"
+	TypeAttachment = "attachment"
+
+	// Attachment previews are ready, message contains updated Attachment.
+	TypeAttachmentUpdated = "attachment_updated"
+
+	// Link previews are ready, message contains Id of updated message and its Previews.
+	TypeMessageUpdated = "message_updated"
+
+	// Message was edited by its author, message contains Id of edited message and new Text.
+	TypeMessageEdited = "message_edited"
+
+	// Message was deleted by its author, message contains Id of deleted message.
+	TypeMessageDeleted = "message_deleted"
+
+	// Message of the user is stored, sent only to the user with Id, Seq and ClientId of the message.
+	TypeSent = "sent"
+)
+
+// User is a channel member.
+type User struct {
+	Id     string `json:"id"`
+	Name   string `json:"name"`
+	Email  string `json:"-"`
+	Avatar string `json:"avatar,omitempty"`
+}
+
+// NewUser will generate new users based on name and email.
+// Id generating by name + email.
+// If email present, Avatar will be fullfiled with Gravatar url.
+func NewUser(name, email string) *User {
+	id := md5.Sum([]byte(name + email))
+
+	user := User{
+		Id:    fmt.Sprintf("%x", id),
+		Name:  name,
+		Email: email,
+	}
+
+	if len(email) > 0 {
+		user.Avatar = generateGravatar(email)
+	}
+
+	return &user
+}
+
+func generateGravatar(email string) string {
+	hashString := []byte(email)
+
+	return fmt.Sprintf("https://www.gravatar.com/avatar/%x?s=128", md5.Sum(hashString))
+}
+
+// ChannelMessage unsing for communication in channel.
+type ChannelMessage struct {
+	// Unique id of text message.
+	Id         string        `json:"id,omitempty"`
+	Type       string        `json:"type"`
+	FromUser   *User         `json:"from_user"`
+	SentAt     time.Time     `json:"sent_at"`
+	Text       string        `json:"text,omitempty"`
+	Target     *User         `json:"target,omitempty"`
+	Attachment *Attachment   `json:"attachment,omitempty"`
+	Previews   []LinkPreview `json:"previews,omitempty"`
+
+	// Time of the last edit, nil if message wasn't edited.
+	EditedAt *time.Time `json:"edited_at,omitempty"`
+
+	// Idempotency key of the sent message, only in replies to its author, eg. "sent" or "error".
+	ClientId string `json:"client_id,omitempty"`
+
+	// Stream sequence of the sent message, only in replies to its author.
+	Seq uint64 `json:"seq,omitempty"`
+}
+
+// OutgoingMessage is a text message sent by client as JSON, so it's acknowledged with "sent" reply.
+// Messages with the same ClientId are stored once, so they could be safely retried, eg. after reconnect.
+// Plain text is still accepted, but can't be retried without duplicates.
+type OutgoingMessage struct {
+	Text     string `json:"text"`
+	ClientId string `json:"client_id"`
+}
+
+// LinkPreview is a card of the link in message text, from OpenGraph or oEmbed metadata.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// Attachment is an uploaded file, URL is relative to the server and needs token query param.
+type Attachment struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	MimeType string `json:"mime_type"`
+
+	// Image dimensions, zero for other files.
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+
+	URL string `json:"url"`
+
+	// Image previews, generated after upload, see TypeAttachmentUpdated.
+	Thumbnails []Thumbnail `json:"thumbnails,omitempty"`
+	Blurhash   string      `json:"blurhash,omitempty"`
+}
+
+// Thumbnail is a resized image attachment.
+type Thumbnail struct {
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	URL    string `json:"url"`
+}
+
+// Auth represents current JWT auth.
+type Auth struct {
+	// Current User.
+	User *User `json:"user"`
+
+	// Current channel.
+	Channel string `json:"channel"`
+
+	// Rest JWT headers.
+	jwt.StandardClaims
+}
+
+// NewAuth build JWT claims for user in channel, expiring in given duration.
+func NewAuth(user *User, channel string, expiresIn time.Duration) *Auth {
+	return &Auth{
+		User:    user,
+		Channel: channel,
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    "chitchat",
+			ExpiresAt: time.Now().Add(expiresIn).Unix(),
+		},
+	}
+}
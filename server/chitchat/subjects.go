@@ -0,0 +1,85 @@
+package chitchat
+
+import "fmt"
+
+// StreamName of the JetStream stream with all channels.
+const StreamName = "CHITCHAT"
+
+// ChannelStreamPrefix of streams with stream-per-channel topology, see ChannelStreamName.
+const ChannelStreamPrefix = StreamName + "-"
+
+// UnfurlConsumer is a durable consumer of text messages for link previews, shared by all server instances.
+const UnfurlConsumer = "unfurl"
+
+// BansBucket is a KeyValue bucket with banned users of all channels.
+const BansBucket = "chitchat-bans"
+
+// RetentionBucket is a KeyValue bucket with history retention policies by channel.
+const RetentionBucket = "chitchat-retention"
+
+// AttachmentsBucket is an ObjectStore bucket with uploaded files of all channels.
+const AttachmentsBucket = "chitchat-attachments"
+
+// PreviewsBucket is a KeyValue bucket with cached link previews.
+const PreviewsBucket = "chitchat-previews"
+
+// JobsStreamName of the JetStream work-queue stream with background jobs.
+const JobsStreamName = "CHITCHAT_JOBS"
+
+// ThumbnailJobSubject for image attachments waiting for previews.
+const ThumbnailJobSubject = JobsStreamName + ".thumbnail"
+
+// Generate subject based on channel and message
+func subject(c, m string) string {
+	return fmt.Sprintf("%s.%s.%s", StreamName, c, m)
+}
+
+// PresenceSubject for presence messages
+func PresenceSubject(channel string) string {
+	return subject(channel, "presence")
+}
+
+// MessageSubject for text messages
+func MessageSubject(channel string) string {
+	return subject(channel, "message")
+}
+
+// ChannelSubject for all channel messages
+func ChannelSubject(channel string) string {
+	return subject(channel, "*")
+}
+
+// ChannelStreamName of the channel stream with stream-per-channel topology, eg. "CHITCHAT-general".
+// Subjects are the same as in the shared stream.
+func ChannelStreamName(channel string) string {
+	return ChannelStreamPrefix + channel
+}
+
+// MaxChannelLength of the channel name.
+const MaxChannelLength = 64
+
+// ValidChannel tells if channel name is safe for subjects, stream and bucket names,
+// only letters, digits, dashes and underscores are allowed.
+func ValidChannel(channel string) bool {
+	if len(channel) == 0 || len(channel) > MaxChannelLength {
+		return false
+	}
+
+	for _, r := range channel {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PresenceBucket name of KeyValue bucket with channel users online.
+func PresenceBucket(channel string) string {
+	return channel + "-presence"
+}
+
+// BanKey of the user in BansBucket.
+func BanKey(channel, userId string) string {
+	return channel + "." + userId
+}
@@ -0,0 +1,265 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: chitchat.proto
+
+// ChitChat gRPC API, mirrors REST and WebSocket API.
+// Every call requires "authorization: Bearer <token>" metadata with token from POST /auth,
+// channel is taken from the token, same as for HTTP.
+
+package chitchatpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ChitChat_Chat_FullMethodName        = "/chitchat.v1.ChitChat/Chat"
+	ChitChat_GetMessages_FullMethodName = "/chitchat.v1.ChitChat/GetMessages"
+	ChitChat_GetUsers_FullMethodName    = "/chitchat.v1.ChitChat/GetUsers"
+	ChitChat_SendMessage_FullMethodName = "/chitchat.v1.ChitChat/SendMessage"
+)
+
+// ChitChatClient is the client API for ChitChat service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ChitChatClient interface {
+	// Chat join the channel, streams channel events and accepts messages and slash commands.
+	Chat(ctx context.Context, opts ...grpc.CallOption) (ChitChat_ChatClient, error)
+	// GetMessages return channel text messages, optionally starting from time.
+	GetMessages(ctx context.Context, in *GetMessagesRequest, opts ...grpc.CallOption) (*GetMessagesResponse, error)
+	// GetUsers return users online in the channel.
+	GetUsers(ctx context.Context, in *GetUsersRequest, opts ...grpc.CallOption) (*GetUsersResponse, error)
+	// SendMessage publish text message to the channel without joining it.
+	SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendMessageResponse, error)
+}
+
+type chitChatClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewChitChatClient(cc grpc.ClientConnInterface) ChitChatClient {
+	return &chitChatClient{cc}
+}
+
+func (c *chitChatClient) Chat(ctx context.Context, opts ...grpc.CallOption) (ChitChat_ChatClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ChitChat_ServiceDesc.Streams[0], ChitChat_Chat_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &chitChatChatClient{stream}
+	return x, nil
+}
+
+type ChitChat_ChatClient interface {
+	Send(*ChatRequest) error
+	Recv() (*ChatEvent, error)
+	grpc.ClientStream
+}
+
+type chitChatChatClient struct {
+	grpc.ClientStream
+}
+
+func (x *chitChatChatClient) Send(m *ChatRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *chitChatChatClient) Recv() (*ChatEvent, error) {
+	m := new(ChatEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *chitChatClient) GetMessages(ctx context.Context, in *GetMessagesRequest, opts ...grpc.CallOption) (*GetMessagesResponse, error) {
+	out := new(GetMessagesResponse)
+	err := c.cc.Invoke(ctx, ChitChat_GetMessages_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chitChatClient) GetUsers(ctx context.Context, in *GetUsersRequest, opts ...grpc.CallOption) (*GetUsersResponse, error) {
+	out := new(GetUsersResponse)
+	err := c.cc.Invoke(ctx, ChitChat_GetUsers_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *chitChatClient) SendMessage(ctx context.Context, in *SendMessageRequest, opts ...grpc.CallOption) (*SendMessageResponse, error) {
+	out := new(SendMessageResponse)
+	err := c.cc.Invoke(ctx, ChitChat_SendMessage_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ChitChatServer is the server API for ChitChat service.
+// All implementations must embed UnimplementedChitChatServer
+// for forward compatibility
+type ChitChatServer interface {
+	// Chat join the channel, streams channel events and accepts messages and slash commands.
+	Chat(ChitChat_ChatServer) error
+	// GetMessages return channel text messages, optionally starting from time.
+	GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error)
+	// GetUsers return users online in the channel.
+	GetUsers(context.Context, *GetUsersRequest) (*GetUsersResponse, error)
+	// SendMessage publish text message to the channel without joining it.
+	SendMessage(context.Context, *SendMessageRequest) (*SendMessageResponse, error)
+	mustEmbedUnimplementedChitChatServer()
+}
+
+// UnimplementedChitChatServer must be embedded to have forward compatible implementations.
+type UnimplementedChitChatServer struct {
+}
+
+func (UnimplementedChitChatServer) Chat(ChitChat_ChatServer) error {
+	return status.Errorf(codes.Unimplemented, "method Chat not implemented")
+}
+func (UnimplementedChitChatServer) GetMessages(context.Context, *GetMessagesRequest) (*GetMessagesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMessages not implemented")
+}
+func (UnimplementedChitChatServer) GetUsers(context.Context, *GetUsersRequest) (*GetUsersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUsers not implemented")
+}
+func (UnimplementedChitChatServer) SendMessage(context.Context, *SendMessageRequest) (*SendMessageResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendMessage not implemented")
+}
+func (UnimplementedChitChatServer) mustEmbedUnimplementedChitChatServer() {}
+
+// UnsafeChitChatServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ChitChatServer will
+// result in compilation errors.
+type UnsafeChitChatServer interface {
+	mustEmbedUnimplementedChitChatServer()
+}
+
+func RegisterChitChatServer(s grpc.ServiceRegistrar, srv ChitChatServer) {
+	s.RegisterService(&ChitChat_ServiceDesc, srv)
+}
+
+func _ChitChat_Chat_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ChitChatServer).Chat(&chitChatChatServer{stream})
+}
+
+type ChitChat_ChatServer interface {
+	Send(*ChatEvent) error
+	Recv() (*ChatRequest, error)
+	grpc.ServerStream
+}
+
+type chitChatChatServer struct {
+	grpc.ServerStream
+}
+
+func (x *chitChatChatServer) Send(m *ChatEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *chitChatChatServer) Recv() (*ChatRequest, error) {
+	m := new(ChatRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ChitChat_GetMessages_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMessagesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChitChatServer).GetMessages(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChitChat_GetMessages_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChitChatServer).GetMessages(ctx, req.(*GetMessagesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChitChat_GetUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChitChatServer).GetUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChitChat_GetUsers_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChitChatServer).GetUsers(ctx, req.(*GetUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ChitChat_SendMessage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendMessageRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ChitChatServer).SendMessage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ChitChat_SendMessage_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ChitChatServer).SendMessage(ctx, req.(*SendMessageRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ChitChat_ServiceDesc is the grpc.ServiceDesc for ChitChat service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ChitChat_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "chitchat.v1.ChitChat",
+	HandlerType: (*ChitChatServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetMessages",
+			Handler:    _ChitChat_GetMessages_Handler,
+		},
+		{
+			MethodName: "GetUsers",
+			Handler:    _ChitChat_GetUsers_Handler,
+		},
+		{
+			MethodName: "SendMessage",
+			Handler:    _ChitChat_SendMessage_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Chat",
+			Handler:       _ChitChat_Chat_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "chitchat.proto",
+}
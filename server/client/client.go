@@ -0,0 +1,275 @@
+// Package client is a typed Go client for ChitChat REST and WebSocket API.
+//
+//	c := client.New("http://localhost:8080")
+//
+//	if _, err := c.Login(ctx, "John Snow", "john.snow@gmail.com", "lobby"); err != nil {
+//		log.Fatal(err)
+//	}
+//
+//	conn := c.Connect(ctx)
+//
+//	for event := range conn.Events() {
+//		if event.Type == client.EventMessage {
+//			fmt.Println(event.Message.Text)
+//		}
+//	}
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/gorilla/websocket"
+)
+
+// Default configuration for client.
+const (
+	// Time allowed for REST requests.
+	requestTimeout = 10 * time.Second
+
+	// Token is refreshed when it's going to expire in this period.
+	refreshBefore = 1 * time.Minute
+
+	// Initial delay before reconnect.
+	reconnectDelay = 1 * time.Second
+
+	// Maximum delay between reconnects.
+	maxReconnectDelay = 30 * time.Second
+)
+
+// ErrUnauthorized returned when token is invalid and can't be refreshed.
+var ErrUnauthorized = errors.New("client: unauthorized")
+
+// Client for ChitChat server.
+type Client struct {
+	// Server base URL, eg. "http://localhost:8080".
+	URL string
+
+	// HTTP client for REST API calls.
+	HTTPClient *http.Client
+
+	// WebSocket dialer for channel connections.
+	Dialer *websocket.Dialer
+
+	// Batch asks server to send pending events in one frame, they are decoded with DecodeBatch.
+	Batch bool
+
+	// Delay before reconnect, doubled on each failed attempt up to MaxReconnectDelay.
+	ReconnectDelay    time.Duration
+	MaxReconnectDelay time.Duration
+
+	// Guards credentials and auth state.
+	mu sync.Mutex
+
+	// Credentials used for token refresh.
+	name    string
+	email   string
+	channel string
+
+	token string
+	auth  *chitchat.Auth
+}
+
+// New build new Client.
+func New(serverURL string) *Client {
+	return &Client{
+		URL:               strings.TrimSuffix(serverURL, "/"),
+		HTTPClient:        &http.Client{Timeout: requestTimeout},
+		Dialer:            websocket.DefaultDialer,
+		ReconnectDelay:    reconnectDelay,
+		MaxReconnectDelay: maxReconnectDelay,
+	}
+}
+
+// Login create new token for the user in channel.
+// Credentials are kept for automatic token refresh.
+func (c *Client) Login(ctx context.Context, name, email, channel string) (*chitchat.Auth, error) {
+	c.mu.Lock()
+	c.name, c.email, c.channel = name, email, channel
+	c.mu.Unlock()
+
+	if err := c.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	return c.Auth(ctx)
+}
+
+// SetToken use existing token instead of Login.
+// Token can't be refreshed without Login.
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.token = token
+	c.auth = nil
+}
+
+// Token return current token.
+func (c *Client) Token() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.token
+}
+
+// Auth fetch current auth from the server.
+func (c *Client) Auth(ctx context.Context) (*chitchat.Auth, error) {
+	auth := &chitchat.Auth{}
+
+	if err := c.get(ctx, "/auth", nil, auth); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.auth = auth
+	c.mu.Unlock()
+
+	return auth, nil
+}
+
+// Messages fetch channel history, starting from time if it's not zero.
+func (c *Client) Messages(ctx context.Context, start time.Time) ([]chitchat.ChannelMessage, error) {
+	query := url.Values{}
+	if !start.IsZero() {
+		query.Set("start_time", start.Format(time.RFC3339Nano))
+	}
+
+	body := struct {
+		Messages []chitchat.ChannelMessage `json:"messages"`
+	}{}
+
+	if err := c.get(ctx, "/messages", query, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Messages, nil
+}
+
+// Users fetch channel members online.
+func (c *Client) Users(ctx context.Context) ([]chitchat.User, error) {
+	body := struct {
+		Users []chitchat.User `json:"users"`
+	}{}
+
+	if err := c.get(ctx, "/users", nil, &body); err != nil {
+		return nil, err
+	}
+
+	return body.Users, nil
+}
+
+// validToken return token, refreshing it if it's going to expire.
+func (c *Client) validToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	token, auth := c.token, c.auth
+	c.mu.Unlock()
+
+	if len(token) > 0 && (auth == nil || time.Until(time.Unix(auth.ExpiresAt, 0)) > refreshBefore) {
+		return token, nil
+	}
+
+	if err := c.refresh(ctx); err != nil {
+		return "", err
+	}
+
+	return c.Token(), nil
+}
+
+// refresh token using stored credentials.
+func (c *Client) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	form := url.Values{
+		"name":    {c.name},
+		"email":   {c.email},
+		"channel": {c.channel},
+	}
+	c.mu.Unlock()
+
+	if len(form.Get("name")) == 0 {
+		return ErrUnauthorized
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/auth", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	body := struct {
+		Token string `json:"token"`
+	}{}
+
+	if err := c.do(req, &body); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.token = body.Token
+	c.auth = nil
+	c.mu.Unlock()
+
+	return nil
+}
+
+// get JSON from REST API, refreshing token once if it's rejected.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v interface{}) error {
+	for attempt := 0; ; attempt++ {
+		token, err := c.validToken(ctx)
+		if err != nil {
+			return err
+		}
+
+		q := url.Values{}
+		for k, vs := range query {
+			q[k] = vs
+		}
+		q.Set("token", token)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+path+"?"+q.Encode(), nil)
+		if err != nil {
+			return err
+		}
+
+		err = c.do(req, v)
+		if errors.Is(err, ErrUnauthorized) && attempt == 0 {
+			if c.refresh(ctx) == nil {
+				continue
+			}
+		}
+
+		return err
+	}
+}
+
+// do HTTP request and decode JSON response.
+func (c *Client) do(req *http.Request, v interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return ErrUnauthorized
+	}
+
+	if resp.StatusCode >= 300 {
+		body := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&body)
+
+		return fmt.Errorf("client: %s %s: %s %s", req.Method, req.URL.Path, resp.Status, body.Message)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer issue new token on each login and accept only the latest one.
+type fakeServer struct {
+	mu     sync.Mutex
+	logins int
+
+	messages []chitchat.ChannelMessage
+	live     []chitchat.ChannelMessage
+
+	// Connections count and start_time of history requests.
+	connects   int
+	startTimes []string
+}
+
+func (s *fakeServer) token() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return fmt.Sprintf("token-%d", s.logins)
+}
+
+func (s *fakeServer) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logins++
+}
+
+func (s *fakeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	upgrader := websocket.Upgrader{}
+
+	authorized := func(r *http.Request) bool {
+		return r.URL.Query().Get("token") == s.token()
+	}
+
+	mux.HandleFunc("/auth", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			s.expire()
+
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"token": s.token()})
+			return
+		}
+
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		json.NewEncoder(w).Encode(chitchat.Auth{User: &chitchat.User{Id: "1", Name: "Jon"}, Channel: "lobby"})
+	})
+
+	mux.HandleFunc("/messages", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		s.mu.Lock()
+		s.startTimes = append(s.startTimes, r.URL.Query().Get("start_time"))
+		s.mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"messages": s.messages})
+	})
+
+	mux.HandleFunc("/channel", func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+
+		s.mu.Lock()
+		s.connects++
+		first := s.connects == 1
+		s.mu.Unlock()
+
+		if first && r.URL.Query().Get("batch") == "true" {
+			var frame [][]byte
+			for _, msg := range s.live {
+				data, _ := json.Marshal(msg)
+				frame = append(frame, data)
+			}
+
+			ws.WriteMessage(websocket.TextMessage, bytes.Join(frame, []byte{'\n'}))
+		} else if first {
+			for _, msg := range s.live {
+				ws.WriteJSON(msg)
+			}
+		}
+
+		// Drop connection after sending live messages
+	})
+
+	return mux
+}
+
+func TestClientTokenRefresh(t *testing.T) {
+	fake := &fakeServer{messages: []chitchat.ChannelMessage{{Type: chitchat.TypeMessage, Text: "hello"}}}
+
+	server := httptest.NewServer(fake.handler())
+	defer server.Close()
+
+	c := New(server.URL)
+
+	auth, err := c.Login(context.Background(), "Jon", "", "lobby")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Jon", auth.User.Name)
+	}
+
+	// Token is rejected by server, client should login again
+	fake.expire()
+
+	messages, err := c.Messages(context.Background(), time.Time{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", messages[0].Text)
+		assert.Equal(t, fake.token(), c.Token())
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	fake := &fakeServer{}
+
+	server := httptest.NewServer(fake.handler())
+	defer server.Close()
+
+	c := New(server.URL)
+	c.SetToken("invalid")
+
+	_, err := c.Messages(context.Background(), time.Time{})
+
+	assert.Equal(t, ErrUnauthorized, err)
+}
+
+func TestConnResume(t *testing.T) {
+	now := time.Unix(1000, 500).UTC()
+
+	first := chitchat.ChannelMessage{Id: "1", Type: chitchat.TypeMessage, SentAt: now, Text: "first"}
+	second := chitchat.ChannelMessage{Id: "2", Type: chitchat.TypeMessage, SentAt: now, Text: "second"}
+	missed := chitchat.ChannelMessage{Id: "3", Type: chitchat.TypeMessage, SentAt: now, Text: "missed"}
+
+	// Messages sent at the same time are delivered, only replayed ones are skipped
+	fake := &fakeServer{
+		messages: []chitchat.ChannelMessage{first, second, missed},
+		live:     []chitchat.ChannelMessage{first, second},
+	}
+
+	server := httptest.NewServer(fake.handler())
+	defer server.Close()
+
+	c := New(server.URL)
+	c.ReconnectDelay = time.Millisecond
+
+	_, err := c.Login(context.Background(), "Jon", "", "lobby")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := c.Connect(ctx)
+
+	var texts []string
+
+	for event := range conn.Events() {
+		if event.Type == EventMessage {
+			texts = append(texts, event.Message.Text)
+		}
+
+		if len(texts) == 3 {
+			conn.Close()
+		}
+	}
+
+	// Live messages are delivered once, missed one is fetched from history after reconnect
+	assert.Equal(t, []string{"first", "second", "missed"}, texts)
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	if assert.NotEmpty(t, fake.startTimes) {
+		assert.Equal(t, "1970-01-01T00:16:40.0000005Z", fake.startTimes[0])
+	}
+}
+
+func TestDecodeBatch(t *testing.T) {
+	messages, err := DecodeBatch([]byte(`{"id":"1","text":"first"}` + "\n" + `{"id":"2","text":"second"}`))
+	assert.NoError(t, err)
+	if assert.Len(t, messages, 2) {
+		assert.Equal(t, "first", messages[0].Text)
+		assert.Equal(t, "second", messages[1].Text)
+	}
+
+	// Frame without batch
+	messages, err = DecodeBatch([]byte(`{"id":"1","text":"first"}`))
+	assert.NoError(t, err)
+	assert.Len(t, messages, 1)
+
+	messages, err = DecodeBatch([]byte(`{"id":"1","text":"first"}` + "\n" + `{"id":`))
+	assert.Error(t, err)
+	assert.Len(t, messages, 1)
+}
+
+func TestConnBatch(t *testing.T) {
+	now := time.Unix(1000, 500).UTC()
+
+	fake := &fakeServer{
+		live: []chitchat.ChannelMessage{
+			{Id: "1", Type: chitchat.TypeMessage, SentAt: now, Text: "first"},
+			{Id: "2", Type: chitchat.TypeMessage, SentAt: now, Text: "second"},
+		},
+	}
+
+	server := httptest.NewServer(fake.handler())
+	defer server.Close()
+
+	c := New(server.URL)
+	c.Batch = true
+
+	_, err := c.Login(context.Background(), "Jon", "", "lobby")
+	assert.NoError(t, err)
+
+	conn := c.Connect(context.Background())
+
+	var texts []string
+
+	for event := range conn.Events() {
+		if event.Type == EventMessage {
+			texts = append(texts, event.Message.Text)
+		}
+
+		if len(texts) == 2 {
+			conn.Close()
+		}
+	}
+
+	assert.Equal(t, []string{"first", "second"}, texts)
+}
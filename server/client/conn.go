@@ -0,0 +1,329 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/gorilla/websocket"
+)
+
+// Default configuration for channel connection.
+const (
+	// Time allowed to write a message to the server.
+	writeWait = 10 * time.Second
+
+	// Time allowed to read the next ping message from the server.
+	pingWait = 70 * time.Second
+
+	// Size of events buffer.
+	eventsBuffer = 64
+)
+
+// ErrNotConnected returned when message is sent without connection.
+var ErrNotConnected = errors.New("client: not connected")
+
+// EventType of connection event.
+type EventType int
+
+const (
+	// EventMessage is a channel message.
+	EventMessage EventType = iota
+
+	// EventConnected is sent when connection is (re)established.
+	EventConnected
+
+	// EventDisconnected is sent when connection is lost, Err contains the reason.
+	EventDisconnected
+)
+
+// Event from channel connection.
+type Event struct {
+	Type EventType
+
+	// Channel message for EventMessage.
+	Message chitchat.ChannelMessage
+
+	// Disconnect reason for EventDisconnected.
+	Err error
+}
+
+// Conn is a channel connection with automatic reconnects.
+// Messages missed while disconnected are fetched from history after reconnect.
+type Conn struct {
+	client *Client
+
+	events chan Event
+
+	cancel context.CancelFunc
+
+	// Time of the last delivered message, used for resume.
+	lastSentAt time.Time
+
+	// Ids of delivered messages sent at lastSentAt, history from that time could replay them on resume.
+	delivered map[string]bool
+
+	// Guards ws and writes to it.
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+// Connect open channel connection, it's closed when context is done or on Close.
+func (c *Client) Connect(ctx context.Context) *Conn {
+	ctx, cancel := context.WithCancel(ctx)
+
+	conn := &Conn{
+		client: c,
+		events: make(chan Event, eventsBuffer),
+		cancel: cancel,
+
+		delivered: make(map[string]bool),
+	}
+
+	go conn.run(ctx)
+
+	return conn
+}
+
+// Events return channel of connection events, closed with connection.
+func (conn *Conn) Events() <-chan Event {
+	return conn.events
+}
+
+// Send text to the channel.
+func (conn *Conn) Send(text string) error {
+	return conn.write([]byte(text))
+}
+
+// SendMessage send text with idempotency key, server replies with "sent" message with the same ClientId once it's stored.
+// Message could be retried with the same key, eg. after reconnect, it's stored once.
+func (conn *Conn) SendMessage(text, clientId string) error {
+	data, err := json.Marshal(chitchat.OutgoingMessage{Text: text, ClientId: clientId})
+	if err != nil {
+		return err
+	}
+
+	return conn.write(data)
+}
+
+func (conn *Conn) write(data []byte) error {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.ws == nil {
+		return ErrNotConnected
+	}
+
+	conn.ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return conn.ws.WriteMessage(websocket.TextMessage, data)
+}
+
+// Close connection.
+func (conn *Conn) Close() {
+	conn.cancel()
+}
+
+// run keep connection alive until context is done.
+func (conn *Conn) run(ctx context.Context) {
+	defer close(conn.events)
+
+	delay := conn.client.ReconnectDelay
+
+	for {
+		connected, err := conn.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if connected {
+			delay = conn.client.ReconnectDelay
+		}
+
+		if !conn.emit(ctx, Event{Type: EventDisconnected, Err: err}) {
+			return
+		}
+
+		// Backoff with jitter, so clients don't reconnect all at once
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > conn.client.MaxReconnectDelay {
+			delay = conn.client.MaxReconnectDelay
+		}
+	}
+}
+
+// session handle one websocket connection.
+func (conn *Conn) session(ctx context.Context) (bool, error) {
+	ws, err := conn.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	conn.mu.Lock()
+	conn.ws = ws
+	conn.mu.Unlock()
+
+	defer func() {
+		conn.mu.Lock()
+		conn.ws = nil
+		conn.mu.Unlock()
+
+		ws.Close()
+	}()
+
+	// Close connection on context cancel to unblock reading
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	ws.SetReadDeadline(time.Now().Add(pingWait))
+	ws.SetPingHandler(func(data string) error {
+		ws.SetReadDeadline(time.Now().Add(pingWait))
+
+		return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(writeWait))
+	})
+
+	if !conn.emit(ctx, Event{Type: EventConnected}) {
+		return true, ctx.Err()
+	}
+
+	if !conn.lastSentAt.IsZero() {
+		conn.resume(ctx)
+	}
+
+	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+
+		// Broken events are skipped
+		messages, _ := DecodeBatch(data)
+
+		for _, msg := range messages {
+			if !conn.deliver(ctx, msg) {
+				return true, ctx.Err()
+			}
+		}
+	}
+}
+
+// DecodeBatch decode frame of new line delimited JSON events, frame without batch has one event.
+// Events decoded before the error are returned too.
+func DecodeBatch(data []byte) ([]chitchat.ChannelMessage, error) {
+	var messages []chitchat.ChannelMessage
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	for {
+		msg := chitchat.ChannelMessage{}
+
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return messages, nil
+		}
+
+		if err != nil {
+			return messages, err
+		}
+
+		messages = append(messages, msg)
+	}
+}
+
+// dial channel websocket, refreshing token once if it's rejected.
+func (conn *Conn) dial(ctx context.Context) (*websocket.Conn, error) {
+	c := conn.client
+
+	for attempt := 0; ; attempt++ {
+		token, err := c.validToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		wsURL := strings.Replace(c.URL, "http", "ws", 1) + "/channel?token=" + url.QueryEscape(token)
+		if c.Batch {
+			wsURL += "&batch=true"
+		}
+
+		ws, resp, err := c.Dialer.DialContext(ctx, wsURL, nil)
+		if err != nil && resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			if attempt == 0 && c.refresh(ctx) == nil {
+				continue
+			}
+
+			return nil, ErrUnauthorized
+		}
+
+		return ws, err
+	}
+}
+
+// resume deliver messages missed while disconnected.
+func (conn *Conn) resume(ctx context.Context) {
+	messages, err := conn.client.Messages(ctx, conn.lastSentAt)
+	if err != nil {
+		return
+	}
+
+	for _, msg := range messages {
+		if conn.delivered[msg.Id] {
+			continue
+		}
+
+		if !conn.deliver(ctx, msg) {
+			return
+		}
+	}
+}
+
+// deliver message and remember it for resume.
+// Messages without Id aren't in history, eg. sent acks, so they don't move resume time.
+func (conn *Conn) deliver(ctx context.Context, msg chitchat.ChannelMessage) bool {
+	if len(msg.Id) > 0 && !msg.SentAt.Before(conn.lastSentAt) {
+		// Older ids can't be replayed anymore, history is fetched from lastSentAt
+		if msg.SentAt.After(conn.lastSentAt) {
+			conn.lastSentAt = msg.SentAt
+			conn.delivered = make(map[string]bool)
+		}
+
+		conn.delivered[msg.Id] = true
+	}
+
+	return conn.emit(ctx, Event{Type: EventMessage, Message: msg})
+}
+
+// emit event unless context is done.
+func (conn *Conn) emit(ctx context.Context, event Event) bool {
+	select {
+	case conn.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
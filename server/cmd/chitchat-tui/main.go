@@ -0,0 +1,305 @@
+// Command chitchat-tui is a terminal ChitChat client.
+//
+//	chitchat-tui -server http://localhost:8080 -name "John Snow" -channel lobby
+//
+// Local commands:
+//
+//	/join <channel>  join channel or switch to already joined one
+//	/part            leave current channel
+//	/quit            exit
+//
+// Ctrl-N and Ctrl-P switch between joined channels, any other slash command is sent to the server.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// ui keeps joined rooms and widgets.
+type ui struct {
+	ctx context.Context
+
+	server string
+	name   string
+	email  string
+
+	app      *tview.Application
+	status   *tview.TextView
+	messages *tview.TextView
+	users    *tview.TextView
+	channels *tview.TextView
+	input    *tview.InputField
+
+	// Joined rooms, only touched from UI goroutine.
+	rooms   []*room
+	current *room
+}
+
+func main() {
+	server := flag.String("server", envOr("CHITCHAT_URL", "http://localhost:8080"), "ChitChat server URL")
+	name := flag.String("name", os.Getenv("USER"), "user name")
+	email := flag.String("email", "", "user email, used for avatar")
+	channel := flag.String("channel", "lobby", "channel to join")
+	flag.Parse()
+
+	if len(*name) == 0 {
+		log.Fatal("name can't be blank")
+	}
+
+	u := newUI(context.Background(), *server, *name, *email)
+
+	// Join waits for UI loop, so it's started in background
+	var joinErr error
+	go func() {
+		if joinErr = u.join(*channel); joinErr != nil {
+			u.app.Stop()
+		}
+	}()
+
+	if err := u.app.Run(); err != nil {
+		log.Fatal(err)
+	}
+
+	if joinErr != nil {
+		log.Fatal(joinErr)
+	}
+}
+
+// newUI build widgets and layout.
+func newUI(ctx context.Context, server, name, email string) *ui {
+	u := &ui{
+		ctx:    ctx,
+		server: server,
+		name:   name,
+		email:  email,
+		app:    tview.NewApplication(),
+	}
+
+	u.status = tview.NewTextView().SetDynamicColors(true)
+
+	u.messages = tview.NewTextView().SetDynamicColors(true).SetWordWrap(true).SetScrollable(true)
+	u.messages.SetBorder(true)
+
+	u.users = tview.NewTextView().SetDynamicColors(true)
+	u.users.SetBorder(true).SetTitle("Users")
+
+	u.channels = tview.NewTextView().SetDynamicColors(true)
+	u.channels.SetBorder(true).SetTitle("Channels")
+
+	u.input = tview.NewInputField().SetLabel("> ").SetFieldBackgroundColor(tcell.ColorDefault)
+	u.input.SetDoneFunc(func(key tcell.Key) {
+		if key == tcell.KeyEnter {
+			u.submit(u.input.GetText())
+			u.input.SetText("")
+		}
+	})
+
+	sidebar := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(u.channels, 0, 1, false).
+		AddItem(u.users, 0, 2, false)
+
+	panes := tview.NewFlex().
+		AddItem(u.messages, 0, 4, false).
+		AddItem(sidebar, 24, 0, false)
+
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(u.status, 1, 0, false).
+		AddItem(panes, 0, 1, false).
+		AddItem(u.input, 1, 0, true)
+
+	u.app.SetRoot(layout, true).SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+		switch event.Key() {
+		case tcell.KeyCtrlN:
+			u.cycle(1)
+			return nil
+		case tcell.KeyCtrlP:
+			u.cycle(-1)
+			return nil
+		}
+
+		return event
+	})
+
+	return u
+}
+
+// submit input line.
+func (u *ui) submit(text string) {
+	text = strings.TrimSpace(text)
+	if len(text) == 0 {
+		return
+	}
+
+	cmd, arg, _ := strings.Cut(text, " ")
+	arg = strings.TrimSpace(arg)
+
+	switch cmd {
+	case "/quit":
+		u.app.Stop()
+		return
+	case "/join":
+		if len(arg) == 0 {
+			u.notice("Usage: /join <channel>")
+			return
+		}
+
+		// Joining makes network calls, don't block UI
+		go func() {
+			if err := u.join(arg); err != nil {
+				u.app.QueueUpdateDraw(func() { u.notice(err.Error()) })
+			}
+		}()
+		return
+	case "/part":
+		u.part()
+		return
+	}
+
+	if u.current == nil {
+		return
+	}
+
+	if err := u.current.conn.Send(text); err != nil {
+		u.notice(err.Error())
+	}
+}
+
+// join channel and switch to it, safe to call from any goroutine.
+func (u *ui) join(channel string) error {
+	done := make(chan *room)
+	u.app.QueueUpdate(func() {
+		for _, r := range u.rooms {
+			if r.name == channel {
+				done <- r
+				return
+			}
+		}
+		done <- nil
+	})
+
+	if existed := <-done; existed != nil {
+		u.app.QueueUpdateDraw(func() { u.switchTo(existed) })
+		return nil
+	}
+
+	r, err := joinRoom(u.ctx, u.server, u.name, u.email, channel)
+	if err != nil {
+		return fmt.Errorf("can't join %s: %w", channel, err)
+	}
+
+	go r.listen(func(r *room) {
+		u.app.QueueUpdateDraw(func() {
+			if r == u.current {
+				u.render()
+			} else {
+				u.renderChannels()
+			}
+		})
+	})
+
+	u.app.QueueUpdateDraw(func() {
+		u.rooms = append(u.rooms, r)
+		u.switchTo(r)
+	})
+
+	return nil
+}
+
+// part from current channel.
+func (u *ui) part() {
+	if u.current == nil {
+		return
+	}
+
+	u.current.leave()
+
+	for i, r := range u.rooms {
+		if r == u.current {
+			u.rooms = append(u.rooms[:i], u.rooms[i+1:]...)
+			break
+		}
+	}
+
+	u.current = nil
+
+	if len(u.rooms) > 0 {
+		u.switchTo(u.rooms[0])
+	} else {
+		u.render()
+	}
+}
+
+// cycle switch to the next or previous channel.
+func (u *ui) cycle(step int) {
+	for i, r := range u.rooms {
+		if r == u.current {
+			u.switchTo(u.rooms[(i+step+len(u.rooms))%len(u.rooms)])
+			return
+		}
+	}
+}
+
+func (u *ui) switchTo(r *room) {
+	u.current = r
+	u.render()
+}
+
+// notice show local message in current channel.
+func (u *ui) notice(text string) {
+	fmt.Fprintf(u.messages, "\n[yellow]-- %s[-]", tview.Escape(text))
+	u.messages.ScrollToEnd()
+}
+
+// render current channel.
+func (u *ui) render() {
+	u.renderChannels()
+
+	if u.current == nil {
+		u.status.SetText("not in channel, use /join <channel>")
+		u.messages.Clear()
+		u.users.Clear()
+		return
+	}
+
+	u.current.read()
+
+	u.status.SetText(u.current.status())
+	u.messages.SetTitle("#" + u.current.name)
+	u.messages.SetText(u.current.text()).ScrollToEnd()
+	u.users.SetText(strings.Join(u.current.members(), "\n"))
+}
+
+// renderChannels list with unread counters.
+func (u *ui) renderChannels() {
+	var lines []string
+
+	for _, r := range u.rooms {
+		line := "#" + tview.Escape(r.name)
+
+		if r == u.current {
+			line = "[::r]" + line + "[::-]"
+		} else if unread := r.unreadCount(); unread > 0 {
+			line = fmt.Sprintf("%s [yellow](%d)[-]", line, unread)
+		}
+
+		lines = append(lines, line)
+	}
+
+	u.channels.SetText(strings.Join(lines, "\n"))
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); len(v) > 0 {
+		return v
+	}
+
+	return fallback
+}
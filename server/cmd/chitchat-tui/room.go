@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/faustman/chitchat/server/client"
+	"github.com/rivo/tview"
+)
+
+// Maximum number of lines kept per channel.
+const maxLines = 1000
+
+// room is a joined channel with its own connection, history and members.
+type room struct {
+	name string
+
+	client *client.Client
+	conn   *client.Conn
+	cancel context.CancelFunc
+
+	// Guards fields below, they are updated from connection goroutine.
+	mu        sync.Mutex
+	lines     []string
+	users     map[string]chitchat.User
+	topic     string
+	connected bool
+	unread    int
+}
+
+// joinRoom login to the channel, load history and members and open connection.
+func joinRoom(ctx context.Context, serverURL, name, email, channel string) (*room, error) {
+	c := client.New(serverURL)
+
+	if _, err := c.Login(ctx, name, email, channel); err != nil {
+		return nil, err
+	}
+
+	r := &room{
+		name:   channel,
+		client: c,
+		users:  make(map[string]chitchat.User),
+	}
+
+	messages, err := c.Messages(ctx, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, msg := range messages {
+		r.handle(msg)
+	}
+
+	users, err := c.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		r.users[user.Id] = user
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.conn = c.Connect(ctx)
+
+	return r, nil
+}
+
+// listen connection events, calling update after each one.
+func (r *room) listen(update func(r *room)) {
+	for event := range r.conn.Events() {
+		r.mu.Lock()
+		switch event.Type {
+		case client.EventConnected:
+			r.connected = true
+		case client.EventDisconnected:
+			r.connected = false
+			r.addLine(fmt.Sprintf("[red]-- disconnected: %s[-]", tview.Escape(fmt.Sprint(event.Err))))
+		case client.EventMessage:
+			r.handleLocked(event.Message)
+		}
+		r.mu.Unlock()
+
+		update(r)
+	}
+}
+
+// leave channel and close connection.
+func (r *room) leave() {
+	r.cancel()
+}
+
+// handle channel message.
+func (r *room) handle(msg chitchat.ChannelMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.handleLocked(msg)
+}
+
+func (r *room) handleLocked(msg chitchat.ChannelMessage) {
+	ts := msg.SentAt.Local().Format("15:04")
+	from := "?"
+	if msg.FromUser != nil {
+		from = tview.Escape(msg.FromUser.Name)
+	}
+	text := tview.Escape(msg.Text)
+
+	switch msg.Type {
+	case chitchat.TypeMessage:
+		r.addLine(fmt.Sprintf("[gray]%s[-] [::b]%s[::-]: %s", ts, from, text))
+		r.unread++
+	case chitchat.TypeAction:
+		r.addLine(fmt.Sprintf("[gray]%s[-] * %s %s", ts, from, text))
+		r.unread++
+	case chitchat.TypeTopic:
+		r.topic = msg.Text
+		r.addLine(fmt.Sprintf("[gray]%s -- %s changed topic to: %s[-]", ts, from, text))
+	case chitchat.TypeJoin:
+		r.users[msg.FromUser.Id] = *msg.FromUser
+		r.addLine(fmt.Sprintf("[green]%s --> %s joined[-]", ts, from))
+	case chitchat.TypeLeave:
+		delete(r.users, msg.FromUser.Id)
+		r.addLine(fmt.Sprintf("[green]%s <-- %s left[-]", ts, from))
+	case chitchat.TypeNick:
+		r.users[msg.FromUser.Id] = *msg.FromUser
+		r.addLine(fmt.Sprintf("[gray]%s -- %s is now known as %s[-]", ts, text, from))
+	case chitchat.TypeKick:
+		if msg.Target != nil {
+			delete(r.users, msg.Target.Id)
+			r.addLine(fmt.Sprintf("[red]%s <-- %s was kicked by %s[-]", ts, tview.Escape(msg.Target.Name), from))
+		}
+	case chitchat.TypeAttachment:
+		if msg.Attachment != nil {
+			r.addLine(fmt.Sprintf("[gray]%s[-] [::b]%s[::-]: [blue]%s (%d bytes)[-] %s", ts, from, tview.Escape(msg.Attachment.Name), msg.Attachment.Size, text))
+			r.unread++
+		}
+	case chitchat.TypeMessageEdited:
+		r.addLine(fmt.Sprintf("[gray]%s -- %s edited message: %s[-]", ts, from, text))
+	case chitchat.TypeMessageDeleted:
+		r.addLine(fmt.Sprintf("[gray]%s -- %s deleted message[-]", ts, from))
+	case chitchat.TypeEphemeral:
+		r.addLine(fmt.Sprintf("[yellow]%s -- %s[-]", ts, text))
+	case chitchat.TypeError:
+		r.addLine(fmt.Sprintf("[red]%s -- %s[-]", ts, text))
+	}
+}
+
+func (r *room) addLine(line string) {
+	r.lines = append(r.lines, line)
+
+	if len(r.lines) > maxLines {
+		r.lines = r.lines[len(r.lines)-maxLines:]
+	}
+}
+
+// text of the channel history.
+func (r *room) text() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return strings.Join(r.lines, "\n")
+}
+
+// members sorted by name.
+func (r *room) members() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var names []string
+	for _, user := range r.users {
+		names = append(names, tview.Escape(user.Name))
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// status line of the channel.
+func (r *room) status() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state := "[green]connected[-]"
+	if !r.connected {
+		state = "[red]connecting..[-]"
+	}
+
+	return fmt.Sprintf("#%s %s %s", tview.Escape(r.name), state, tview.Escape(r.topic))
+}
+
+// unreadCount of messages since channel was read.
+func (r *room) unreadCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.unread
+}
+
+// read mark channel as read.
+func (r *room) read() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.unread = 0
+}
@@ -0,0 +1,520 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/golang-jwt/jwt"
+	"github.com/nats-io/nats.go"
+)
+
+// Time allowed for JetStream API requests.
+const requestTimeout = 5 * time.Second
+
+// admin is a user on whose behalf chitchatctl publishes messages.
+var admin = &chitchat.User{Id: "chitchatctl", Name: "admin"}
+
+// ban stored in bans bucket.
+type ban struct {
+	Reason   string    `json:"reason,omitempty"`
+	BannedAt time.Time `json:"banned_at"`
+}
+
+// channelsCommand list channels with message counts.
+func channelsCommand(c *ctl, args []string) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	subjects := make(map[string]uint64)
+
+	for _, stream := range channelStreams(c.js) {
+		counts, err := subjectCounts(c.nc, stream)
+		if err != nil {
+			return err
+		}
+
+		for subject, n := range counts {
+			subjects[subject] += n
+		}
+	}
+
+	type counts struct{ messages, presence uint64 }
+	channels := make(map[string]*counts)
+
+	for subject, n := range subjects {
+		parts := strings.Split(subject, ".")
+		if len(parts) != 3 {
+			continue
+		}
+
+		channel := parts[1]
+		if channels[channel] == nil {
+			channels[channel] = &counts{}
+		}
+
+		switch subject {
+		case chitchat.MessageSubject(channel):
+			channels[channel].messages += n
+		case chitchat.PresenceSubject(channel):
+			channels[channel].presence += n
+		}
+	}
+
+	var names []string
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tMESSAGES\tPRESENCE EVENTS")
+	for _, name := range names {
+		fmt.Fprintf(w, "%s\t%d\t%d\n", name, channels[name].messages, channels[name].presence)
+	}
+
+	return w.Flush()
+}
+
+// subjectCounts request number of messages per subject in the stream.
+// JetStream client doesn't expose subjects filter, so API is called directly.
+func subjectCounts(nc *nats.Conn, stream string) (map[string]uint64, error) {
+	msg, err := nc.Request("$JS.API.STREAM.INFO."+stream, []byte(`{"subjects_filter":">"}`), requestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := struct {
+		State struct {
+			Subjects map[string]uint64 `json:"subjects"`
+		} `json:"state"`
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Error != nil {
+		return nil, errors.New(resp.Error.Description)
+	}
+
+	return resp.State.Subjects, nil
+}
+
+// messagesCommand show last channel messages.
+func messagesCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("messages", flag.ExitOnError)
+	n := fs.Int("n", 20, "number of messages")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("usage: messages [-n 20] <channel>")
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	sub, err := c.js.SubscribeSync(chitchat.MessageSubject(fs.Arg(0)), nats.OrderedConsumer())
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	var last []*nats.Msg
+
+	for {
+		m, err := sub.NextMsg(1 * time.Second)
+		if err != nil {
+			break
+		}
+
+		last = append(last, m)
+		if len(last) > *n {
+			last = last[1:]
+		}
+
+		meta, err := m.Metadata()
+		if err != nil || meta.NumPending == 0 {
+			break
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SEQ\tSENT AT\tTYPE\tFROM\tTEXT")
+	for _, m := range last {
+		meta, _ := m.Metadata()
+
+		msg := chitchat.ChannelMessage{}
+		json.Unmarshal(m.Data, &msg)
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", meta.Sequence.Stream, msg.SentAt.Format(time.RFC3339), msg.Type, userName(msg.FromUser), msg.Text)
+	}
+
+	return w.Flush()
+}
+
+// deleteCommand delete message from the stream.
+func deleteCommand(c *ctl, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: delete <channel> <seq>")
+	}
+
+	seq, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return err
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	stream := channelStream(c.js, args[0])
+
+	// Make sure sequence belongs to the channel
+	msg, err := c.js.GetMsg(stream, seq)
+	if err != nil {
+		return err
+	}
+
+	if msg.Subject != chitchat.MessageSubject(args[0]) {
+		return fmt.Errorf("message %d is not in channel %s", seq, args[0])
+	}
+
+	if err := c.js.DeleteMsg(stream, seq); err != nil {
+		return err
+	}
+
+	fmt.Printf("Message %d deleted\n", seq)
+
+	return nil
+}
+
+// tailCommand print channel messages until interrupted.
+func tailCommand(c *ctl, args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tail <channel>")
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	sub, err := c.nc.Subscribe(chitchat.ChannelSubject(args[0]), func(m *nats.Msg) {
+		msg := chitchat.ChannelMessage{}
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			fmt.Printf("%s %s\n", m.Subject, m.Data)
+			return
+		}
+
+		fmt.Printf("%s [%s] %s: %s\n", msg.SentAt.Format("15:04:05"), msg.Type, userName(msg.FromUser), msg.Text)
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	<-quit
+
+	return nil
+}
+
+// presenceCommand list presence buckets or user connections in channel presence bucket.
+func presenceCommand(c *ctl, args []string) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		// KeyValue buckets are backed by "KV_<bucket>" streams
+		for name := range c.js.StreamNames() {
+			bucket := strings.TrimPrefix(name, "KV_")
+			if bucket != name && strings.HasSuffix(bucket, "-presence") {
+				fmt.Println(bucket)
+			}
+		}
+
+		return nil
+	}
+
+	kv, err := c.js.KeyValue(chitchat.PresenceBucket(args[0]))
+	if err != nil {
+		return err
+	}
+
+	keys, err := kv.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER ID\tCONNECTION\tNAME\tHEARTBEAT")
+	for _, key := range keys {
+		entry, err := kv.Get(key)
+		if err != nil {
+			continue
+		}
+
+		user := chitchat.User{}
+		json.Unmarshal(entry.Value(), &user)
+
+		// Keys are "<user-id>.<connection-id>"
+		conn := strings.TrimPrefix(key, user.Id+".")
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", user.Id, conn, user.Name, entry.Created().Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+// presencePurgeCommand purge whole presence bucket or all connections of single user.
+func presencePurgeCommand(c *ctl, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: presence-purge <channel> [user-id]")
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	bucket := chitchat.PresenceBucket(args[0])
+
+	if len(args) == 1 {
+		if err := c.js.DeleteKeyValue(bucket); err != nil {
+			return err
+		}
+
+		fmt.Printf("Bucket %s deleted\n", bucket)
+
+		return nil
+	}
+
+	kv, err := c.js.KeyValue(bucket)
+	if err != nil {
+		return err
+	}
+
+	keys, err := kv.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return err
+	}
+
+	for _, key := range keys {
+		if strings.HasPrefix(key, args[1]+".") {
+			if err := kv.Purge(key); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Printf("User %s purged from %s\n", args[1], bucket)
+
+	return nil
+}
+
+// tokenCommand mint token for testing.
+func tokenCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	email := fs.String("email", "", "user email")
+	ttl := fs.Duration("ttl", 72*time.Hour, "token lifetime")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: token [-email email] [-ttl 72h] <channel> <name>")
+	}
+
+	if !chitchat.ValidChannel(fs.Arg(0)) {
+		return fmt.Errorf("invalid channel %q, only letters, digits, dashes and underscores are allowed", fs.Arg(0))
+	}
+
+	secret := os.Getenv("JWT_SECRET")
+	if len(secret) == 0 {
+		return errors.New("JWT_SECRET is not set")
+	}
+
+	auth := chitchat.NewAuth(chitchat.NewUser(fs.Arg(1), *email), fs.Arg(0), *ttl)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, auth).SignedString([]byte(secret))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token)
+
+	return nil
+}
+
+// banCommand ban user in channel and kick all user connections.
+func banCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	reason := fs.String("reason", "", "ban reason")
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		return errors.New("usage: ban [-reason text] <channel> <user-id>")
+	}
+
+	channel, userId := fs.Arg(0), fs.Arg(1)
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	// Bucket config is owned by server, which creates it on startup
+	bans, err := c.js.KeyValue(chitchat.BansBucket)
+	if err == nats.ErrBucketNotFound {
+		return fmt.Errorf("bucket %s not found, start chitchat server first", chitchat.BansBucket)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(ban{Reason: *reason, BannedAt: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	if _, err := bans.Put(chitchat.BanKey(channel, userId), data); err != nil {
+		return err
+	}
+
+	// Kick message disconnects all active user connections
+	target := findUser(c.js, channel, userId)
+
+	data, err = json.Marshal(chitchat.ChannelMessage{
+		Type:     chitchat.TypeKick,
+		FromUser: admin,
+		SentAt:   time.Now(),
+		Target:   target,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := c.nc.Publish(chitchat.PresenceSubject(channel), data); err != nil {
+		return err
+	}
+
+	fmt.Printf("User %s banned in %s\n", userName(target), channel)
+
+	return nil
+}
+
+// unbanCommand remove user ban.
+func unbanCommand(c *ctl, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: unban <channel> <user-id>")
+	}
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	bans, err := c.js.KeyValue(chitchat.BansBucket)
+	if err != nil {
+		return err
+	}
+
+	if err := bans.Purge(chitchat.BanKey(args[0], args[1])); err != nil {
+		return err
+	}
+
+	fmt.Printf("User %s unbanned in %s\n", args[1], args[0])
+
+	return nil
+}
+
+// bansCommand list banned users.
+func bansCommand(c *ctl, args []string) error {
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	bans, err := c.js.KeyValue(chitchat.BansBucket)
+	if err == nats.ErrBucketNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := bans.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANNEL\tUSER ID\tBANNED AT\tREASON")
+	for _, key := range keys {
+		i := strings.LastIndex(key, ".")
+		channel, userId := key[:i], key[i+1:]
+
+		if len(args) > 0 && channel != args[0] {
+			continue
+		}
+
+		entry, err := bans.Get(key)
+		if err != nil {
+			continue
+		}
+
+		b := ban{}
+		json.Unmarshal(entry.Value(), &b)
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", channel, userId, b.BannedAt.Format(time.RFC3339), b.Reason)
+	}
+
+	return w.Flush()
+}
+
+// findUser in any user connection of channel presence bucket, falling back to user with id only.
+func findUser(js nats.JetStreamContext, channel, userId string) *chitchat.User {
+	user := &chitchat.User{Id: userId, Name: userId}
+
+	kv, err := js.KeyValue(chitchat.PresenceBucket(channel))
+	if err != nil {
+		return user
+	}
+
+	keys, err := kv.Keys()
+	if err != nil {
+		return user
+	}
+
+	// Keys are "<user-id>.<connection-id>"
+	for _, key := range keys {
+		if !strings.HasPrefix(key, userId+".") {
+			continue
+		}
+
+		if entry, err := kv.Get(key); err == nil {
+			json.Unmarshal(entry.Value(), user)
+			return user
+		}
+	}
+
+	return user
+}
+
+func userName(user *chitchat.User) string {
+	if user == nil {
+		return "-"
+	}
+
+	return user.Name
+}
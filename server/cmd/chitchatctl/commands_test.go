@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCtl start embedded JetStream server and connect ctl to it.
+func testCtl(t *testing.T) *ctl {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoSigs:    true,
+		NoLog:     true,
+	})
+	require.NoError(t, err)
+
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(10*time.Second))
+	t.Cleanup(srv.Shutdown)
+
+	c := &ctl{url: srv.ClientURL()}
+	require.NoError(t, c.connect())
+	t.Cleanup(c.nc.Close)
+
+	return c
+}
+
+// testPresence put user connection into channel presence bucket.
+func testPresence(t *testing.T, c *ctl, channel, connId string, user chitchat.User) {
+	kv, err := c.js.KeyValue(chitchat.PresenceBucket(channel))
+	if err == nats.ErrBucketNotFound {
+		kv, err = c.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: chitchat.PresenceBucket(channel)})
+	}
+	require.NoError(t, err)
+
+	data, err := json.Marshal(user)
+	require.NoError(t, err)
+
+	_, err = kv.Put(user.Id+"."+connId, data)
+	require.NoError(t, err)
+}
+
+func TestFindUser(t *testing.T) {
+	c := testCtl(t)
+
+	// No presence bucket yet
+	assert.Equal(t, &chitchat.User{Id: "jon", Name: "jon"}, findUser(c.js, "general", "jon"))
+
+	testPresence(t, c, "general", "conn1", chitchat.User{Id: "jon", Name: "Jon Snow"})
+	testPresence(t, c, "general", "conn1", chitchat.User{Id: "jonny", Name: "Jonny"})
+
+	user := findUser(c.js, "general", "jon")
+	assert.Equal(t, "jon", user.Id)
+	assert.Equal(t, "Jon Snow", user.Name)
+
+	// Offline user has id only
+	assert.Equal(t, &chitchat.User{Id: "arya", Name: "arya"}, findUser(c.js, "general", "arya"))
+}
+
+func TestBanCommand(t *testing.T) {
+	c := testCtl(t)
+
+	// Server didn't create bans bucket yet
+	assert.Error(t, banCommand(c, []string{"general", "jon"}))
+
+	_, err := c.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: chitchat.BansBucket, History: 5})
+	require.NoError(t, err)
+
+	testPresence(t, c, "general", "conn1", chitchat.User{Id: "jon", Name: "Jon Snow"})
+
+	kicks, err := c.nc.SubscribeSync(chitchat.PresenceSubject("general"))
+	require.NoError(t, err)
+
+	assert.NoError(t, banCommand(c, []string{"-reason", "spam", "general", "jon"}))
+
+	bans, err := c.js.KeyValue(chitchat.BansBucket)
+	require.NoError(t, err)
+
+	entry, err := bans.Get(chitchat.BanKey("general", "jon"))
+	if assert.NoError(t, err) {
+		b := ban{}
+		assert.NoError(t, json.Unmarshal(entry.Value(), &b))
+		assert.Equal(t, "spam", b.Reason)
+	}
+
+	// Bucket config is left as server made it
+	status, err := bans.Status()
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(5), status.History())
+	}
+
+	msg, err := kicks.NextMsg(time.Second)
+	if assert.NoError(t, err) {
+		kick := chitchat.ChannelMessage{}
+		assert.NoError(t, json.Unmarshal(msg.Data, &kick))
+		assert.Equal(t, chitchat.TypeKick, kick.Type)
+		assert.Equal(t, "Jon Snow", kick.Target.Name)
+	}
+}
+
+func TestUnbanCommand(t *testing.T) {
+	c := testCtl(t)
+
+	bans, err := c.js.CreateKeyValue(&nats.KeyValueConfig{Bucket: chitchat.BansBucket})
+	require.NoError(t, err)
+
+	assert.NoError(t, banCommand(c, []string{"general", "jon"}))
+	assert.NoError(t, banCommand(c, []string{"general", "arya"}))
+
+	assert.NoError(t, unbanCommand(c, []string{"general", "jon"}))
+
+	_, err = bans.Get(chitchat.BanKey("general", "jon"))
+	assert.Equal(t, nats.ErrKeyNotFound, err)
+
+	_, err = bans.Get(chitchat.BanKey("general", "arya"))
+	assert.NoError(t, err)
+}
+
+func TestPresencePurgeCommand(t *testing.T) {
+	c := testCtl(t)
+
+	testPresence(t, c, "general", "conn1", chitchat.User{Id: "jon", Name: "Jon Snow"})
+	testPresence(t, c, "general", "conn2", chitchat.User{Id: "jon", Name: "Jon Snow"})
+	testPresence(t, c, "general", "conn1", chitchat.User{Id: "jonny", Name: "Jonny"})
+
+	// All connections of the user are purged, users with the same id prefix stay
+	assert.NoError(t, presencePurgeCommand(c, []string{"general", "jon"}))
+
+	kv, err := c.js.KeyValue(chitchat.PresenceBucket("general"))
+	require.NoError(t, err)
+
+	keys, err := kv.Keys()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"jonny.conn1"}, keys)
+
+	// Whole bucket is deleted without user
+	assert.NoError(t, presencePurgeCommand(c, []string{"general"}))
+
+	_, err = c.js.KeyValue(chitchat.PresenceBucket("general"))
+	assert.Equal(t, nats.ErrBucketNotFound, err)
+}
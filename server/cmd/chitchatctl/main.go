@@ -0,0 +1,118 @@
+// Command chitchatctl operates ChitChat deployment by talking to NATS directly.
+//
+//	chitchatctl [-nats url] <command> [arguments]
+//
+// Run "chitchatctl help" for the list of commands.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/nats-io/nats.go"
+)
+
+// command is a chitchatctl subcommand.
+type command struct {
+	usage string
+	help  string
+	run   func(ctl *ctl, args []string) error
+}
+
+var commands = map[string]command{
+	"channels":        {"channels", "list channels with message counts", channelsCommand},
+	"messages":        {"messages [-n 20] <channel>", "show last channel messages with sequence numbers", messagesCommand},
+	"delete":          {"delete <channel> <seq>", "delete message by sequence number", deleteCommand},
+	"migrate-streams": {"migrate-streams [-max-age 0] [-max-bytes -1]", "move channels from shared stream to own streams", migrateStreamsCommand},
+	"tail":            {"tail <channel>", "print channel messages as they arrive", tailCommand},
+	"presence":        {"presence [channel]", "list presence buckets or users online in channel", presenceCommand},
+	"presence-purge":  {"presence-purge <channel> [user-id]", "purge channel presence bucket or single user", presencePurgeCommand},
+	"token":           {"token [-email email] [-ttl 72h] <channel> <name>", "mint auth token, requires JWT_SECRET", tokenCommand},
+	"ban":             {"ban <channel> <user-id>", "ban user in channel and disconnect it", banCommand},
+	"unban":           {"unban <channel> <user-id>", "remove user ban", unbanCommand},
+	"bans":            {"bans [channel]", "list banned users", bansCommand},
+}
+
+// ctl keeps NATS connection for commands.
+type ctl struct {
+	url string
+	nc  *nats.Conn
+	js  nats.JetStreamContext
+}
+
+// connect to NATS lazily, so commands like token work without it.
+func (c *ctl) connect() error {
+	if c.nc != nil {
+		return nil
+	}
+
+	nc, err := nats.Connect(c.url)
+	if err != nil {
+		return err
+	}
+
+	js, err := nc.JetStream()
+	if err != nil {
+		return err
+	}
+
+	c.nc, c.js = nc, js
+
+	return nil
+}
+
+func main() {
+	url := flag.String("nats", envOr("NATS_URL", nats.DefaultURL), "NATS server URL")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "chitchatctl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	c := &ctl{url: *url}
+
+	if err := cmd.run(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "chitchatctl: %v\n", err)
+		os.Exit(1)
+	}
+
+	if c.nc != nil {
+		c.nc.Drain()
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: chitchatctl [-nats url] <command> [arguments]\n\nCommands:\n")
+
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-50s %s\n", commands[name].usage, commands[name].help)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); len(v) > 0 {
+		return v
+	}
+
+	return fallback
+}
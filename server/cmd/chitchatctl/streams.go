@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/nats-io/nats.go"
+)
+
+// channelStreams return shared stream, if it exists, and streams of channels with stream-per-channel topology.
+func channelStreams(js nats.JetStreamContext) []string {
+	var streams []string
+
+	for name := range js.StreamNames() {
+		if name == chitchat.StreamName || strings.HasPrefix(name, chitchat.ChannelStreamPrefix) {
+			streams = append(streams, name)
+		}
+	}
+
+	sort.Strings(streams)
+
+	return streams
+}
+
+// channelStream return own stream of the channel or the shared one.
+func channelStream(js nats.JetStreamContext, channel string) string {
+	if _, err := js.StreamInfo(chitchat.ChannelStreamName(channel)); err == nil {
+		return chitchat.ChannelStreamName(channel)
+	}
+
+	return chitchat.StreamName
+}
+
+// migrateStreamsCommand move channels out of the shared stream, so servers could run with STREAM_TOPOLOGY=channel.
+// Channel streams source their events from the shared stream first, then it's deleted
+// and channel streams take over the subjects. Servers should be stopped while it's running.
+func migrateStreamsCommand(c *ctl, args []string) error {
+	fs := flag.NewFlagSet("migrate-streams", flag.ExitOnError)
+	maxAge := fs.Duration("max-age", 0, "channel stream max age, 0 is unlimited")
+	maxBytes := fs.Int64("max-bytes", -1, "channel stream max bytes, -1 is unlimited")
+	replicas := fs.Int("replicas", 1, "channel stream replicas")
+	timeout := fs.Duration("timeout", time.Minute, "time to wait for channel events copy")
+	fs.Parse(args)
+
+	if err := c.connect(); err != nil {
+		return err
+	}
+
+	subjects, err := subjectCounts(c.nc, chitchat.StreamName)
+	if err != nil {
+		return err
+	}
+
+	// Events by channel, subjects are "CHITCHAT.<channel>.<kind>"
+	counts := make(map[string]uint64)
+	for subject, n := range subjects {
+		parts := strings.Split(subject, ".")
+		if len(parts) == 3 {
+			counts[parts[1]] += n
+		}
+	}
+
+	var channels []string
+	for channel := range counts {
+		channels = append(channels, channel)
+	}
+	sort.Strings(channels)
+
+	for _, channel := range channels {
+		name := chitchat.ChannelStreamName(channel)
+
+		if _, err := c.js.StreamInfo(name); err == nil {
+			return fmt.Errorf("stream %s already exists", name)
+		}
+
+		_, err := c.js.AddStream(&nats.StreamConfig{
+			Name: name,
+			Sources: []*nats.StreamSource{{
+				Name:          chitchat.StreamName,
+				FilterSubject: chitchat.ChannelSubject(channel),
+			}},
+			MaxAge:   *maxAge,
+			MaxBytes: *maxBytes,
+			Replicas: *replicas,
+		})
+		if err != nil {
+			return fmt.Errorf("create stream %s: %w", name, err)
+		}
+	}
+
+	for _, channel := range channels {
+		if err := waitCopied(c.js, chitchat.ChannelStreamName(channel), counts[channel], *timeout); err != nil {
+			return err
+		}
+
+		fmt.Printf("Channel %s: %d events copied\n", channel, counts[channel])
+	}
+
+	// Shared stream subjects overlap with channel streams ones
+	if err := c.js.DeleteStream(chitchat.StreamName); err != nil {
+		return err
+	}
+
+	for _, channel := range channels {
+		name := chitchat.ChannelStreamName(channel)
+
+		info, err := c.js.StreamInfo(name)
+		if err != nil {
+			return err
+		}
+
+		config := info.Config
+		config.Sources = nil
+		config.Subjects = []string{chitchat.ChannelSubject(channel)}
+
+		if _, err := c.js.UpdateStream(&config); err != nil {
+			return fmt.Errorf("update stream %s: %w", name, err)
+		}
+
+		// History has link previews already, so only new messages are unfurled
+		_, err = c.js.AddConsumer(name, &nats.ConsumerConfig{
+			Durable:       chitchat.UnfurlConsumer,
+			DeliverPolicy: nats.DeliverNewPolicy,
+			AckPolicy:     nats.AckExplicitPolicy,
+			FilterSubject: chitchat.MessageSubject(channel),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%d channels moved, run servers with STREAM_TOPOLOGY=channel\n", len(channels))
+
+	return nil
+}
+
+// waitCopied wait until stream sourced all channel events.
+// Last sequence is compared, as limits could drop copied events.
+func waitCopied(js nats.JetStreamContext, stream string, events uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		info, err := js.StreamInfo(stream)
+		if err != nil {
+			return err
+		}
+
+		if info.State.LastSeq >= events {
+			return nil
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return errors.New("timeout waiting for " + stream + " to copy events")
+}
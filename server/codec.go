@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// Codec encode channel events to the wire format negotiated by WebSocket subprotocol.
+// Messages are stored in the stream as JSON regardless of the wire format.
+type Codec interface {
+	// Encode JSON channel message to the wire format.
+	Encode(data []byte) ([]byte, error)
+
+	// Binary tells if the wire format needs binary frames.
+	Binary() bool
+
+	// Batch join encoded messages in one frame.
+	Batch(messages [][]byte) []byte
+}
+
+// Subprotocols supported by the server, in preference order.
+// Without subprotocol client gets JSON.
+var Subprotocols = []string{"protobuf", "msgpack", "json"}
+
+// Binary codecs are shared by all connections, so each event is encoded once per codec.
+var codecs = map[string]Codec{
+	"json":     jsonCodec{},
+	"msgpack":  newSharedCodec(msgpackCodec{}),
+	"protobuf": newSharedCodec(protobufCodec{}),
+}
+
+// Encoded messages kept by shared codec, enough for events being sent to all connections at once.
+const sharedCodecSize = 1024
+
+// sharedCodec memoize encoded messages by their JSON, so event sent to many connections is encoded once.
+type sharedCodec struct {
+	Codec
+
+	mu sync.Mutex
+
+	// Recently encoded messages, previous generation is dropped when current one is full.
+	current  map[string]*encodedMessage
+	previous map[string]*encodedMessage
+}
+
+// encodedMessage is encoded once, other connections wait for it.
+type encodedMessage struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+func newSharedCodec(codec Codec) *sharedCodec {
+	return &sharedCodec{Codec: codec, current: make(map[string]*encodedMessage)}
+}
+
+// Encode return shared bytes of the same message, they must not be modified.
+func (c *sharedCodec) Encode(data []byte) ([]byte, error) {
+	encoded := c.get(data)
+
+	encoded.once.Do(func() {
+		encoded.data, encoded.err = c.Codec.Encode(data)
+	})
+
+	return encoded.data, encoded.err
+}
+
+// get encoded message by JSON, adding it if it's new.
+func (c *sharedCodec) get(data []byte) *encodedMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if encoded, ok := c.current[string(data)]; ok {
+		return encoded
+	}
+
+	encoded, ok := c.previous[string(data)]
+	if !ok {
+		encoded = &encodedMessage{}
+	}
+
+	if len(c.current) >= sharedCodecSize {
+		c.previous, c.current = c.current, make(map[string]*encodedMessage)
+	}
+
+	c.current[string(data)] = encoded
+
+	return encoded
+}
+
+// GetCodec by negotiated subprotocol, JSON codec is the default.
+func GetCodec(subprotocol string) Codec {
+	if codec, ok := codecs[subprotocol]; ok {
+		return codec
+	}
+
+	return jsonCodec{}
+}
+
+// jsonCodec send messages as they are stored.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+// Batch join messages by new lines as NDJSON, JSON messages don't contain them, see client.DecodeBatch.
+func (jsonCodec) Batch(messages [][]byte) []byte {
+	return bytes.Join(messages, []byte{'\n'})
+}
+
+// msgpackCodec encode messages to MessagePack maps with the same keys as JSON.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(data []byte) ([]byte, error) {
+	msg := ChannelMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+
+	if err := enc.Encode(msg); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+// Batch concatenate messages, MessagePack decoders read them one by one.
+func (msgpackCodec) Batch(messages [][]byte) []byte {
+	return bytes.Join(messages, nil)
+}
+
+// protobufCodec encode messages to ChannelMessage from chitchat.proto, same as in gRPC API.
+type protobufCodec struct{}
+
+func (protobufCodec) Encode(data []byte) ([]byte, error) {
+	msg := ChannelMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+
+	return proto.Marshal(toProtoMessage(msg))
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+// Batch prefix each message with its varint size, same as protodelim package.
+func (protobufCodec) Batch(messages [][]byte) []byte {
+	var frame []byte
+
+	for _, data := range messages {
+		frame = protowire.AppendVarint(frame, uint64(len(data)))
+		frame = append(frame, data...)
+	}
+
+	return frame
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchatpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+func testStoredMessage(t *testing.T) []byte {
+	data, err := json.Marshal(NewChannelMessage(NewUser("Jon Snow", "jon@labstack.com"), time.Now(), "Winter is coming"))
+	assert.NoError(t, err)
+
+	return data
+}
+
+func TestGetCodec(t *testing.T) {
+	assert.Equal(t, jsonCodec{}, GetCodec(""))
+	assert.Equal(t, jsonCodec{}, GetCodec("unknown"))
+	assert.Equal(t, msgpackCodec{}, GetCodec("msgpack").(*sharedCodec).Codec)
+	assert.Equal(t, protobufCodec{}, GetCodec("protobuf").(*sharedCodec).Codec)
+}
+
+// countingCodec count encoded messages.
+type countingCodec struct {
+	jsonCodec
+
+	mu      sync.Mutex
+	encoded int
+}
+
+func (c *countingCodec) Encode(data []byte) ([]byte, error) {
+	c.mu.Lock()
+	c.encoded++
+	c.mu.Unlock()
+
+	return append([]byte("encoded "), data...), nil
+}
+
+func TestSharedCodec(t *testing.T) {
+	counting := &countingCodec{}
+	codec := newSharedCodec(counting)
+
+	// Same event sent to many connections is encoded once
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			data, err := codec.Encode([]byte("one"))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("encoded one"), data)
+		}()
+	}
+
+	wg.Wait()
+	assert.Equal(t, 1, counting.encoded)
+
+	// Old messages are dropped
+	for i := 0; i < 2*sharedCodecSize; i++ {
+		codec.Encode([]byte(fmt.Sprint(i)))
+	}
+
+	codec.Encode([]byte("one"))
+	assert.Equal(t, 2*sharedCodecSize+2, counting.encoded)
+	assert.LessOrEqual(t, len(codec.current)+len(codec.previous), 2*sharedCodecSize)
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	data, err := msgpackCodec{}.Encode(testStoredMessage(t))
+	assert.NoError(t, err)
+
+	msg := map[string]interface{}{}
+	if assert.NoError(t, msgpack.Unmarshal(data, &msg)) {
+		assert.Equal(t, "message", msg["type"])
+		assert.Equal(t, "Winter is coming", msg["text"])
+		assert.Equal(t, "Jon Snow", msg["from_user"].(map[string]interface{})["name"])
+		assert.NotContains(t, msg["from_user"], "Email")
+		assert.IsType(t, time.Time{}, msg["sent_at"])
+	}
+}
+
+func TestProtobufCodec(t *testing.T) {
+	data, err := protobufCodec{}.Encode(testStoredMessage(t))
+	assert.NoError(t, err)
+
+	msg := &chitchatpb.ChannelMessage{}
+	if assert.NoError(t, proto.Unmarshal(data, msg)) {
+		assert.Equal(t, "message", msg.Type)
+		assert.Equal(t, "Winter is coming", msg.Text)
+		assert.Equal(t, "Jon Snow", msg.FromUser.Name)
+	}
+}
+
+func TestCodecBatch(t *testing.T) {
+	messages := [][]byte{[]byte("one"), []byte("two")}
+
+	assert.Equal(t, []byte("one\ntwo"), jsonCodec{}.Batch(messages))
+	assert.Equal(t, []byte("onetwo"), msgpackCodec{}.Batch(messages))
+	assert.Equal(t, []byte("\x03one\x03two"), protobufCodec{}.Batch(messages))
+}
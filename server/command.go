@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Command parsed from the user input, eg. "/topic Weekly sync".
+type Command struct {
+	// Command name without leading slash.
+	Name string
+
+	// Arguments splitted by whitespaces.
+	Args []string
+
+	// Raw arguments string as it was typed.
+	Text string
+}
+
+// ParseCommand try to parse slash command from the message.
+// Messages starting with "//" are not commands, so user could still send text like "/shrug".
+func ParseCommand(msg string) (Command, bool) {
+	if !strings.HasPrefix(msg, "/") || strings.HasPrefix(msg, "//") {
+		return Command{}, false
+	}
+
+	name, text, _ := strings.Cut(msg[1:], " ")
+	if len(name) == 0 {
+		return Command{}, false
+	}
+
+	text = strings.TrimSpace(text)
+
+	return Command{
+		Name: strings.ToLower(name),
+		Args: strings.Fields(text),
+		Text: text,
+	}, true
+}
+
+// CommandHandler execute command on behalf of consumer.
+// Returned reply is sent only to the command issuer.
+type CommandHandler func(c *Consumer, cmd Command) (string, error)
+
+// CommandsRegistry keeps all known slash commands.
+type CommandsRegistry struct {
+	mu       sync.RWMutex
+	commands map[string]CommandHandler
+}
+
+// NewCommandsRegistry build registry with built-in commands.
+// Moderators is a list of user ids allowed to kick other users.
+func NewCommandsRegistry(auth *authHandler, moderators []string) *CommandsRegistry {
+	r := &CommandsRegistry{
+		commands: make(map[string]CommandHandler),
+	}
+
+	r.Register("me", meCommand)
+	r.Register("shrug", shrugCommand)
+	r.Register("topic", topicCommand)
+	r.Register("nick", nickCommand)
+	r.Register("kick", kickCommand(moderators))
+	r.Register("invite", inviteCommand(auth))
+	r.Register("retention", retentionCommand(moderators))
+
+	return r
+}
+
+// Register new command handler, overriding existed one with the same name.
+func (r *CommandsRegistry) Register(name string, handler CommandHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.commands[strings.ToLower(name)] = handler
+}
+
+// Execute command by consumer.
+func (r *CommandsRegistry) Execute(c *Consumer, cmd Command) (string, error) {
+	r.mu.RLock()
+	handler, ok := r.commands[cmd.Name]
+	r.mu.RUnlock()
+
+	if !ok {
+		return "", fmt.Errorf("Unknown command /%s", cmd.Name)
+	}
+
+	return handler(c, cmd)
+}
+
+// LoadCommands register custom commands from config string,
+// eg. "deploy=bot,weather=http://weather.local/hook".
+// "bot" commands are routed to the channel for bots, any URL is treated as a webhook.
+func (r *CommandsRegistry) LoadCommands(config string) error {
+	for _, entry := range strings.Split(config, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		name, target, ok := strings.Cut(entry, "=")
+		if !ok || len(name) == 0 || len(target) == 0 {
+			return fmt.Errorf("invalid command config: %q", entry)
+		}
+
+		if target == "bot" {
+			r.Register(name, BotCommand)
+		} else {
+			r.Register(name, WebhookCommand(target))
+		}
+	}
+
+	return nil
+}
+
+// BotCommand publish command to the channel, so bots could handle it.
+func BotCommand(c *Consumer, cmd Command) (string, error) {
+	c.Publish(EventMessage, NewChannelCommandMessage(c.User, time.Now(), cmd))
+
+	return "", nil
+}
+
+// webhookTimeout is a time allowed for webhook to respond.
+const webhookTimeout = 5 * time.Second
+
+// webhookRequest is a payload sent to command webhook.
+type webhookRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	Text    string   `json:"text"`
+	Channel string   `json:"channel"`
+	User    *User    `json:"user"`
+}
+
+// webhookResponse is expected webhook reply.
+// Response type "in_channel" publish text to the channel, otherwise it's ephemeral.
+type webhookResponse struct {
+	Text         string `json:"text"`
+	ResponseType string `json:"response_type"`
+}
+
+// WebhookCommand forward command to the webhook url.
+func WebhookCommand(url string) CommandHandler {
+	client := &http.Client{Timeout: webhookTimeout}
+
+	return func(c *Consumer, cmd Command) (string, error) {
+		data, err := json.Marshal(webhookRequest{
+			Command: cmd.Name,
+			Args:    cmd.Args,
+			Text:    cmd.Text,
+			Channel: c.Channel,
+			User:    c.User,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			c.Logger.Errorf("Command webhook error: %v", err)
+			return "", fmt.Errorf("Command /%s is not available", cmd.Name)
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("Command /%s failed", cmd.Name)
+		}
+
+		reply := webhookResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+			return "", fmt.Errorf("Command /%s failed", cmd.Name)
+		}
+
+		if reply.ResponseType == "in_channel" {
+			c.Publish(EventMessage, NewChannelMessage(c.User, time.Now(), reply.Text))
+
+			return "", nil
+		}
+
+		return reply.Text, nil
+	}
+}
+
+// meCommand publish action message, eg. "/me waves".
+func meCommand(c *Consumer, cmd Command) (string, error) {
+	if len(cmd.Text) == 0 {
+		return "", errors.New("Usage: /me <action>")
+	}
+
+	c.Publish(EventMessage, NewChannelActionMessage(c.User, time.Now(), cmd.Text))
+
+	return "", nil
+}
+
+// shrugCommand append shrug to the message.
+func shrugCommand(c *Consumer, cmd Command) (string, error) {
+	text := strings.TrimSpace(cmd.Text + ` ¯\_(ツ)_/¯`)
+
+	c.Publish(EventMessage, NewChannelMessage(c.User, time.Now(), text))
+
+	return "", nil
+}
+
+// topicCommand change channel topic.
+func topicCommand(c *Consumer, cmd Command) (string, error) {
+	if len(cmd.Text) == 0 {
+		return "", errors.New("Usage: /topic <topic>")
+	}
+
+	c.Publish(EventMessage, NewChannelTopicMessage(c.User, time.Now(), cmd.Text))
+
+	return "", nil
+}
+
+// nickCommand change user name for current connection.
+func nickCommand(c *Consumer, cmd Command) (string, error) {
+	if len(cmd.Text) == 0 {
+		return "", errors.New("Usage: /nick <name>")
+	}
+
+	oldName := c.User.Name
+	c.User.Name = cmd.Text
+
+	if err := c.store.Presence.Update(c.Channel, c.User); err != nil {
+		return "", err
+	}
+
+	c.Publish(EventPresence, NewChannelNickMessage(c.User, time.Now(), oldName))
+
+	return fmt.Sprintf("You are now known as %s", c.User.Name), nil
+}
+
+// kickCommand disconnect user from the channel, allowed only for moderators.
+func kickCommand(moderators []string) CommandHandler {
+	return func(c *Consumer, cmd Command) (string, error) {
+		if !contains(moderators, c.User.Id) {
+			return "", errors.New("Only moderators can kick users")
+		}
+
+		if len(cmd.Text) == 0 {
+			return "", errors.New("Usage: /kick <name>")
+		}
+
+		target, err := findPresentUser(c, cmd.Text)
+		if err != nil {
+			return "", err
+		}
+
+		c.Publish(EventPresence, NewChannelKickMessage(c.User, time.Now(), target))
+
+		return fmt.Sprintf("%s was kicked", target.Name), nil
+	}
+}
+
+// retentionCommand show or change channel history retention, changes are allowed only for moderators.
+// Eg. "/retention 30d", "/retention 1000 messages", "/retention 10MB" or "/retention forever".
+func retentionCommand(moderators []string) CommandHandler {
+	return func(c *Consumer, cmd Command) (string, error) {
+		if c.store.Retention == nil {
+			return "", errors.New("Retention policies are not supported by storage")
+		}
+
+		if len(cmd.Args) == 0 {
+			policy, err := c.store.Retention.Retention(c.Channel)
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("History is kept %s", retentionDescription(policy)), nil
+		}
+
+		if !contains(moderators, c.User.Id) {
+			return "", errors.New("Only moderators can change retention")
+		}
+
+		policy, err := ParseRetentionPolicy(cmd.Args)
+		if err != nil {
+			return "", errors.New("Usage: /retention [forever|<days>d|<count> messages|<size>MB]")
+		}
+
+		if err := c.store.Retention.SetRetention(c.Channel, policy); err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("History is now kept %s", retentionDescription(policy)), nil
+	}
+}
+
+func retentionDescription(policy RetentionPolicy) string {
+	if policy.IsForever() {
+		return "forever"
+	}
+
+	return "up to " + policy.String()
+}
+
+// inviteCommand generate token for invited user, eg. "/invite Bob bob@example.com".
+func inviteCommand(auth *authHandler) CommandHandler {
+	return func(c *Consumer, cmd Command) (string, error) {
+		if len(cmd.Args) == 0 {
+			return "", errors.New("Usage: /invite <name> [email]")
+		}
+
+		name, email := cmd.Args[0], ""
+		if len(cmd.Args) > 1 {
+			email = cmd.Args[1]
+		}
+
+		token, err := auth.NewToken(NewUser(name, email), c.Channel)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("Invite token for %s: %s", name, token), nil
+	}
+}
+
+// findPresentUser by name in channel presence store.
+func findPresentUser(c *Consumer, name string) (*User, error) {
+	users, err := c.store.Presence.Users(c.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if strings.EqualFold(user.Name, name) {
+			return &user, nil
+		}
+	}
+
+	return nil, fmt.Errorf("User %s is not in the channel", name)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
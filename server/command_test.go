@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	cmd, ok := ParseCommand("/Topic  Weekly sync ")
+
+	if assert.True(t, ok) {
+		assert.Equal(t, "topic", cmd.Name)
+		assert.Equal(t, "Weekly sync", cmd.Text)
+		assert.Equal(t, []string{"Weekly", "sync"}, cmd.Args)
+	}
+}
+
+func TestParseCommandWithoutArgs(t *testing.T) {
+	cmd, ok := ParseCommand("/shrug")
+
+	if assert.True(t, ok) {
+		assert.Equal(t, "shrug", cmd.Name)
+		assert.Equal(t, "", cmd.Text)
+		assert.Empty(t, cmd.Args)
+	}
+}
+
+func TestParseCommandNotCommand(t *testing.T) {
+	for _, msg := range []string{"hello", "//shrug", "/ hello", ""} {
+		_, ok := ParseCommand(msg)
+
+		assert.False(t, ok, msg)
+	}
+}
+
+func TestLoadCommands(t *testing.T) {
+	r := NewCommandsRegistry(NewAuthHandler(jwtSecret), nil)
+
+	assert.NoError(t, r.LoadCommands("deploy=bot, weather=http://localhost/hook"))
+	assert.Contains(t, r.commands, "deploy")
+	assert.Contains(t, r.commands, "weather")
+
+	assert.Error(t, r.LoadCommands("broken"))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	r := NewCommandsRegistry(NewAuthHandler(jwtSecret), nil)
+
+	_, err := r.Execute(&Consumer{}, Command{Name: "unknown"})
+
+	if assert.Error(t, err) {
+		assert.Equal(t, "Unknown command /unknown", err.Error())
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/faustman/chitchat/server/chitchat"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
-	"github.com/nats-io/nats.go"
 )
 
 // Default configuration for WS connections.
@@ -21,8 +24,8 @@ const (
 	// Send pings to peer with this period. Must be less than pongWait.
 	pingPeriod = (pongWait * 9) / 10
 
-	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// Maximum pending events coalesced in one write.
+	maxBatchSize = 64
 )
 
 // consumerHub suppose to organize cosumers in one place
@@ -36,14 +39,30 @@ type ConsumersHub struct {
 
 	// Unregister consumer from consumers.
 	unregister chan *Consumer
+
+	// Typing consumers, broadcasted to datagram consumers of the same channel.
+	typing chan *Consumer
+
+	// Closed on shutdown, for connections outside of hub.
+	done chan bool
+
+	// Consumers send queue configuration.
+	queueConfig SendQueueConfig
+
+	// Message size limits of the channels.
+	limits MessageLimits
 }
 
 // NewConsumersHub create new hub.
-func NewConsumersHub() *ConsumersHub {
+func NewConsumersHub(queueConfig SendQueueConfig, limits MessageLimits) *ConsumersHub {
 	return &ConsumersHub{
-		consumers:  make(map[*Consumer]bool),
-		register:   make(chan *Consumer),
-		unregister: make(chan *Consumer),
+		queueConfig: queueConfig,
+		limits:      limits,
+		consumers:   make(map[*Consumer]bool),
+		register:    make(chan *Consumer),
+		unregister:  make(chan *Consumer),
+		typing:      make(chan *Consumer),
+		done:        make(chan bool),
 	}
 }
 
@@ -57,11 +76,34 @@ func (h *ConsumersHub) run() {
 			if _, ok := h.consumers[consumer]; ok {
 				delete(h.consumers, consumer)
 			}
+		case from := <-h.typing:
+			h.broadcastTyping(from)
+		}
+	}
+}
+
+// broadcastTyping send typing notification to other users in the channel.
+// Typing is volatile, so it's only delivered over datagrams to consumers on this server.
+func (h *ConsumersHub) broadcastTyping(from *Consumer) {
+	data, err := json.Marshal(NewChannelTypingMessage(from.User, time.Now()))
+	if err != nil {
+		return
+	}
+
+	for consumer := range h.consumers {
+		if consumer.Channel != from.Channel || consumer.User.Id == from.User.Id {
+			continue
+		}
+
+		if conn, ok := consumer.conn.(DatagramTransport); ok {
+			conn.SendDatagram(data)
 		}
 	}
 }
 
 func (h *ConsumersHub) Shutdown() {
+	close(h.done)
+
 	for consumer := range h.consumers {
 		consumer.Shutdown()
 	}
@@ -75,97 +117,132 @@ type Consumer struct {
 	// Current user.
 	User *User
 
-	// WebSocket connection.
-	ws *websocket.Conn
-
-	// Channel stream.
-	stream nats.JetStreamContext
+	// Client connection, eg. WebSocket or WebTransport.
+	conn Transport
 
-	// Presence store.
-	presence nats.KeyValue
+	// Channel events, history and presence.
+	store *Storage
 
 	// ConsumersHub for self management.
 	hub *ConsumersHub
 
+	// Slash commands registry.
+	commands *CommandsRegistry
+
 	// Binded Logger for tracking internal process.
 	Logger echo.Logger
 
-	shutdown chan bool
+	shutdown     chan bool
+	shutdownOnce sync.Once
+
+	// Outbound events and replies, drained by the only writer in Listen.
+	queue chan outbound
+
+	// What to do when queue is full.
+	policy OverflowPolicy
+
+	// Close connection from the writer, eg. on overflow.
+	evict chan eviction
+
+	// Signal writer to resume paused subscription.
+	resume chan bool
+
+	// Guards subscription state below.
+	mu sync.Mutex
+
+	// Current subscription and its generation, callbacks of replaced ones are ignored.
+	sub Subscription
+	gen int
+
+	// Subscription is paused on overflow, events are replayed starting from resumeSeq.
+	paused    bool
+	resumeSeq uint64
+
+	// Connection is about to be closed, no need to queue events anymore.
+	evicted bool
+
+	// Presence of the connection in the channel, set by Register
+	presence *PresenceConn
 }
 
 // NewConsumer build new Consumer
 // TODO: let's reduce number of agruments
-func NewConsumer(channel string, user *User, ws *websocket.Conn, hub *ConsumersHub, stream nats.JetStreamContext, presence nats.KeyValue, logger echo.Logger) *Consumer {
+func NewConsumer(channel string, user *User, conn Transport, hub *ConsumersHub, store *Storage, commands *CommandsRegistry, logger echo.Logger) *Consumer {
 	return &Consumer{
 		Channel:  channel,
 		User:     user,
-		ws:       ws,
+		conn:     conn,
 		hub:      hub,
-		stream:   stream,
-		presence: presence,
+		store:    store,
+		commands: commands,
 		Logger:   logger,
 		shutdown: make(chan bool),
+		queue:    make(chan outbound, hub.queueConfig.Size),
+		policy:   hub.queueConfig.Policy,
+		evict:    make(chan eviction, 1),
+		resume:   make(chan bool, 1),
 	}
 }
 
 // Register consumer in hub, managing join presence.
-func (c Consumer) Register() {
-	c.hub.register <- &c
-
-	if c.Join() {
-		data, err := json.Marshal(c.User)
-		if err != nil {
-			c.Logger.Errorf("Consumer JSON Marshall error: %v", err)
-		}
+func (c *Consumer) Register() {
+	c.hub.register <- c
 
-		// Put user in presence store
-		c.presence.Create(c.User.Id, data)
-	}
+	c.presence = Join(c.store, c.Channel, c.User)
 }
 
 // Unregister consumer from hub, managing leave presence.
-func (c Consumer) Unregister() {
-	c.hub.unregister <- &c
+func (c *Consumer) Unregister() {
+	c.hub.unregister <- c
 
-	if c.Leave() {
-		// Remove user from presence store
-		c.presence.Purge(c.User.Id)
-	}
+	c.presence.Leave()
 }
 
 // Listen create new listener for incomming and ongoing channel messages for User consumer.
-func (c Consumer) Listen() {
+func (c *Consumer) Listen() {
 	defer c.Unregister()
 
-	var subscription *nats.Subscription
-
-	// Without nats.DeliverNew() the subscriber will get all messages in the stream
+	// Without start sequence the subscriber will get all messages in the stream
 	// It allows us for free fill the chat history in UI, but I found that it hard to manage it
 	// if it'll passible to pass last message time to WS reconnect state,
 	// then we'll send to client only missed messages.
-	//
-	// Consumer description here used for track users subscription. See Unregister for details.
-	subscription, err := c.stream.Subscribe(ChannelSubject(c.Channel), func(msg *nats.Msg) {
-		c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-		c.ws.WriteMessage(websocket.TextMessage, msg.Data)
-	}, nats.DeliverNew(), nats.Description(c.User.Id))
-
-	if err != nil {
+	if err := c.subscribe(0); err != nil {
 		c.Logger.Errorf("Consumer Listener error: %v", err)
 		return
 	}
 
-	defer subscription.Unsubscribe()
+	defer c.unsubscribe()
+
+	// Datagram pump, only "typing" notifications are expected from client
+	if conn, ok := c.conn.(DatagramTransport); ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		go func() {
+			for {
+				data, err := conn.ReceiveDatagram(ctx)
+				if err != nil {
+					return
+				}
+
+				if string(data) == typingDatagram {
+					c.hub.typing <- c
+				}
+			}
+		}()
+	}
 
 	// Read pump
 	go func() {
-		c.ws.SetReadLimit(maxMessageSize)
-		c.ws.SetReadDeadline(time.Now().Add(pongWait))
-		c.ws.SetPongHandler(func(string) error { c.ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
-
 		for {
 			// Read msg
-			_, msg, err := c.ws.ReadMessage()
+			msg, err := c.conn.ReadMessage()
+			if err == ErrMessageTooBig {
+				// Keep connection open, message is already discarded
+				c.ReplyError(err.Error())
+				continue
+			}
+
 			if err != nil {
 				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 					c.Logger.Errorf("Consumer read error: %v", err)
@@ -175,7 +252,26 @@ func (c Consumer) Listen() {
 				break
 			}
 
-			c.PublishMsg(MessageSubject(c.Channel), NewChannelMessage(c.User, time.Now(), string(msg)))
+			out := ParseOutgoingMessage(msg)
+			text := out.Text
+
+			// Keep connection open, just tell the client that message is not sent
+			if err := c.hub.limits.Check(c.Channel, text); err != nil {
+				c.replySendError(out.ClientId, err.Error())
+				continue
+			}
+
+			if cmd, ok := ParseCommand(text); ok {
+				c.ExecuteCommand(cmd)
+				continue
+			}
+
+			// Escaped slash, eg. "//shrug" is sent as "/shrug" text
+			if strings.HasPrefix(text, "//") {
+				text = text[1:]
+			}
+
+			c.Send(text, out.ClientId)
 		}
 	}()
 
@@ -183,68 +279,276 @@ func (c Consumer) Listen() {
 	ticker := time.NewTicker(pingPeriod)
 	defer ticker.Stop()
 
-	// Service stuff
+	// Stream sequence of the last written event, to skip already written ones after resume
+	var lastSeq uint64
+
+	resuming := false
+
+	// Writer, the only one writing to the connection
 	for {
 		select {
 		case <-c.shutdown:
 			// Shutdown
-			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			c.ws.WriteMessage(websocket.CloseMessage, []byte{})
+			c.conn.Close(websocket.CloseNoStatusReceived, "")
+			return
+		case e := <-c.evict:
+			c.conn.Close(e.code, e.reason)
 			return
+		case <-c.resume:
+			resuming = true
+		case out := <-c.queue:
+			var batch [][]byte
+			var seqs []uint64
+			kicked := false
+
+			for {
+				if out.seq == 0 || out.seq > lastSeq {
+					batch = append(batch, out.data)
+					seqs = append(seqs, out.seq)
+					kicked = out.kick
+
+					if out.seq > 0 {
+						lastSeq = out.seq
+					}
+				}
+
+				// Coalesce pending events in one write, eg. in busy channels
+				if kicked || len(batch) >= maxBatchSize || len(c.queue) == 0 {
+					break
+				}
+
+				out = <-c.queue
+			}
+
+			if len(batch) > 0 {
+				if err := c.write(batch, seqs); err != nil {
+					return
+				}
+
+				sendQueueMetrics.Add("written", int64(len(batch)))
+			}
+
+			if kicked {
+				c.conn.Close(evictKicked.code, evictKicked.reason)
+				return
+			}
 		case <-ticker.C:
-			c.ws.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.ws.WriteMessage(websocket.PingMessage, nil); err != nil {
+			if err := c.conn.Ping(); err != nil {
 				return
 			}
 		}
 
+		// Replay missed events once client catch up
+		if resuming && len(c.queue) == 0 {
+			resuming = false
+
+			if err := c.resumeSubscription(); err != nil {
+				c.Logger.Errorf("Consumer resume error: %v", err)
+				return
+			}
+		}
 	}
 }
 
-func (c Consumer) Shutdown() {
-	close(c.shutdown)
+// write batch of events, with their sequences if transport sends them.
+func (c *Consumer) write(batch [][]byte, seqs []uint64) error {
+	if conn, ok := c.conn.(EventTransport); ok {
+		return conn.WriteEvents(batch, seqs)
+	}
+
+	return c.conn.WriteMessages(batch)
 }
 
-// Join to channel if no consumers for User
-func (c Consumer) Join() bool {
-	consumers := GetConsumersDescription(c.stream)
+// subscribe to channel events starting from the sequence, replacing current subscription.
+// Only new events are delivered if sequence is zero.
+func (c *Consumer) subscribe(startSeq uint64) error {
+	c.mu.Lock()
+	c.gen++
+	gen := c.gen
+	c.paused = false
+	c.mu.Unlock()
 
-	// if there still no more consumers for user
-	// send leave msg to the channel
-	for _, consumer := range consumers {
-		if consumer == c.User.Id {
-			return false
-		}
+	opts := SubscribeOptions{StartSeq: startSeq}
+
+	sub, err := c.store.Broker.Subscribe(c.Channel, opts, func(e Event) {
+		c.enqueueEvent(gen, e)
+	})
+	if err != nil {
+		return err
 	}
 
-	c.PublishMsg(PresenceSubject(c.Channel), NewChannelJoinMessage(c.User, time.Now()))
+	c.mu.Lock()
+	old := c.sub
+	c.sub = sub
+	c.mu.Unlock()
 
-	return true
+	// New subscription is already in place, so user stays present
+	if old != nil {
+		old.Unsubscribe()
+	}
+
+	return nil
+}
+
+// unsubscribe from channel events.
+func (c *Consumer) unsubscribe() {
+	c.mu.Lock()
+	sub := c.sub
+	c.sub = nil
+	c.gen++
+	c.mu.Unlock()
+
+	if sub != nil {
+		sub.Unsubscribe()
+	}
 }
 
-// Leave from channel if no more consumers for User
-func (c Consumer) Leave() bool {
-	consumers := GetConsumersDescription(c.stream)
+// resumeSubscription replay events starting from the first dropped one.
+func (c *Consumer) resumeSubscription() error {
+	c.mu.Lock()
+	seq := c.resumeSeq
+	c.mu.Unlock()
 
-	// if there still no more consumers for user
-	// send leave msg to the channel
-	for _, consumer := range consumers {
-		if consumer == c.User.Id {
-			return false
+	sendQueueMetrics.Add("resumed", 1)
+
+	return c.subscribe(seq)
+}
+
+// enqueueEvent put channel event in send queue, applying overflow policy if it's full.
+// Called from subscription, so it never blocks Broker dispatcher.
+func (c *Consumer) enqueueEvent(gen int, e Event) {
+	out := outbound{data: e.Data, seq: e.Seq, kick: isKick(e, c.User)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Replaced subscription, event will be replayed or connection is closing
+	if gen != c.gen || c.paused || c.evicted {
+		return
+	}
+
+	if c.push(out) {
+		return
+	}
+
+	switch {
+	case out.kick:
+		c.evictWith(evictKicked)
+	case c.policy == OverflowDisconnect:
+		sendQueueMetrics.Add("evicted", 1)
+		c.evictWith(evictSlow)
+	case c.policy == OverflowResume && e.Seq > 0:
+		sendQueueMetrics.Add("paused", 1)
+		c.paused, c.resumeSeq = true, e.Seq
+
+		select {
+		case c.resume <- true:
+		default:
 		}
+	default:
+		sendQueueMetrics.Add("dropped", 1)
+	}
+}
+
+// push put event in send queue without blocking, false if queue is full.
+func (c *Consumer) push(out outbound) bool {
+	select {
+	case c.queue <- out:
+		sendQueueMetrics.Add("queued", 1)
+		return true
+	default:
+		return false
 	}
+}
 
-	c.PublishMsg(PresenceSubject(c.Channel), NewChannelLeaveMessage(c.User, time.Now()))
+// evictWith ask writer to close connection.
+func (c *Consumer) evictWith(e eviction) {
+	c.evicted = true
 
-	return true
+	select {
+	case c.evict <- e:
+	default:
+	}
 }
 
-// Publish channel message to the channel
-func (c Consumer) PublishMsg(subject string, msg ChannelMessage) {
+// ExecuteCommand run slash command and reply to the user with result.
+func (c *Consumer) ExecuteCommand(cmd Command) {
+	reply, err := c.commands.Execute(c, cmd)
+	if err != nil {
+		reply = err.Error()
+	}
+
+	if len(reply) > 0 {
+		c.Reply(reply)
+	}
+}
+
+// Reply send ephemeral message only to the current consumer.
+func (c *Consumer) Reply(text string) {
+	c.send(NewChannelEphemeralMessage(time.Now(), text))
+}
+
+// ReplyError send error message only to the current consumer, eg. when its message is rejected.
+func (c *Consumer) ReplyError(text string) {
+	c.send(NewChannelErrorMessage(time.Now(), text))
+}
+
+// send message directly to the consumer, bypassing the stream.
+func (c *Consumer) send(msg ChannelMessage) {
 	data, err := json.Marshal(msg)
 	if err != nil {
 		c.Logger.Errorf("Consumer JSON Marshall error: %v", err)
+		return
+	}
+
+	if !c.push(outbound{data: data}) {
+		sendQueueMetrics.Add("dropped", 1)
+	}
+}
+
+// replySendError send error message with client id of the rejected message.
+func (c *Consumer) replySendError(clientId, text string) {
+	msg := NewChannelErrorMessage(time.Now(), text)
+	msg.ClientId = clientId
+
+	c.send(msg)
+}
+
+// Shutdown close consumer connection, it's safe to call it several times.
+func (c *Consumer) Shutdown() {
+	c.shutdownOnce.Do(func() {
+		close(c.shutdown)
+	})
+}
+
+// Publish channel message of the kind to the channel
+func (c *Consumer) Publish(kind string, msg ChannelMessage) {
+	if err := c.store.Broker.Publish(c.Channel, kind, msg); err != nil {
+		c.Logger.Errorf("Consumer publish error: %v", err)
+	}
+}
+
+// Send text message of the user, replying with "sent" once it's stored or with error, so client could retry.
+func (c *Consumer) Send(text, clientId string) {
+	msg, _, err := SendMessage(c.store, c.Channel, c.User, text, clientId)
+	if err != nil {
+		c.Logger.Errorf("Consumer send error: %v", err)
+		c.replySendError(clientId, ErrMessageNotSent.Error())
+		return
+	}
+
+	c.send(NewChannelSentMessage(time.Now(), msg.Id, clientId, msg.Seq))
+}
+
+// ParseOutgoingMessage parse client frame, JSON one with client id or plain text.
+func ParseOutgoingMessage(data []byte) chitchat.OutgoingMessage {
+	out := chitchat.OutgoingMessage{}
+
+	if len(data) > 0 && data[0] == '{' {
+		if err := json.Unmarshal(data, &out); err == nil && len(out.Text) > 0 && len(out.ClientId) > 0 {
+			return out
+		}
 	}
 
-	c.stream.Publish(subject, data)
+	return chitchat.OutgoingMessage{Text: string(data)}
 }
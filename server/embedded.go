@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// embeddedNATS is a NATS server with JetStream running in process, so chitchat could run without Docker Compose.
+// Everything works the same as with external NATS, including attachments, thumbnails and link previews.
+type embeddedNATS struct {
+	server *server.Server
+
+	// Temporary store directory, removed on shutdown
+	tempDir string
+}
+
+// NewEmbeddedNATS start NATS server on random localhost port.
+// Streams and buckets are kept in dataDir, or in temporary directory if it's empty, so they are lost on restart.
+func NewEmbeddedNATS(dataDir string) (*embeddedNATS, error) {
+	n := &embeddedNATS{}
+
+	if len(dataDir) == 0 {
+		tempDir, err := os.MkdirTemp("", "chitchat-nats-")
+		if err != nil {
+			return nil, err
+		}
+
+		dataDir, n.tempDir = tempDir, tempDir
+	}
+
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  dataDir,
+		NoSigs:    true,
+		NoLog:     true,
+	})
+	if err != nil {
+		n.removeTempDir()
+		return nil, err
+	}
+
+	n.server = srv
+
+	go srv.Start()
+
+	if !srv.ReadyForConnections(10 * time.Second) {
+		n.Shutdown()
+		return nil, errors.New("embedded NATS server is not ready")
+	}
+
+	return n, nil
+}
+
+// URL of the server for clients, eg. chitchatctl.
+func (n *embeddedNATS) URL() string {
+	return n.server.ClientURL()
+}
+
+// Shutdown the server and remove temporary store.
+func (n *embeddedNATS) Shutdown() {
+	n.server.Shutdown()
+	n.server.WaitForShutdown()
+	n.removeTempDir()
+}
+
+func (n *embeddedNATS) removeTempDir() {
+	if len(n.tempDir) > 0 {
+		os.RemoveAll(n.tempDir)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testNewStream connect to NATS and create stream.
+func testNewStream(t *testing.T, url string, config StreamConfig) (*JetStream, error) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(nc.Close)
+
+	return NewStream(nc, config, DefaultJetStreamConfig, log.New("test"))
+}
+
+// testPublishCore publish message with core NATS, stream stores it without waiting for ack.
+func testPublishCore(t *testing.T, url, channel string, msg ChannelMessage) {
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	data, _ := json.Marshal(msg)
+
+	assert.NoError(t, nc.Publish(chitchat.MessageSubject(channel), data))
+	assert.NoError(t, nc.Flush())
+}
+
+func TestEmbeddedNATS(t *testing.T) {
+	dataDir := t.TempDir()
+	user := NewUser("Jon Snow", "")
+
+	embedded, err := NewEmbeddedNATS(dataDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	js, err := testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		embedded.Shutdown()
+		return
+	}
+
+	testPublishCore(t, embedded.URL(), "general", NewChannelMessage(user, time.Now(), "Winter is coming"))
+	embedded.Shutdown()
+
+	// History is kept in data dir between restarts
+	embedded, err = NewEmbeddedNATS(dataDir)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err = testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	messages, err := NewJetStreamStorage(js).Messages.Messages("general", MessageQuery{})
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "Winter is coming", messages[0].Text)
+	}
+}
+
+func TestEmbeddedNATSTempDir(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	_, err = testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	assert.NoError(t, err)
+
+	embedded.Shutdown()
+
+	_, err = os.Stat(embedded.tempDir)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"golang.org/x/net/html"
+)
+
+// Link fetcher limits.
+const (
+	// Time allowed to fetch a page, including redirects.
+	fetchTimeout = 5 * time.Second
+
+	// Maximum bytes read from a page, metadata is in the head anyway.
+	maxFetchSize = 512 * 1024
+
+	// Maximum redirects to follow.
+	maxFetchRedirects = 3
+
+	// Maximum length of preview title and description.
+	maxPreviewText = 300
+)
+
+var (
+	errForbiddenAddress = errors.New("address is not allowed")
+	errNotHTML          = errors.New("content is not HTML")
+)
+
+// Addresses that are not public, see https://en.wikipedia.org/wiki/Reserved_IP_addresses.
+// IsPrivate, IsLoopback etc. cover the rest.
+var reservedNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+	mustParseCIDR("192.0.0.0/24"),
+	mustParseCIDR("198.18.0.0/15"),
+	mustParseCIDR("240.0.0.0/4"),
+	mustParseCIDR("64:ff9b::/96"),
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+// isPublicIP check that IP is routable in the internet, so fetcher can't reach internal services.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// LinkPreview is OpenGraph or oEmbed metadata of a link.
+type LinkPreview = chitchat.LinkPreview
+
+// LinkFetcher fetch link previews from untrusted URLs.
+// Address is checked right before connecting, after DNS resolution, so DNS rebinding doesn't help to reach private network.
+type LinkFetcher struct {
+	client *http.Client
+
+	// Allow private addresses, only for tests with local servers.
+	allowPrivate bool
+}
+
+// NewLinkFetcher build fetcher with timeouts, redirects limit and private networks protection.
+func NewLinkFetcher() *LinkFetcher {
+	f := &LinkFetcher{}
+
+	dialer := &net.Dialer{
+		Timeout: fetchTimeout,
+		Control: f.checkAddress,
+	}
+
+	f.client = &http.Client{
+		Timeout: fetchTimeout,
+		Transport: &http.Transport{
+			// Never use environment proxy, it would connect instead of us
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   fetchTimeout,
+			ResponseHeaderTimeout: fetchTimeout,
+			MaxIdleConns:          10,
+			IdleConnTimeout:       30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return errors.New("too many redirects")
+			}
+
+			return checkScheme(req.URL)
+		},
+	}
+
+	return f
+}
+
+// checkAddress is a dialer control, it's called with resolved IP for every connection.
+func (f *LinkFetcher) checkAddress(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || (!f.allowPrivate && !isPublicIP(ip)) {
+		return fmt.Errorf("%w: %s", errForbiddenAddress, host)
+	}
+
+	return nil
+}
+
+// checkScheme allow only http and https links.
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	return nil
+}
+
+// get fetch URL with size cap, only successful responses of expected media type are read.
+func (f *LinkFetcher) get(ctx context.Context, link string, mediaTypes ...string) ([]byte, *url.URL, error) {
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := checkScheme(u); err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("User-Agent", "ChitChat link preview")
+	req.Header.Set("Accept", strings.Join(mediaTypes, ", "))
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+
+	accepted := false
+	for _, t := range mediaTypes {
+		accepted = accepted || mediaType == t
+	}
+
+	if !accepted {
+		return nil, nil, errNotHTML
+	}
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxFetchSize))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Final URL after redirects, relative links are resolved against it
+	return body, res.Request.URL, nil
+}
+
+// Fetch page and build preview from its OpenGraph tags, oEmbed is used for missing ones.
+// Pages without title return nil preview.
+func (f *LinkFetcher) Fetch(ctx context.Context, link string) (*LinkPreview, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	body, base, err := f.get(ctx, link, "text/html", "application/xhtml+xml")
+	if err != nil {
+		return nil, err
+	}
+
+	preview, oembed := parsePreview(bytes.NewReader(body), base)
+	preview.URL = link
+
+	// Page metadata is still useful if oEmbed fails
+	if len(oembed) > 0 && (len(preview.Title) == 0 || len(preview.Image) == 0) {
+		f.fetchOEmbed(ctx, oembed, preview)
+	}
+
+	if len(preview.Title) == 0 {
+		return nil, nil
+	}
+
+	preview.Title = truncate(preview.Title, maxPreviewText)
+	preview.Description = truncate(preview.Description, maxPreviewText)
+
+	return preview, nil
+}
+
+// oEmbedResponse is a part of oEmbed response used in previews, see https://oembed.com.
+type oEmbedResponse struct {
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// fetchOEmbed fill missing preview fields from oEmbed endpoint.
+func (f *LinkFetcher) fetchOEmbed(ctx context.Context, link string, preview *LinkPreview) error {
+	body, _, err := f.get(ctx, link, "application/json", "text/json")
+	if err != nil {
+		return err
+	}
+
+	res := oEmbedResponse{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		return err
+	}
+
+	if len(preview.Title) == 0 {
+		preview.Title = res.Title
+	}
+
+	if len(preview.Description) == 0 {
+		preview.Description = res.AuthorName
+	}
+
+	if len(preview.SiteName) == 0 {
+		preview.SiteName = res.ProviderName
+	}
+
+	if len(preview.Image) == 0 {
+		preview.Image = resolveURL(nil, res.ThumbnailURL)
+	}
+
+	return nil
+}
+
+// parsePreview read OpenGraph tags, title and description from HTML head.
+// Returns oEmbed discovery link if page has one.
+func parsePreview(r io.Reader, base *url.URL) (*LinkPreview, string) {
+	preview := &LinkPreview{}
+
+	var title, description, oembed string
+
+	z := html.NewTokenizer(r)
+
+	for {
+		tt := z.Next()
+
+		switch tt {
+		case html.ErrorToken:
+			return finishPreview(preview, title, description), oembed
+		case html.StartTagToken, html.SelfClosingTagToken:
+			t := z.Token()
+
+			switch t.Data {
+			case "body":
+				// Metadata is only in the head
+				return finishPreview(preview, title, description), oembed
+			case "title":
+				if z.Next() == html.TextToken {
+					title = strings.TrimSpace(string(z.Text()))
+				}
+			case "meta":
+				attrs := tokenAttrs(t)
+				content := strings.TrimSpace(attrs["content"])
+
+				switch attrs["property"] {
+				case "og:title":
+					preview.Title = content
+				case "og:description":
+					preview.Description = content
+				case "og:image":
+					preview.Image = resolveURL(base, content)
+				case "og:site_name":
+					preview.SiteName = content
+				}
+
+				if strings.EqualFold(attrs["name"], "description") {
+					description = content
+				}
+			case "link":
+				attrs := tokenAttrs(t)
+
+				if attrs["rel"] == "alternate" && attrs["type"] == "application/json+oembed" {
+					oembed = resolveURL(base, attrs["href"])
+				}
+			}
+		}
+	}
+}
+
+// finishPreview fallback to page title and description.
+func finishPreview(preview *LinkPreview, title, description string) *LinkPreview {
+	if len(preview.Title) == 0 {
+		preview.Title = title
+	}
+
+	if len(preview.Description) == 0 {
+		preview.Description = description
+	}
+
+	return preview
+}
+
+// tokenAttrs collect tag attributes by name.
+func tokenAttrs(t html.Token) map[string]string {
+	attrs := make(map[string]string, len(t.Attr))
+
+	for _, attr := range t.Attr {
+		attrs[strings.ToLower(attr.Key)] = attr.Val
+	}
+
+	return attrs
+}
+
+// resolveURL make link absolute, only http and https links are kept.
+func resolveURL(base *url.URL, link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || len(link) == 0 {
+		return ""
+	}
+
+	if base != nil {
+		u = base.ResolveReference(u)
+	}
+
+	if checkScheme(u) != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+// truncate text to max bytes without breaking UTF-8 characters.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+
+	cut := 0
+	for i := range text {
+		if i > max-len("…") {
+			break
+		}
+
+		cut = i
+	}
+
+	return strings.TrimSpace(text[:cut]) + "…"
+}
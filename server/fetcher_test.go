@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fixture pages of local HTTP stand-in.
+var fetcherFixtures = map[string]string{
+	"/og": `<html><head>
+		<title>Page title</title>
+		<meta property="og:title" content="Winter is coming">
+		<meta property="og:description" content="House Stark words">
+		<meta property="og:image" content="/images/wolf.png">
+		<meta property="og:site_name" content="Westeros">
+		</head><body><meta property="og:title" content="Not in head"></body></html>`,
+	"/plain": `<html><head><title> Plain page </title><meta name="description" content="No OpenGraph here"></head></html>`,
+	"/oembed-page": `<html><head>
+		<link rel="alternate" type="application/json+oembed" href="/oembed.json">
+		</head></html>`,
+	"/untitled": `<html><head></head><body>Hello</body></html>`,
+	"/huge":     `<html><head>` + strings.Repeat(" ", maxFetchSize) + `<title>Too far</title></head></html>`,
+}
+
+func testFetcherServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oembed.json":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"title":"Video","author_name":"Jon Snow","provider_name":"Tube","thumbnail_url":"https://tube.example/thumb.jpg"}`)
+		case "/redirect":
+			http.Redirect(w, r, "/og", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		case "/image.png":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte{0x89, 'P', 'N', 'G'})
+		default:
+			page, ok := fetcherFixtures[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			fmt.Fprint(w, page)
+		}
+	}))
+}
+
+// testFetcher allow local server addresses.
+func testFetcher() *LinkFetcher {
+	f := NewLinkFetcher()
+	f.allowPrivate = true
+
+	return f
+}
+
+func TestLinkFetcherOpenGraph(t *testing.T) {
+	server := testFetcherServer()
+	defer server.Close()
+
+	preview, err := testFetcher().Fetch(context.Background(), server.URL+"/og")
+	assert.Nil(t, err)
+	assert.Equal(t, &LinkPreview{
+		URL:         server.URL + "/og",
+		Title:       "Winter is coming",
+		Description: "House Stark words",
+		Image:       server.URL + "/images/wolf.png",
+		SiteName:    "Westeros",
+	}, preview)
+
+	// Relative image is resolved against final URL
+	preview, err = testFetcher().Fetch(context.Background(), server.URL+"/redirect")
+	assert.Nil(t, err)
+	assert.Equal(t, server.URL+"/redirect", preview.URL)
+	assert.Equal(t, server.URL+"/images/wolf.png", preview.Image)
+}
+
+func TestLinkFetcherFallbacks(t *testing.T) {
+	server := testFetcherServer()
+	defer server.Close()
+
+	preview, err := testFetcher().Fetch(context.Background(), server.URL+"/plain")
+	assert.Nil(t, err)
+	assert.Equal(t, "Plain page", preview.Title)
+	assert.Equal(t, "No OpenGraph here", preview.Description)
+
+	preview, err = testFetcher().Fetch(context.Background(), server.URL+"/oembed-page")
+	assert.Nil(t, err)
+	assert.Equal(t, "Video", preview.Title)
+	assert.Equal(t, "Jon Snow", preview.Description)
+	assert.Equal(t, "Tube", preview.SiteName)
+	assert.Equal(t, "https://tube.example/thumb.jpg", preview.Image)
+
+	preview, err = testFetcher().Fetch(context.Background(), server.URL+"/untitled")
+	assert.Nil(t, err)
+	assert.Nil(t, preview)
+
+	// Only first maxFetchSize bytes are read
+	preview, err = testFetcher().Fetch(context.Background(), server.URL+"/huge")
+	assert.Nil(t, err)
+	assert.Nil(t, preview)
+}
+
+func TestLinkFetcherErrors(t *testing.T) {
+	server := testFetcherServer()
+	defer server.Close()
+
+	_, err := testFetcher().Fetch(context.Background(), server.URL+"/image.png")
+	assert.Equal(t, errNotHTML, err)
+
+	_, err = testFetcher().Fetch(context.Background(), server.URL+"/missing")
+	assert.NotNil(t, err)
+
+	_, err = testFetcher().Fetch(context.Background(), server.URL+"/loop")
+	assert.NotNil(t, err)
+
+	_, err = testFetcher().Fetch(context.Background(), "file:///etc/passwd")
+	assert.NotNil(t, err)
+}
+
+func TestLinkFetcherPrivateAddress(t *testing.T) {
+	server := testFetcherServer()
+	defer server.Close()
+
+	_, err := NewLinkFetcher().Fetch(context.Background(), server.URL+"/og")
+	assert.True(t, errors.Is(err, errForbiddenAddress))
+
+	// Hostnames are checked after resolving
+	_, err = NewLinkFetcher().Fetch(context.Background(), strings.Replace(server.URL, "127.0.0.1", "localhost", 1)+"/og")
+	assert.True(t, errors.Is(err, errForbiddenAddress))
+}
+
+func TestIsPublicIP(t *testing.T) {
+	for ip, public := range map[string]bool{
+		"8.8.8.8":         true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"::1":             false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+	} {
+		assert.Equal(t, public, isPublicIP(net.ParseIP(ip)), ip)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	assert.Equal(t, "short", truncate("short", 10))
+	assert.Equal(t, "привіт…", truncate("привіт світ", 16))
+	assert.LessOrEqual(t, len(truncate(strings.Repeat("ї", 200), maxPreviewText)), maxPreviewText)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/faustman/chitchat/server/chitchatpb"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// authContextKey is a context key for Auth of gRPC call.
+type authContextKey struct{}
+
+// grpcServer implements ChitChat gRPC API on top of the same stream and presence as channelHandler.
+type grpcServer struct {
+	chitchatpb.UnimplementedChitChatServer
+
+	store    *Storage
+	hub      *ConsumersHub
+	commands *CommandsRegistry
+	auth     *authHandler
+	logger   echo.Logger
+}
+
+// NewGRPCServer build gRPC server with ChitChat service and auth interceptors.
+func NewGRPCServer(store *Storage, hub *ConsumersHub, commands *CommandsRegistry, auth *authHandler, logger echo.Logger) *grpc.Server {
+	s := &grpcServer{
+		store:    store,
+		hub:      hub,
+		commands: commands,
+		auth:     auth,
+		logger:   logger,
+	}
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(s.unaryAuth),
+		grpc.StreamInterceptor(s.streamAuth),
+	)
+
+	chitchatpb.RegisterChitChatServer(server, s)
+
+	return server
+}
+
+// authenticate validate JWT token from "authorization: Bearer <token>" metadata.
+func (s *grpcServer) authenticate(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	auth, err := s.auth.ParseToken(strings.TrimPrefix(values[0], "Bearer "))
+	if err != nil {
+		// Masking all jwt errors from the clients
+		return nil, status.Error(codes.Unauthenticated, "Unauthorized")
+	}
+
+	return context.WithValue(ctx, authContextKey{}, auth), nil
+}
+
+func (s *grpcServer) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) streamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(ss.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authServerStream{ServerStream: ss, ctx: ctx})
+}
+
+// authServerStream override stream context with authenticated one.
+type authServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// extractGRPCAuth from authenticated call context.
+func extractGRPCAuth(ctx context.Context) *Auth {
+	return ctx.Value(authContextKey{}).(*Auth)
+}
+
+// checkBan respond with PermissionDenied for banned users.
+func (s *grpcServer) checkBan(auth *Auth) error {
+	banned, err := s.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return status.Error(codes.PermissionDenied, "You are banned in this channel")
+	}
+
+	return nil
+}
+
+// Chat join the channel and stream its events, same as WebSocket /channel.
+// Events go through the consumer send queue, so slow clients get the same overflow policy.
+func (s *grpcServer) Chat(stream chitchatpb.ChitChat_ChatServer) error {
+	auth := extractGRPCAuth(stream.Context())
+
+	if err := s.checkBan(auth); err != nil {
+		return err
+	}
+
+	conn := newGRPCTransport(stream)
+	consumer := NewConsumer(auth.Channel, auth.User, conn, s.hub, s.store, s.commands, s.logger)
+
+	consumer.Register()
+
+	done := make(chan bool)
+
+	go func() {
+		consumer.Listen()
+		close(done)
+	}()
+
+	// Client is gone or finished sending
+	select {
+	case <-done:
+	case <-conn.done:
+		consumer.Shutdown()
+		<-done
+	}
+
+	return conn.err()
+}
+
+// grpcTransport is a Chat stream Transport.
+// Client requests are read as outgoing messages, events are sent as ChatEvent with stream sequence.
+type grpcTransport struct {
+	stream chitchatpb.ChitChat_ChatServer
+
+	// Closed when reading fails, eg. client finished sending
+	done chan bool
+
+	mu sync.Mutex
+
+	// Read error and status the stream is closed with
+	readErr  error
+	closeErr error
+
+	// Stream sequence of the last written event
+	lastSeq uint64
+}
+
+func newGRPCTransport(stream chitchatpb.ChitChat_ChatServer) *grpcTransport {
+	return &grpcTransport{stream: stream, done: make(chan bool)}
+}
+
+// ReadMessage read the next text, JSON with client id if it's set, same as WebSocket clients send.
+func (t *grpcTransport) ReadMessage() ([]byte, error) {
+	for {
+		req, err := t.stream.Recv()
+		if err != nil {
+			t.mu.Lock()
+			t.readErr = err
+			t.mu.Unlock()
+
+			close(t.done)
+
+			return nil, err
+		}
+
+		if len(req.GetText()) == 0 {
+			continue
+		}
+
+		if len(req.GetClientId()) == 0 {
+			return []byte(req.GetText()), nil
+		}
+
+		return json.Marshal(chitchat.OutgoingMessage{Text: req.GetText(), ClientId: req.GetClientId()})
+	}
+}
+
+func (t *grpcTransport) WriteMessage(data []byte) error {
+	return t.WriteMessages([][]byte{data})
+}
+
+func (t *grpcTransport) WriteMessages(messages [][]byte) error {
+	return t.WriteEvents(messages, make([]uint64, len(messages)))
+}
+
+// WriteEvents send events one by one, gRPC stream has own buffering.
+func (t *grpcTransport) WriteEvents(messages [][]byte, seqs []uint64) error {
+	for i, data := range messages {
+		msg := ChannelMessage{}
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+
+		if err := t.stream.Send(&chitchatpb.ChatEvent{Id: seqs[i], Message: toProtoMessage(msg)}); err != nil {
+			return err
+		}
+
+		if seqs[i] > 0 {
+			t.mu.Lock()
+			t.lastSeq = seqs[i]
+			t.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
+// Ping only check that the call is alive, gRPC keep-alive does the rest.
+func (t *grpcTransport) Ping() error {
+	return t.stream.Context().Err()
+}
+
+// Close keep status for the Chat call by WebSocket close code, unless client is already gone.
+func (t *grpcTransport) Close(code int, reason string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.readErr != nil || t.closeErr != nil {
+		return nil
+	}
+
+	switch code {
+	case evictKicked.code:
+		t.closeErr = status.Error(codes.PermissionDenied, "You were kicked from the channel")
+	case evictSlow.code:
+		// Client could load messages after the last event from history
+		t.closeErr = status.Errorf(codes.ResourceExhausted, "Slow consumer, last event id %d", t.lastSeq)
+	case websocket.CloseNoStatusReceived:
+		t.closeErr = status.Error(codes.Unavailable, "Server is shutting down")
+	default:
+		t.closeErr = status.Error(codes.Unavailable, reason)
+	}
+
+	return nil
+}
+
+// err to finish the Chat call with, nil if client finished it.
+func (t *grpcTransport) err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closeErr != nil {
+		return t.closeErr
+	}
+
+	if t.readErr == io.EOF || status.Code(t.readErr) == codes.Canceled {
+		return nil
+	}
+
+	return t.readErr
+}
+
+// GetMessages return channel text messages, same as GET /messages.
+func (s *grpcServer) GetMessages(ctx context.Context, req *chitchatpb.GetMessagesRequest) (*chitchatpb.GetMessagesResponse, error) {
+	auth := extractGRPCAuth(ctx)
+
+	query := MessageQuery{}
+	if req.StartTime != nil {
+		query.Since = req.StartTime.AsTime()
+	}
+
+	query.Before = req.Before
+	query.Limit = int(req.Limit)
+
+	messages, err := s.store.Messages.Messages(auth.Channel, query)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chitchatpb.GetMessagesResponse{}
+	for _, msg := range messages {
+		res.Messages = append(res.Messages, toProtoMessage(msg))
+	}
+
+	return res, nil
+}
+
+// GetUsers return users from channel presence store, same as GET /users.
+func (s *grpcServer) GetUsers(ctx context.Context, req *chitchatpb.GetUsersRequest) (*chitchatpb.GetUsersResponse, error) {
+	auth := extractGRPCAuth(ctx)
+
+	users, err := s.store.Presence.Users(auth.Channel)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chitchatpb.GetUsersResponse{}
+	for i := range users {
+		res.Users = append(res.Users, toProtoUser(&users[i]))
+	}
+
+	return res, nil
+}
+
+// SendMessage publish text message to the channel, same as POST /messages.
+func (s *grpcServer) SendMessage(ctx context.Context, req *chitchatpb.SendMessageRequest) (*chitchatpb.SendMessageResponse, error) {
+	auth := extractGRPCAuth(ctx)
+
+	if len(req.Text) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Text can't be blank")
+	}
+
+	if err := s.hub.limits.Check(auth.Channel, req.Text); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	if err := s.checkBan(auth); err != nil {
+		return nil, err
+	}
+
+	// Retries with the same client id are stored once
+	msg, _, err := SendMessage(s.store, auth.Channel, auth.User, req.Text, req.ClientId)
+	if err != nil {
+		s.logger.Errorf("Publish error: %v", err)
+
+		return nil, status.Error(codes.Unavailable, ErrMessageNotSent.Error())
+	}
+
+	return &chitchatpb.SendMessageResponse{Message: toProtoMessage(msg)}, nil
+}
+
+// toProtoUser convert User to protobuf one.
+func toProtoUser(user *User) *chitchatpb.User {
+	if user == nil {
+		return nil
+	}
+
+	return &chitchatpb.User{
+		Id:     user.Id,
+		Name:   user.Name,
+		Avatar: user.Avatar,
+	}
+}
+
+// toProtoMessage convert ChannelMessage to protobuf one.
+func toProtoMessage(msg ChannelMessage) *chitchatpb.ChannelMessage {
+	return &chitchatpb.ChannelMessage{
+		Type:       msg.Type,
+		FromUser:   toProtoUser(msg.FromUser),
+		SentAt:     timestamppb.New(msg.SentAt),
+		Text:       msg.Text,
+		Target:     toProtoUser(msg.Target),
+		Attachment: toProtoAttachment(msg.Attachment),
+		Id:         msg.Id,
+		Previews:   toProtoPreviews(msg.Previews),
+		EditedAt:   toProtoTime(msg.EditedAt),
+		ClientId:   msg.ClientId,
+		Seq:        msg.Seq,
+	}
+}
+
+// toProtoTime convert optional time to protobuf timestamp.
+func toProtoTime(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+
+	return timestamppb.New(*t)
+}
+
+// toProtoPreviews convert LinkPreviews to protobuf ones.
+func toProtoPreviews(previews []LinkPreview) []*chitchatpb.LinkPreview {
+	var res []*chitchatpb.LinkPreview
+
+	for _, preview := range previews {
+		res = append(res, &chitchatpb.LinkPreview{
+			Url:         preview.URL,
+			Title:       preview.Title,
+			Description: preview.Description,
+			Image:       preview.Image,
+			SiteName:    preview.SiteName,
+		})
+	}
+
+	return res
+}
+
+// toProtoAttachment convert Attachment to protobuf one.
+func toProtoAttachment(attachment *Attachment) *chitchatpb.Attachment {
+	if attachment == nil {
+		return nil
+	}
+
+	res := &chitchatpb.Attachment{
+		Id:       attachment.Id,
+		Name:     attachment.Name,
+		Size:     attachment.Size,
+		MimeType: attachment.MimeType,
+		Width:    int32(attachment.Width),
+		Height:   int32(attachment.Height),
+		Url:      attachment.URL,
+		Blurhash: attachment.Blurhash,
+	}
+
+	for _, thumbnail := range attachment.Thumbnails {
+		res.Thumbnails = append(res.Thumbnails, &chitchatpb.Thumbnail{
+			Width:  int32(thumbnail.Width),
+			Height: int32(thumbnail.Height),
+			Url:    thumbnail.URL,
+		})
+	}
+
+	return res
+}
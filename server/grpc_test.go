@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/faustman/chitchat/server/chitchatpb"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testGRPCClient start gRPC server on top of the storage and connect to it as user in "general" channel.
+func testGRPCClient(t *testing.T, store *Storage, queueConfig SendQueueConfig, user *User) (chitchatpb.ChitChatClient, context.Context) {
+	auth := NewAuthHandler(jwtSecret)
+
+	hub := NewConsumersHub(queueConfig, DefaultMessageLimits)
+	go hub.run()
+
+	server := NewGRPCServer(store, hub, NewCommandsRegistry(auth, nil), auth, log.New("test"))
+
+	lis := bufconn.Listen(1 << 20)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	token, err := auth.NewToken(user, "general")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+
+	return chitchatpb.NewChitChatClient(conn), ctx
+}
+
+// testGRPCServer build server for unary calls.
+func testGRPCServer(store *Storage) *grpcServer {
+	return &grpcServer{store: store, hub: NewConsumersHub(DefaultSendQueueConfig, DefaultMessageLimits), logger: log.New("test")}
+}
+
+// testGRPCContext is a context of the call authenticated as user in "general" channel.
+func testGRPCContext(user *User) context.Context {
+	return context.WithValue(context.Background(), authContextKey{}, &Auth{User: user, Channel: "general"})
+}
+
+func TestGRPCAuthenticate(t *testing.T) {
+	h := NewAuthHandler(jwtSecret)
+	s := &grpcServer{auth: h}
+
+	token, err := h.NewToken(NewUser("Jon Snow", "jon@labstack.com"), "general")
+	assert.NoError(t, err)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+
+	ctx, err = s.authenticate(ctx)
+	if assert.NoError(t, err) {
+		auth := extractGRPCAuth(ctx)
+
+		assert.Equal(t, "Jon Snow", auth.User.Name)
+		assert.Equal(t, "general", auth.Channel)
+	}
+}
+
+func TestGRPCAuthenticateInvalidToken(t *testing.T) {
+	s := &grpcServer{auth: NewAuthHandler(jwtSecret)}
+
+	_, err := s.authenticate(context.Background())
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer invalid"))
+
+	_, err = s.authenticate(ctx)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestGRPCChat(t *testing.T) {
+	store := NewMemoryStorage()
+	user := NewUser("Jon Snow", "")
+
+	client, ctx := testGRPCClient(t, store, DefaultSendQueueConfig, user)
+
+	stream, err := client.Chat(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Message is sent to the channel and acknowledged
+	assert.NoError(t, stream.Send(&chitchatpb.ChatRequest{Text: "Winter is coming", ClientId: "1"}))
+
+	var sent, received *chitchatpb.ChatEvent
+
+	for sent == nil || received == nil {
+		event, err := stream.Recv()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		switch event.Message.Type {
+		case chitchat.TypeSent:
+			sent = event
+		case chitchat.TypeMessage:
+			received = event
+		}
+	}
+
+	assert.Equal(t, "1", sent.Message.ClientId)
+	assert.Equal(t, received.Id, sent.Message.Seq)
+	assert.Equal(t, received.Message.Id, sent.Message.Id)
+	assert.Equal(t, "Winter is coming", received.Message.Text)
+
+	// Slash commands are replied only to the user
+	assert.NoError(t, stream.Send(&chitchatpb.ChatRequest{Text: "/unknown"}))
+
+	event, err := stream.Recv()
+	if assert.NoError(t, err) {
+		assert.Equal(t, chitchat.TypeEphemeral, event.Message.Type)
+		assert.Zero(t, event.Id)
+	}
+
+	// Client finished sending
+	assert.NoError(t, stream.CloseSend())
+
+	for {
+		if _, err := stream.Recv(); err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+	}
+}
+
+func TestGRPCChatOverflow(t *testing.T) {
+	store := NewMemoryStorage()
+	user := NewUser("Jon Snow", "")
+
+	client, ctx := testGRPCClient(t, store, SendQueueConfig{Size: 4, Policy: OverflowResume}, user)
+
+	stream, err := client.Chat(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Subscription is ready once own message is received
+	assert.NoError(t, stream.Send(&chitchatpb.ChatRequest{Text: "ready", ClientId: "ready"}))
+
+	for {
+		event, err := stream.Recv()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if event.Message.Type == chitchat.TypeMessage {
+			break
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), fmt.Sprint(i)))
+	}
+
+	// Events dropped from the full queue are replayed
+	var texts []string
+
+	for len(texts) < 100 {
+		event, err := stream.Recv()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if event.Message.Type == chitchat.TypeMessage {
+			texts = append(texts, event.Message.Text)
+		}
+	}
+
+	assert.Equal(t, "0", texts[0])
+	assert.Equal(t, "99", texts[99])
+}
+
+func TestGRPCChatKick(t *testing.T) {
+	store := NewMemoryStorage()
+	user := NewUser("Jon Snow", "")
+
+	client, ctx := testGRPCClient(t, store, DefaultSendQueueConfig, user)
+
+	stream, err := client.Chat(ctx)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, stream.Send(&chitchatpb.ChatRequest{Text: "ready", ClientId: "ready"}))
+
+	for {
+		event, err := stream.Recv()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		if event.Message.Type == chitchat.TypeMessage {
+			break
+		}
+	}
+
+	store.Broker.Publish("general", EventPresence, NewChannelKickMessage(NewUser("Ned Stark", ""), time.Now(), user))
+
+	// Stream is closed after kick event
+	for {
+		if _, err := stream.Recv(); err != nil {
+			assert.Equal(t, codes.PermissionDenied, status.Code(err))
+			break
+		}
+	}
+}
+
+func TestGRPCGetMessages(t *testing.T) {
+	store := NewMemoryStorage()
+	s := testGRPCServer(store)
+	user := NewUser("Jon Snow", "")
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(1000, 0), "old"))
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(3000, 0), "new"))
+	store.Broker.Publish("lobby", EventMessage, NewChannelMessage(user, time.Unix(3000, 0), "other"))
+
+	res, err := s.GetMessages(testGRPCContext(user), &chitchatpb.GetMessagesRequest{})
+	if assert.NoError(t, err) && assert.Len(t, res.Messages, 2) {
+		assert.Equal(t, "old", res.Messages[0].Text)
+		assert.Equal(t, "Jon Snow", res.Messages[0].FromUser.Name)
+	}
+
+	res, err = s.GetMessages(testGRPCContext(user), &chitchatpb.GetMessagesRequest{StartTime: timestamppb.New(time.Unix(2000, 0))})
+	if assert.NoError(t, err) && assert.Len(t, res.Messages, 1) {
+		assert.Equal(t, "new", res.Messages[0].Text)
+	}
+}
+
+func TestGRPCSendMessage(t *testing.T) {
+	store := NewMemoryStorage()
+	s := testGRPCServer(store)
+	user := NewUser("Jon Snow", "")
+
+	res, err := s.SendMessage(testGRPCContext(user), &chitchatpb.SendMessageRequest{Text: "Winter is coming", ClientId: "1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "Winter is coming", res.Message.Text)
+		assert.NotEmpty(t, res.Message.Id)
+	}
+
+	// Retry is stored once
+	retry, err := s.SendMessage(testGRPCContext(user), &chitchatpb.SendMessageRequest{Text: "Winter is coming", ClientId: "1"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, res.Message.Id, retry.Message.Id)
+	}
+
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	assert.Len(t, messages, 1)
+
+	_, err = s.SendMessage(testGRPCContext(user), &chitchatpb.SendMessageRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// Banned users can't send messages
+	store.Bans.(*memoryStore).Ban("general", user.Id)
+
+	_, err = s.SendMessage(testGRPCContext(user), &chitchatpb.SendMessageRequest{Text: "Hello"})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// Not published message is reported
+	store.Broker = failingBroker{store.Broker}
+
+	_, err = testGRPCServer(store).SendMessage(testGRPCContext(NewUser("Arya Stark", "")), &chitchatpb.SendMessageRequest{Text: "Hello"})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Message size limits, in bytes.
+const (
+	// Default limit for message text, enough for a short stack trace.
+	defaultMessageLimit = 4096
+
+	// Maximum message size allowed from peer, no channel limit could be bigger.
+	// Bigger messages are discarded by transport and replied with error, same as ones over channel limit.
+	maxMessageSize = 64 * 1024
+
+	// Maximum frame size transport reads before dropping the connection, bigger pastes aren't worth reading.
+	maxFrameSize = 4 * 1024 * 1024
+)
+
+// ErrMessageTooBig is returned by Transport for discarded message bigger than maxMessageSize, connection stays open.
+var ErrMessageTooBig = fmt.Errorf("Message is too long, maximum is %d bytes", maxMessageSize)
+
+// readMessage read message up to maxMessageSize, bigger one is discarded with ErrMessageTooBig.
+func readMessage(r io.Reader) ([]byte, error) {
+	msg, err := io.ReadAll(io.LimitReader(r, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msg) > maxMessageSize {
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return nil, err
+		}
+
+		return nil, ErrMessageTooBig
+	}
+
+	return msg, nil
+}
+
+// MessageLimits limit message text size per deployment and per channel.
+type MessageLimits struct {
+	// Limit for all channels.
+	Default int
+
+	// Channel specific limits, eg. bigger one for #logs.
+	Channels map[string]int
+}
+
+// DefaultMessageLimits is applied to all channels.
+var DefaultMessageLimits = MessageLimits{Default: defaultMessageLimit}
+
+// ParseMessageLimits override default limit if it set and load channel limits from config string,
+// eg. "logs=65536,lobby=280".
+func ParseMessageLimits(limit, channels string) (MessageLimits, error) {
+	limits := MessageLimits{Default: DefaultMessageLimits.Default, Channels: make(map[string]int)}
+
+	if len(limit) > 0 {
+		size, err := parseMessageLimit(limit)
+		if err != nil {
+			return limits, err
+		}
+
+		limits.Default = size
+	}
+
+	for _, entry := range strings.Split(channels, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		channel, limit, ok := strings.Cut(entry, "=")
+		if !ok || len(channel) == 0 {
+			return limits, fmt.Errorf("invalid channel message limit config: %q", entry)
+		}
+
+		size, err := parseMessageLimit(limit)
+		if err != nil {
+			return limits, err
+		}
+
+		limits.Channels[channel] = size
+	}
+
+	return limits, nil
+}
+
+// parseMessageLimit parse limit in bytes, it can't exceed maxMessageSize.
+func parseMessageLimit(limit string) (int, error) {
+	size, err := strconv.Atoi(limit)
+	if err != nil || size < 1 || size > maxMessageSize {
+		return 0, fmt.Errorf("invalid message limit %q, should be between 1 and %d", limit, maxMessageSize)
+	}
+
+	return size, nil
+}
+
+// For return message limit of the channel.
+func (l MessageLimits) For(channel string) int {
+	if size, ok := l.Channels[channel]; ok {
+		return size
+	}
+
+	if l.Default > 0 {
+		return l.Default
+	}
+
+	return defaultMessageLimit
+}
+
+// Check return error if text is too long for the channel.
+func (l MessageLimits) Check(channel, text string) error {
+	if limit := l.For(channel); len(text) > limit {
+		return fmt.Errorf("Message is too long, maximum is %d bytes", limit)
+	}
+
+	return nil
+}
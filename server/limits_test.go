@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessageLimits(t *testing.T) {
+	limits, err := ParseMessageLimits("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultMessageLimit, limits.For("general"))
+
+	limits, err = ParseMessageLimits("1024", " logs=65536, lobby=280 ")
+	assert.Nil(t, err)
+	assert.Equal(t, 1024, limits.For("general"))
+	assert.Equal(t, 65536, limits.For("logs"))
+	assert.Equal(t, 280, limits.For("lobby"))
+
+	_, err = ParseMessageLimits("0", "")
+	assert.NotNil(t, err)
+
+	_, err = ParseMessageLimits("", "logs=1000000")
+	assert.NotNil(t, err)
+
+	_, err = ParseMessageLimits("", "logs")
+	assert.NotNil(t, err)
+}
+
+func TestMessageLimitsCheck(t *testing.T) {
+	limits := MessageLimits{Default: 5, Channels: map[string]int{"logs": 10}}
+
+	assert.Nil(t, limits.Check("general", "hello"))
+	assert.EqualError(t, limits.Check("general", "hello!"), "Message is too long, maximum is 5 bytes")
+	assert.Nil(t, limits.Check("logs", "hello, log"))
+}
+
+func TestConsumerReplyError(t *testing.T) {
+	c := testConsumer(OverflowDrop)
+
+	c.ReplyError("Message is too long, maximum is 5 bytes")
+
+	out := <-c.queue
+	assert.Contains(t, string(out.data), `"type":"error"`)
+	assert.Contains(t, string(out.data), "maximum is 5 bytes")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Default configuration for long-polling.
+const (
+	// Default time to wait for new events.
+	pollTimeout = 25 * time.Second
+
+	// Maximum time to wait for new events, client could ask for less.
+	maxPollTimeout = 60 * time.Second
+
+	// Session is closed if client doesn't poll during this period.
+	// User stays in the channel between polls until session is closed.
+	pollSessionTimeout = maxPollTimeout + 15*time.Second
+
+	// Pending events buffer per session.
+	pollBuffer = 1024
+
+	// Maximum events returned by one poll.
+	maxPollEvents = 100
+)
+
+// PollEvent is a channel event with stream sequence id.
+type PollEvent struct {
+	Id   uint64          `json:"id"`
+	Data json.RawMessage `json:"data"`
+}
+
+// pollSession keeps subscription between polls, so events aren't lost and user stays present.
+type pollSession struct {
+	id      string
+	channel string
+	user    *User
+
+	presence *PresenceConn
+
+	broker Broker
+	sub    Subscription
+	events chan Event
+
+	// Set when events buffer was full and events were dropped
+	overflow *atomic.Bool
+
+	// Sequence of the first received event and of the last returned one,
+	// session is subscribed again when client is behind or after overflow.
+	first atomic.Uint64
+	last  uint64
+
+	// Closed when session is closed
+	closed chan bool
+
+	// Only one poll at a time, guards subscription
+	mu sync.Mutex
+
+	// Last poll time, guarded by LongPollHub.mu
+	lastPoll time.Time
+}
+
+// LongPollHub keeps long-polling sessions and closes inactive ones.
+type LongPollHub struct {
+	store *Storage
+
+	mu       sync.Mutex
+	sessions map[string]*pollSession
+
+	done chan bool
+}
+
+// NewLongPollHub create new hub.
+func NewLongPollHub(store *Storage) *LongPollHub {
+	return &LongPollHub{
+		store:    store,
+		sessions: make(map[string]*pollSession),
+		done:     make(chan bool),
+	}
+}
+
+// run close sessions without polls.
+func (h *LongPollHub) run() {
+	ticker := time.NewTicker(pollSessionTimeout / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-ticker.C:
+			var expired []*pollSession
+
+			h.mu.Lock()
+			for id, s := range h.sessions {
+				if time.Since(s.lastPoll) > pollSessionTimeout {
+					delete(h.sessions, id)
+					expired = append(expired, s)
+				}
+			}
+			h.mu.Unlock()
+
+			for _, s := range expired {
+				h.leave(s)
+			}
+		}
+	}
+}
+
+// Shutdown close all sessions.
+func (h *LongPollHub) Shutdown() {
+	close(h.done)
+
+	h.mu.Lock()
+	sessions := h.sessions
+	h.sessions = make(map[string]*pollSession)
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		h.leave(s)
+	}
+}
+
+// open new session, joining user to the channel.
+// Events are delivered starting after the sequence, or only new ones if it's zero.
+func (h *LongPollHub) open(channel string, user *User, after uint64) (*pollSession, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	s := &pollSession{
+		id:       hex.EncodeToString(id),
+		channel:  channel,
+		user:     user,
+		presence: Join(h.store, channel, user),
+		broker:   h.store.Broker,
+		closed:   make(chan bool),
+		lastPoll: time.Now(),
+	}
+
+	var startSeq uint64
+	if after > 0 {
+		startSeq = after + 1
+	}
+
+	if err := s.subscribe(startSeq); err != nil {
+		s.presence.Leave()
+		return nil, err
+	}
+
+	h.mu.Lock()
+	h.sessions[s.id] = s
+	h.mu.Unlock()
+
+	return s, nil
+}
+
+// get session by id and mark it as active.
+func (h *LongPollHub) get(id string) *pollSession {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sessions[id]
+	if ok {
+		s.lastPoll = time.Now()
+	}
+
+	return s
+}
+
+// close session, eg. when user was kicked.
+func (h *LongPollHub) close(s *pollSession) {
+	h.mu.Lock()
+	_, ok := h.sessions[s.id]
+	delete(h.sessions, s.id)
+	h.mu.Unlock()
+
+	if ok {
+		h.leave(s)
+	}
+}
+
+// leave unsubscribe session and leave user from the channel.
+func (h *LongPollHub) leave(s *pollSession) {
+	close(s.closed)
+
+	// Waits for current poll, it returns on closed session
+	s.mu.Lock()
+	s.sub.Unsubscribe()
+	s.mu.Unlock()
+
+	s.presence.Leave()
+}
+
+// subscribe session to events starting at the sequence, or only to new ones if it's zero.
+func (s *pollSession) subscribe(startSeq uint64) error {
+	events := make(chan Event, pollBuffer)
+	overflow := &atomic.Bool{}
+
+	sub, err := s.broker.Subscribe(s.channel, SubscribeOptions{StartSeq: startSeq}, func(e Event) {
+		s.first.CompareAndSwap(0, e.Seq)
+
+		select {
+		case events <- e:
+		default:
+			overflow.Store(true)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	s.sub, s.events, s.overflow = sub, events, overflow
+
+	return nil
+}
+
+// resubscribe session after the sequence seen by client, when returned events were lost or dropped on overflow.
+func (s *pollSession) resubscribe(after uint64) error {
+	if after >= s.last && !s.overflow.Load() {
+		return nil
+	}
+
+	// Client hasn't seen any event yet, start from the first one
+	startSeq := after + 1
+	if after == 0 {
+		startSeq = s.first.Load()
+	}
+
+	s.sub.Unsubscribe()
+
+	return s.subscribe(startSeq)
+}
+
+// poll wait for events after sequence until timeout or context is done.
+// Returns events available right after the first one, up to maxPollEvents.
+func (s *pollSession) poll(ctx context.Context, after uint64, timeout time.Duration) (events []PollEvent, kicked bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events = []PollEvent{}
+
+	select {
+	case <-s.closed:
+		return events, false, nil
+	default:
+	}
+
+	if err := s.resubscribe(after); err != nil {
+		return nil, false, err
+	}
+
+	defer func() {
+		if len(events) > 0 {
+			s.last = events[len(events)-1].Id
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for len(events) < maxPollEvents {
+		var e Event
+
+		if len(events) == 0 {
+			select {
+			case e = <-s.events:
+			case <-timer.C:
+				return events, false, nil
+			case <-ctx.Done():
+				return events, false, nil
+			case <-s.closed:
+				return events, false, nil
+			}
+		} else {
+			select {
+			case e = <-s.events:
+			default:
+				return events, false, nil
+			}
+		}
+
+		if e.Seq <= after {
+			// Already seen by client
+			continue
+		}
+
+		events = append(events, PollEvent{Id: e.Seq, Data: e.Data})
+
+		if isKick(e, s.user) {
+			return events, true, nil
+		}
+	}
+
+	return events, false, nil
+}
+
+// Poll long-polling fallback for clients without WebSocket and SSE.
+// First poll opens a session, next polls should pass it with last seen event id:
+//
+//	GET /channel/poll?token=<token>&after=<last id>&session=<session>&timeout=25
+//
+// Responds with {"session": "...", "last_id": 42, "events": [{"id": 42, "data": {...}}]}
+// as soon as there are new events, or with empty events on timeout.
+// User stays in the channel while client keeps polling.
+func (h channelHandler) Poll(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	var after uint64
+	if a := c.QueryParam("after"); len(a) > 0 {
+		var err error
+		if after, err = strconv.ParseUint(a, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "After is not valid")
+		}
+	}
+
+	timeout := pollTimeout
+	if t := c.QueryParam("timeout"); len(t) > 0 {
+		seconds, err := strconv.Atoi(t)
+		if err != nil || seconds < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Timeout is not valid")
+		}
+
+		timeout = time.Duration(seconds) * time.Second
+		if timeout > maxPollTimeout {
+			timeout = maxPollTimeout
+		}
+	}
+
+	session := h.polls.get(c.QueryParam("session"))
+
+	// Session could be closed or opened on another server, start new one from the last seen event
+	if session == nil || session.user.Id != auth.User.Id || session.channel != auth.Channel {
+		banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+		if err != nil {
+			return err
+		}
+
+		if banned {
+			return echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+		}
+
+		if session, err = h.polls.open(auth.Channel, auth.User, after); err != nil {
+			return err
+		}
+	}
+
+	events, kicked, err := session.poll(c.Request().Context(), after, timeout)
+	if err != nil {
+		return err
+	}
+
+	if kicked {
+		h.polls.close(session)
+	}
+
+	lastID := after
+	if len(events) > 0 {
+		lastID = events[len(events)-1].Id
+	}
+
+	return c.JSON(http.StatusOK, echo.Map{
+		"session": session.id,
+		"last_id": lastID,
+		"events":  events,
+	})
+}
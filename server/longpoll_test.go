@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPollResponse is a response of Poll.
+type testPollResponse struct {
+	Session string      `json:"session"`
+	LastID  uint64      `json:"last_id"`
+	Events  []PollEvent `json:"events"`
+}
+
+// testPoll poll channel as user with after and session, waiting up to timeout seconds.
+func testPoll(t *testing.T, h *channelHandler, user *User, session string, after uint64, timeout int) testPollResponse {
+	path := fmt.Sprintf("/channel/poll?session=%s&after=%d&timeout=%d", session, after, timeout)
+	c, rec := testContext(httptest.NewRequest(http.MethodGet, path, nil), user)
+
+	res := testPollResponse{}
+
+	if assert.NoError(t, h.Poll(c)) {
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+	}
+
+	return res
+}
+
+func TestPoll(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+
+	// First poll opens session and joins user to the channel
+	first := testPoll(t, h, user, "", 0, 0)
+	assert.NotEmpty(t, first.Session)
+	assert.Empty(t, first.Events)
+
+	users, err := store.Presence.Users("general")
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "hello"))
+
+	res := testPoll(t, h, user, first.Session, first.LastID, 1)
+	assert.Equal(t, first.Session, res.Session)
+
+	if assert.Len(t, res.Events, 1) {
+		msg := ChannelMessage{}
+		assert.NoError(t, json.Unmarshal(res.Events[0].Data, &msg))
+		assert.Equal(t, "hello", msg.Text)
+		assert.Equal(t, res.Events[0].Id, res.LastID)
+	}
+}
+
+func TestPollAfter(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+
+	var acks []PublishAck
+
+	for _, text := range []string{"first", "second", "third"} {
+		ack, err := store.Broker.PublishAck("general", EventMessage, NewChannelMessage(user, time.Now(), text), PublishOptions{})
+		assert.NoError(t, err)
+
+		acks = append(acks, ack)
+	}
+
+	// New session starts after the last seen event, eg. when the old one is closed
+	res := testPoll(t, h, user, "", acks[0].Seq, 1)
+
+	var texts []string
+
+	for _, e := range res.Events {
+		msg := ChannelMessage{}
+		assert.NoError(t, json.Unmarshal(e.Data, &msg))
+
+		// Join of the new session is delivered too
+		if msg.Type == chitchat.TypeMessage {
+			texts = append(texts, msg.Text)
+		}
+	}
+
+	assert.Equal(t, []string{"second", "third"}, texts)
+	assert.Greater(t, res.LastID, acks[2].Seq)
+}
+
+func TestPollTimeout(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+
+	first := testPoll(t, h, user, "", 0, 0)
+
+	start := time.Now()
+	res := testPoll(t, h, user, first.Session, first.LastID, 1)
+
+	assert.Empty(t, res.Events)
+	assert.Equal(t, first.LastID, res.LastID)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestPollKick(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+	moderator := NewUser("Ned Stark", "")
+
+	first := testPoll(t, h, user, "", 0, 0)
+
+	store.Broker.Publish("general", EventPresence, NewChannelKickMessage(moderator, time.Now(), user))
+
+	// Kick is delivered and session is closed
+	res := testPoll(t, h, user, first.Session, first.LastID, 1)
+	if assert.Len(t, res.Events, 1) {
+		msg := ChannelMessage{}
+		assert.NoError(t, json.Unmarshal(res.Events[0].Data, &msg))
+		assert.Equal(t, chitchat.TypeKick, msg.Type)
+	}
+
+	assert.Nil(t, h.polls.get(first.Session))
+
+	users, err := store.Presence.Users("general")
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+}
+
+func TestPollBanned(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+	store.Bans.(*memoryStore).Ban("general", user.Id)
+
+	c, _ := testContext(httptest.NewRequest(http.MethodGet, "/channel/poll", nil), user)
+
+	err := h.Poll(c)
+	if assert.IsType(t, &echo.HTTPError{}, err) {
+		assert.Equal(t, http.StatusForbidden, err.(*echo.HTTPError).Code)
+	}
+}
+
+func TestPollLostResponse(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+
+	first := testPoll(t, h, user, "", 0, 0)
+
+	store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "hello"))
+
+	res := testPoll(t, h, user, first.Session, 0, 1)
+	assert.NotEmpty(t, res.Events)
+
+	// Response was lost, client polls again after the same id and gets the same events
+	retry := testPoll(t, h, user, first.Session, 0, 1)
+	assert.Equal(t, res.Events, retry.Events)
+	assert.Equal(t, res.LastID, retry.LastID)
+}
+
+func TestPollOverflow(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	defer h.polls.Shutdown()
+
+	user := NewUser("Jon Snow", "")
+
+	res := testPoll(t, h, user, "", 0, 0)
+	session, after := res.Session, res.LastID
+
+	for i := 0; i < pollBuffer+10; i++ {
+		store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), fmt.Sprint(i)))
+	}
+
+	// Events dropped on full buffer are delivered after the last seen one
+	var texts []string
+
+	for len(texts) < pollBuffer+10 {
+		res := testPoll(t, h, user, session, after, 1)
+		if !assert.NotEmpty(t, res.Events) {
+			break
+		}
+
+		for _, e := range res.Events {
+			msg := ChannelMessage{}
+			assert.NoError(t, json.Unmarshal(e.Data, &msg))
+
+			if msg.Type == chitchat.TypeMessage {
+				texts = append(texts, msg.Text)
+			}
+		}
+
+		after = res.LastID
+	}
+
+	if assert.Len(t, texts, pollBuffer+10) {
+		assert.Equal(t, "0", texts[0])
+		assert.Equal(t, fmt.Sprint(pollBuffer+9), texts[pollBuffer+9])
+	}
+}
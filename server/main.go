@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
+	"expvar"
+	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/quic-go/webtransport-go"
 )
 
 func main() {
@@ -30,22 +37,210 @@ func main() {
 	// Get auth and validate JWT Token
 	e.GET("/auth", authHandler.Get, authHandler.Require)
 
-	e.Logger.Info("Connecting to NATS..")
+	// Storage backend, eg. STORAGE=redis REDIS_URL=redis://localhost:6379/0, NATS JetStream by default.
+	// Without NATS_URL NATS server is embedded, eg. STORAGE=embedded DATA_DIR=./data to keep history between restarts.
+	// Background workers and "nats" attachments store are only available with NATS.
+	var stream *JetStream
+	var store *Storage
+	var embedded *embeddedNATS
 
-	stream, err := NewStream()
+	// JetStream topology, eg. STREAM_TOPOLOGY=channel CHANNEL_STREAM_MAX_AGE=720h CHANNEL_STREAM_MAX_BYTES=1073741824 CHANNEL_STREAM_REPLICAS=3.
+	// MAX_CHANNELS=1000 limits channels with streams and presence buckets.
+	streamConfig, err := ParseStreamConfig(os.Getenv("STREAM_TOPOLOGY"), os.Getenv("CHANNEL_STREAM_MAX_AGE"),
+		os.Getenv("CHANNEL_STREAM_MAX_BYTES"), os.Getenv("CHANNEL_STREAM_REPLICAS"), os.Getenv("MAX_CHANNELS"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Replicas and storage of JetStream streams and buckets, eg. JETSTREAM_REPLICAS=3 JETSTREAM_STORAGE=memory.
+	// Existing ones are updated on start, drift which can't be fixed stops the server.
+	jetStreamConfig, err := ParseJetStreamConfig(os.Getenv("JETSTREAM_REPLICAS"), os.Getenv("JETSTREAM_STORAGE"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	backend := os.Getenv("STORAGE")
+	if len(backend) == 0 {
+		backend = "nats"
+
+		if len(os.Getenv("NATS_URL")) == 0 {
+			backend = "embedded"
+		}
+	}
+
+	// NATS server URL, external or embedded one
+	var natsURL string
+	var nc *nats.Conn
+
+	switch backend {
+	case "nats":
+		e.Logger.Info("Connecting to NATS..")
+
+		natsURL = nats.DefaultURL
+		if url := os.Getenv("NATS_URL"); len(url) > 0 {
+			natsURL = url
+		}
+	case "embedded":
+		if embedded, err = NewEmbeddedNATS(os.Getenv("DATA_DIR")); err != nil {
+			break
+		}
+
+		e.Logger.Infof("Embedded NATS server started on %s", embedded.URL())
+
+		natsURL = embedded.URL()
+	case "redis":
+		e.Logger.Info("Connecting to Redis..")
+
+		store, err = NewRedisStorage(os.Getenv("REDIS_URL"))
+	case "memory":
+		store = NewMemoryStorage()
+	default:
+		err = fmt.Errorf("unsupported storage %q", backend)
+	}
+
+	if err == nil && len(natsURL) > 0 {
+		if nc, err = nats.Connect(natsURL); err == nil {
+			if stream, err = NewStream(nc, streamConfig, jetStreamConfig, e.Logger); err == nil {
+				store = NewJetStreamStorage(stream)
+			}
+		}
+	}
+
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Channel history in SQL database, eg. MESSAGE_STORE="sqlite:///var/lib/chitchat/chitchat.db" or "postgres://chitchat@postgres/chitchat",
+	// events are still delivered by storage backend.
+	if storeURL := os.Getenv("MESSAGE_STORE"); len(storeURL) > 0 {
+		messages, err := NewSQLMessageStore(storeURL)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		store.WithMessageRecorder(messages)
+	}
+
+	// Consumers send queue, eg. SEND_QUEUE_SIZE=256 SEND_QUEUE_POLICY=drop|disconnect|resume
+	queueConfig, err := ParseSendQueueConfig(os.Getenv("SEND_QUEUE_SIZE"), os.Getenv("SEND_QUEUE_POLICY"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Message size limits, eg. MAX_MESSAGE_SIZE=4096 CHANNEL_MESSAGE_SIZES="logs=65536,lobby=280"
+	limits, err := ParseMessageLimits(os.Getenv("MAX_MESSAGE_SIZE"), os.Getenv("CHANNEL_MESSAGE_SIZES"))
 	if err != nil {
 		e.Logger.Fatal(err)
 	}
 
 	// Run consumer hub
-	consumersHub := NewConsumersHub()
+	consumersHub := NewConsumersHub(queueConfig, limits)
 	go consumersHub.run()
 
-	channelHandler := NewChannelHandler(stream, consumersHub)
+	// Slash commands with custom ones from config, eg. COMMANDS="deploy=bot,weather=http://weather/hook"
+	commands := NewCommandsRegistry(authHandler, strings.Split(os.Getenv("MODERATORS"), ","))
+	if err := commands.LoadCommands(os.Getenv("COMMANDS")); err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Run long-polling sessions hub
+	pollsHub := NewLongPollHub(store)
+	go pollsHub.run()
+
+	// WebSocket compression, eg. WS_COMPRESSION_LEVEL=1 WS_COMPRESSION_THRESHOLD=256, level 0 disables it
+	wsConfig, err := ParseWSConfig(os.Getenv("WS_COMPRESSION_LEVEL"), os.Getenv("WS_COMPRESSION_THRESHOLD"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	channelHandler := NewChannelHandler(store, consumersHub, commands, pollsHub, wsConfig)
 	e.GET("/channel", channelHandler.Listen, authHandler.Require)
+	e.GET("/channel/events", channelHandler.Events, authHandler.Require)
+	e.GET("/channel/poll", channelHandler.Poll, authHandler.Require)
 	e.GET("/messages", channelHandler.GetMessages, authHandler.Require)
+	e.POST("/messages", channelHandler.PostMessage, authHandler.Require)
+	e.PATCH("/messages/:id", channelHandler.EditMessage, authHandler.Require)
+	e.DELETE("/messages/:id", channelHandler.DeleteMessage, authHandler.Require)
 	e.GET("/users", channelHandler.GetUsers, authHandler.Require)
 
+	// Attachments storage, eg. ATTACHMENT_STORE="nats" (default), "file:///var/lib/chitchat" or "s3://key:secret@minio:9000/chitchat?secure=false"
+	blobs, err := NewBlobStore(stream, os.Getenv("ATTACHMENT_STORE"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Attachments limits, eg. ATTACHMENT_MAX_SIZE=10485760 ATTACHMENT_TYPES="image/*,application/pdf"
+	attachmentConfig, err := ParseAttachmentConfig(os.Getenv("ATTACHMENT_MAX_SIZE"), os.Getenv("ATTACHMENT_TYPES"))
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+
+	// Run thumbnails worker, jobs are shared with other server instances
+	var thumbnailWorker *ThumbnailWorker
+	if stream != nil {
+		thumbnailWorker, err = NewThumbnailWorker(stream, store, blobs, e.Logger)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		go thumbnailWorker.run()
+	}
+
+	attachmentHandler := NewAttachmentHandler(store, blobs, attachmentConfig, limits, thumbnailWorker)
+	e.POST("/attachments", attachmentHandler.Upload, authHandler.Require)
+	e.GET("/attachments/:id", attachmentHandler.Download, authHandler.Require)
+	e.GET("/attachments/:id/thumbnails/:size", attachmentHandler.DownloadThumbnail, authHandler.Require)
+
+	// Run link previews worker, disabled with LINK_PREVIEWS=false
+	var unfurlWorker *UnfurlWorker
+	if os.Getenv("LINK_PREVIEWS") != "false" && stream != nil {
+		unfurlWorker, err = NewUnfurlWorker(stream, store, NewLinkFetcher(), e.Logger)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+		go unfurlWorker.run()
+	}
+
+	// Run retention worker purging channels of the shared stream, eg. RETENTION_INTERVAL=1h, 10m by default.
+	// Channel streams have retention policies applied as stream limits.
+	var retentionWorker *RetentionWorker
+	if stream != nil && streamConfig.Topology == TopologyShared {
+		interval := 10 * time.Minute
+		if env := os.Getenv("RETENTION_INTERVAL"); len(env) > 0 {
+			if interval, err = time.ParseDuration(env); err != nil || interval <= 0 {
+				e.Logger.Fatalf("invalid retention interval %q", env)
+			}
+		}
+
+		retentionWorker = NewRetentionWorker(stream, interval, e.Logger)
+		go retentionWorker.run()
+	}
+
+	// gRPC API on separate port, eg. GRPC_ADDR=":4001"
+	grpcAddr := os.Getenv("GRPC_ADDR")
+	if len(grpcAddr) == 0 {
+		grpcAddr = ":4001"
+	}
+
+	grpcServer := NewGRPCServer(store, consumersHub, commands, authHandler, e.Logger)
+
+	// Experimental WebTransport over HTTP/3, eg. WEBTRANSPORT_ADDR=":4443"
+	var wtServer *webtransport.Server
+
+	if wtAddr := os.Getenv("WEBTRANSPORT_ADDR"); len(wtAddr) > 0 {
+		wtServer, err = NewWebTransportServer(wtAddr, os.Getenv("WEBTRANSPORT_CERT"), os.Getenv("WEBTRANSPORT_KEY"), channelHandler, authHandler, e.Logger)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		go func() {
+			e.Logger.Infof("WebTransport server started on %s", wtAddr)
+
+			if err := wtServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				e.Logger.Fatal("shutting down the WebTransport server")
+			}
+		}()
+	}
+
 	e.GET("/", func(c echo.Context) error {
 		return c.JSON(http.StatusOK, echo.Map{
 			"message": "Welcome to ChitChat!",
@@ -61,18 +256,74 @@ func main() {
 		}
 	}()
 
+	// Metrics, eg. send queues, on private admin port only, eg. ADMIN_ADDR="127.0.0.1:4002"
+	var adminServer *http.Server
+
+	if adminAddr := os.Getenv("ADMIN_ADDR"); len(adminAddr) > 0 {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+
+		adminServer = &http.Server{Addr: adminAddr, Handler: mux}
+
+		go func() {
+			e.Logger.Infof("Admin server started on %s", adminAddr)
+
+			if err := adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				e.Logger.Fatal("shutting down the admin server")
+			}
+		}()
+	}
+
+	go func() {
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+
+		e.Logger.Infof("gRPC server started on %s", grpcAddr)
+
+		if err := grpcServer.Serve(lis); err != nil {
+			e.Logger.Fatal("shutting down the gRPC server")
+		}
+	}()
+
 	// Wait for interrupt signal to gracefully shutdown the server with a timeout of 10 seconds.
 	// Use a buffered channel to avoid missing signals as recommended for signal.Notify
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 	<-quit
 
 	e.Logger.Info("Shutdown..")
 	consumersHub.Shutdown()
+	pollsHub.Shutdown()
+	if thumbnailWorker != nil {
+		thumbnailWorker.Shutdown()
+	}
+
+	if unfurlWorker != nil {
+		unfurlWorker.Shutdown()
+	}
+
+	if retentionWorker != nil {
+		retentionWorker.Shutdown()
+	}
+	grpcServer.GracefulStop()
+
+	if wtServer != nil {
+		wtServer.Close()
+	}
+
+	if adminServer != nil {
+		adminServer.Close()
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
+
+	if embedded != nil {
+		embedded.Shutdown()
+	}
 }
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+)
+
+// memoryStore keep channels, presence and bans in process memory.
+// Nothing is shared between servers and history is lost on restart, so it's for tests and local development.
+type memoryStore struct {
+	mu sync.Mutex
+
+	// Last sequence, shared by all channels like in one stream
+	seq uint64
+
+	// Channel events and subscriptions
+	events map[string][]Event
+	subs   map[string]map[*memorySubscription]bool
+
+	// Present users and their connections by channel
+	users map[string]map[string]*memoryPresence
+
+	// Banned users by BanKey
+	bans map[string]bool
+
+	// Published events by dedup key, within dedupWindow
+	dedup map[string]memoryDedup
+}
+
+type memoryDedup struct {
+	seq uint64
+	at  time.Time
+}
+
+type memoryPresence struct {
+	user  User
+	conns map[string]bool
+}
+
+type memorySubscription struct {
+	store   *memoryStore
+	channel string
+	handler func(Event)
+}
+
+// NewMemoryStorage build Storage with all backends in memory.
+func NewMemoryStorage() *Storage {
+	s := &memoryStore{
+		events: make(map[string][]Event),
+		subs:   make(map[string]map[*memorySubscription]bool),
+		users:  make(map[string]map[string]*memoryPresence),
+		bans:   make(map[string]bool),
+		dedup:  make(map[string]memoryDedup),
+	}
+
+	return &Storage{
+		Messages: s,
+		Broker:   s,
+		Presence: s,
+		Bans:     s,
+	}
+}
+
+func (s *memoryStore) Publish(channel, kind string, msg ChannelMessage) error {
+	_, err := s.PublishAck(channel, kind, msg, PublishOptions{})
+
+	return err
+}
+
+// PublishAck store event and deliver it to subscribers.
+// Lock is held during delivery, so subscribers get events in order.
+func (s *memoryStore) PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return PublishAck{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(opts.DedupKey) > 0 {
+		s.expireDedup()
+
+		if d, ok := s.dedup[opts.DedupKey]; ok {
+			return PublishAck{Seq: d.seq, Duplicate: true}, nil
+		}
+	}
+
+	s.seq++
+	e := Event{Seq: s.seq, Kind: kind, Data: data}
+
+	s.events[channel] = append(s.events[channel], e)
+
+	if len(opts.DedupKey) > 0 {
+		s.dedup[opts.DedupKey] = memoryDedup{seq: e.Seq, at: time.Now()}
+	}
+
+	for sub := range s.subs[channel] {
+		sub.handler(e)
+	}
+
+	return PublishAck{Seq: e.Seq}, nil
+}
+
+// expireDedup forget dedup keys out of the window.
+func (s *memoryStore) expireDedup() {
+	for key, d := range s.dedup {
+		if time.Since(d.at) > dedupWindow {
+			delete(s.dedup, key)
+		}
+	}
+}
+
+// Subscribe replay stored events starting from the sequence, then deliver new ones.
+func (s *memoryStore) Subscribe(channel string, opts SubscribeOptions, handler func(Event)) (Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if opts.StartSeq > 0 {
+		for _, e := range s.events[channel] {
+			if e.Seq >= opts.StartSeq {
+				handler(e)
+			}
+		}
+	}
+
+	sub := &memorySubscription{store: s, channel: channel, handler: handler}
+
+	if s.subs[channel] == nil {
+		s.subs[channel] = make(map[*memorySubscription]bool)
+	}
+
+	s.subs[channel][sub] = true
+
+	return sub, nil
+}
+
+func (sub *memorySubscription) Unsubscribe() error {
+	sub.store.mu.Lock()
+	defer sub.store.mu.Unlock()
+
+	delete(sub.store.subs[sub.channel], sub)
+
+	return nil
+}
+
+func (s *memoryStore) Messages(channel string, query MessageQuery) ([]ChannelMessage, error) {
+	s.mu.Lock()
+	events := s.events[channel]
+	s.mu.Unlock()
+
+	history := newMessageHistory()
+
+	for _, e := range events {
+		if e.Kind != EventMessage {
+			continue
+		}
+
+		msg := ChannelMessage{}
+		if err := json.Unmarshal(e.Data, &msg); err != nil {
+			return nil, err
+		}
+
+		if msg.SentAt.Before(query.Since) {
+			continue
+		}
+
+		history.add(msg)
+	}
+
+	return pageMessages(history.result(), query), nil
+}
+
+func (s *memoryStore) Message(channel, id string) (*ChannelMessage, error) {
+	return lookupMessage(s, channel, id)
+}
+
+func (s *memoryStore) Join(channel, connId string, user *User) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.users[channel] == nil {
+		s.users[channel] = make(map[string]*memoryPresence)
+	}
+
+	p, ok := s.users[channel][user.Id]
+	if !ok {
+		p = &memoryPresence{user: *user, conns: make(map[string]bool)}
+		s.users[channel][user.Id] = p
+	}
+
+	p.conns[connId] = true
+
+	return len(p.conns) == 1, nil
+}
+
+// Heartbeat is not needed, connections live in the same process.
+func (s *memoryStore) Heartbeat(channel, connId string, user *User) error {
+	return nil
+}
+
+func (s *memoryStore) Leave(channel, connId string, user *User) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.users[channel][user.Id]
+	if !ok || !p.conns[connId] {
+		return false, nil
+	}
+
+	delete(p.conns, connId)
+	if len(p.conns) > 0 {
+		return false, nil
+	}
+
+	delete(s.users[channel], user.Id)
+
+	return true, nil
+}
+
+func (s *memoryStore) Update(channel string, user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.users[channel][user.Id]; ok {
+		p.user = *user
+	}
+
+	return nil
+}
+
+func (s *memoryStore) Users(channel string) ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var users []User
+
+	for _, p := range s.users[channel] {
+		users = append(users, p.user)
+	}
+
+	return users, nil
+}
+
+func (s *memoryStore) IsBanned(channel, userId string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.bans[chitchat.BanKey(channel, userId)], nil
+}
+
+// Ban user in the channel.
+func (s *memoryStore) Ban(channel, userId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.bans[chitchat.BanKey(channel, userId)] = true
+}
@@ -0,0 +1,20 @@
+-- Channel history, sequence is shared by all channels.
+CREATE TABLE messages (
+    seq           BIGSERIAL   PRIMARY KEY,
+    channel       TEXT        NOT NULL,
+    id            TEXT        NOT NULL UNIQUE,
+    type          TEXT        NOT NULL,
+    user_id       TEXT,
+    user_name     TEXT,
+    text          TEXT        NOT NULL DEFAULT '',
+    attachment_id TEXT,
+    sent_at       TIMESTAMPTZ NOT NULL,
+    edited_at     TIMESTAMPTZ,
+    deleted_at    TIMESTAMPTZ,
+    -- Whole message JSON, as it's sent to clients
+    data          JSONB       NOT NULL
+);
+
+CREATE INDEX messages_channel_seq ON messages (channel, seq);
+CREATE INDEX messages_channel_sent_at ON messages (channel, sent_at);
+CREATE INDEX messages_attachment_id ON messages (attachment_id);
@@ -0,0 +1,21 @@
+-- Channel history, sequence is shared by all channels.
+-- Times are unix milliseconds, eg. datetime(sent_at / 1000, 'unixepoch').
+CREATE TABLE messages (
+    seq           INTEGER PRIMARY KEY AUTOINCREMENT,
+    channel       TEXT    NOT NULL,
+    id            TEXT    NOT NULL UNIQUE,
+    type          TEXT    NOT NULL,
+    user_id       TEXT,
+    user_name     TEXT,
+    text          TEXT    NOT NULL DEFAULT '',
+    attachment_id TEXT,
+    sent_at       INTEGER NOT NULL,
+    edited_at     INTEGER,
+    deleted_at    INTEGER,
+    -- Whole message JSON, as it's sent to clients
+    data          TEXT    NOT NULL
+);
+
+CREATE INDEX messages_channel_seq ON messages (channel, seq);
+CREATE INDEX messages_channel_sent_at ON messages (channel, sent_at);
+CREATE INDEX messages_attachment_id ON messages (attachment_id);
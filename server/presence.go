@@ -0,0 +1,400 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nuid"
+)
+
+// PresenceConfig of backends shared by server instances, connections are kept present with heartbeats
+// and ones of crashed servers expire after TTL.
+type PresenceConfig struct {
+	Heartbeat time.Duration
+	TTL       time.Duration
+}
+
+// DefaultPresenceConfig let connection miss two heartbeats.
+var DefaultPresenceConfig = PresenceConfig{Heartbeat: 10 * time.Second, TTL: 30 * time.Second}
+
+// PresenceConn is a user connection joined to the channel, kept present with heartbeats until Leave.
+type PresenceConn struct {
+	store   *Storage
+	channel string
+	user    *User
+	id      string
+
+	// Join message was sent for this connection
+	joined bool
+
+	// Connection is not present when Join failed
+	err error
+
+	once sync.Once
+	done chan bool
+
+	// Heartbeats are stopped before leave, so they don't put connection back
+	heartbeats sync.WaitGroup
+}
+
+// Join user connection to channel, join message is sent only for the first user connection.
+func Join(store *Storage, channel string, user *User) *PresenceConn {
+	p := &PresenceConn{
+		store:   store,
+		channel: channel,
+		user:    user,
+		id:      nuid.Next(),
+		done:    make(chan bool),
+	}
+
+	joined, err := store.Presence.Join(channel, p.id, user)
+	if err != nil {
+		p.err = err
+		return p
+	}
+
+	if joined {
+		store.Broker.Publish(channel, EventPresence, NewChannelJoinMessage(user, time.Now()))
+		p.joined = true
+	}
+
+	if store.PresenceHeartbeat > 0 {
+		p.heartbeats.Add(1)
+		go p.heartbeat()
+	}
+
+	return p
+}
+
+// Joined check if join message was sent for this connection.
+func (p *PresenceConn) Joined() bool {
+	return p.joined
+}
+
+func (p *PresenceConn) heartbeat() {
+	defer p.heartbeats.Done()
+
+	ticker := time.NewTicker(p.store.PresenceHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.store.Presence.Heartbeat(p.channel, p.id, p.user)
+		}
+	}
+}
+
+// Leave user connection from channel, leave message is sent only when the last user connection is gone.
+// Only the first call counts.
+func (p *PresenceConn) Leave() bool {
+	left := false
+
+	p.once.Do(func() {
+		close(p.done)
+		p.heartbeats.Wait()
+
+		if p.err != nil {
+			return
+		}
+
+		var err error
+
+		left, err = p.store.Presence.Leave(p.channel, p.id, p.user)
+		if err != nil || !left {
+			left = false
+			return
+		}
+
+		p.store.Broker.Publish(p.channel, EventPresence, NewChannelLeaveMessage(p.user, time.Now()))
+	})
+
+	return left
+}
+
+// isKick check if channel event is kicking the user.
+func isKick(e Event, user *User) bool {
+	return e.Kind == EventPresence && isKickOf(e.Data, user)
+}
+
+// isKickOf check if presence message is kicking the user.
+func isKickOf(data []byte, user *User) bool {
+	msg := ChannelMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return false
+	}
+
+	return msg.Type == chitchat.TypeKick && msg.Target != nil && msg.Target.Id == user.Id
+}
+
+// presenceKey of the user connection in the presence bucket, eg. "<user-id>.<conn-id>".
+func presenceKey(userId, connId string) string {
+	return userId + "." + connId
+}
+
+// presenceUserId of the presence bucket key.
+func presenceUserId(key string) string {
+	if i := strings.LastIndexByte(key, '.'); i >= 0 {
+		return key[:i]
+	}
+
+	return key
+}
+
+// GetPresentUsers read all users from channel presence bucket, user with many connections is taken from the latest entry.
+func GetPresentUsers(presence nats.KeyValue) ([]User, error) {
+	entries := make(map[string]nats.KeyValueEntry)
+
+	keys, _ := presence.Keys()
+
+	for _, key := range keys {
+		entry, err := presence.Get(key)
+		if err == nats.ErrKeyNotFound {
+			// Expired in the meantime
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		uid := presenceUserId(key)
+		if last, ok := entries[uid]; !ok || entry.Revision() > last.Revision() {
+			entries[uid] = entry
+		}
+	}
+
+	var users []User
+
+	for _, entry := range entries {
+		user := User{}
+		if err := json.Unmarshal(entry.Value(), &user); err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// presenceEntry is a value of the user connection in the presence bucket.
+// Since is the revision connection was joined with, zero in the first entry which revision it is.
+type presenceEntry struct {
+	User
+
+	Since uint64 `json:"since,omitempty"`
+}
+
+// putPresence put user connection joined with since revision, see presenceEntry.
+func putPresence(presence nats.KeyValue, key string, user *User, since uint64) (uint64, error) {
+	data, err := json.Marshal(presenceEntry{User: *user, Since: since})
+	if err != nil {
+		return 0, err
+	}
+
+	return presence.Put(key, data)
+}
+
+// presenceInterval of the user connection in bucket revisions, end is zero while connection is present.
+type presenceInterval struct {
+	since uint64
+	end   uint64
+}
+
+// userIntervals of the user connections in the presence bucket by key, left ones are included while their delete markers are kept.
+func userIntervals(presence nats.KeyValue, userId string) (map[string]presenceInterval, error) {
+	w, err := presence.Watch(presenceKey(userId, "*"), nats.IncludeHistory())
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	conns := make(map[string]presenceInterval)
+
+	for entry := range w.Updates() {
+		if entry == nil {
+			break
+		}
+
+		conn := conns[entry.Key()]
+
+		if entry.Operation() == nats.KeyValuePut {
+			if conn.since == 0 {
+				value := presenceEntry{}
+				json.Unmarshal(entry.Value(), &value)
+
+				conn.since = value.Since
+				if conn.since == 0 {
+					conn.since = entry.Revision()
+				}
+			}
+
+			conn.end = 0
+		} else {
+			conn.end = entry.Revision()
+		}
+
+		conns[entry.Key()] = conn
+	}
+
+	return conns, nil
+}
+
+// presentAt check if any other user connection was present at the revision.
+func presentAt(conns map[string]presenceInterval, key string, rev uint64) bool {
+	for k, conn := range conns {
+		if k != key && conn.since < rev && (conn.end == 0 || conn.end > rev) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// presenceWatcher follow presence bucket of the channel and publish leave message when the last user connection expired,
+// eg. server crashed. Every server with connections in the channel runs one, so leave is published with the expired entry
+// revision as dedup key and stream keeps only the first one.
+type presenceWatcher struct {
+	store   *jetStreamStore
+	channel string
+	bucket  nats.KeyValue
+	watcher nats.KeyWatcher
+
+	// Connections of this server
+	refs int
+
+	// The last entries of present connections by key
+	conns map[string]nats.KeyValueEntry
+
+	done chan bool
+}
+
+// watch start channel presence watcher with the first connection of this server.
+func (s *jetStreamStore) watch(channel string, presence nats.KeyValue) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if w, ok := s.watchers[channel]; ok {
+		w.refs++
+		return nil
+	}
+
+	watcher, err := presence.WatchAll()
+	if err != nil {
+		return err
+	}
+
+	w := &presenceWatcher{
+		store:   s,
+		channel: channel,
+		bucket:  presence,
+		watcher: watcher,
+		refs:    1,
+		conns:   make(map[string]nats.KeyValueEntry),
+		done:    make(chan bool),
+	}
+
+	s.watchers[channel] = w
+
+	go w.run()
+
+	return nil
+}
+
+// unwatch stop channel presence watcher with the last connection of this server.
+func (s *jetStreamStore) unwatch(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.watchers[channel]
+	if !ok {
+		return
+	}
+
+	w.refs--
+	if w.refs > 0 {
+		return
+	}
+
+	delete(s.watchers, channel)
+	close(w.done)
+}
+
+func (w *presenceWatcher) run() {
+	defer w.watcher.Stop()
+
+	ticker := time.NewTicker(w.store.js.config.Presence.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case entry, ok := <-w.watcher.Updates():
+			if !ok {
+				return
+			}
+
+			// Nil marks the end of initial values
+			if entry == nil {
+				continue
+			}
+
+			if entry.Operation() == nats.KeyValuePut {
+				w.conns[entry.Key()] = entry
+			} else {
+				delete(w.conns, entry.Key())
+			}
+		case <-ticker.C:
+			w.expire()
+		}
+	}
+}
+
+// expire drop connections without heartbeats, leave is published for users without other connections.
+func (w *presenceWatcher) expire() {
+	for key, entry := range w.conns {
+		if time.Since(entry.Created()) < w.store.js.config.Presence.TTL {
+			continue
+		}
+
+		// Clocks of servers could differ, entry is expired only when bucket removed it
+		if _, err := w.bucket.Get(key); err != nats.ErrKeyNotFound {
+			continue
+		}
+
+		delete(w.conns, key)
+
+		if w.hasUser(presenceUserId(key)) {
+			continue
+		}
+
+		user := User{}
+		if err := json.Unmarshal(entry.Value(), &user); err != nil {
+			continue
+		}
+
+		dedupKey := fmt.Sprintf("leave.%s.%s.%d", w.channel, key, entry.Revision())
+
+		w.store.PublishAck(w.channel, EventPresence, NewChannelLeaveMessage(&user, time.Now()), PublishOptions{DedupKey: dedupKey})
+	}
+}
+
+// hasUser check if user has any present connection.
+func (w *presenceWatcher) hasUser(userId string) bool {
+	for key := range w.conns {
+		if presenceUserId(key) == userId {
+			return true
+		}
+	}
+
+	return false
+}
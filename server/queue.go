@@ -0,0 +1,95 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// OverflowPolicy decide what to do when consumer send queue is full, eg. client is too slow.
+type OverflowPolicy string
+
+const (
+	// OverflowDrop drop new events until client catch up.
+	OverflowDrop OverflowPolicy = "drop"
+
+	// OverflowDisconnect close connection, so client could reconnect and load missed messages.
+	OverflowDisconnect OverflowPolicy = "disconnect"
+
+	// OverflowResume pause the subscription and replay missed events from the stream once queue is drained.
+	OverflowResume OverflowPolicy = "resume"
+)
+
+// SendQueueConfig configure consumers outbound queue.
+type SendQueueConfig struct {
+	// Maximum pending events per consumer.
+	Size int
+
+	// What to do with events when queue is full.
+	Policy OverflowPolicy
+}
+
+// DefaultSendQueueConfig don't lose events for slow clients.
+var DefaultSendQueueConfig = SendQueueConfig{
+	Size:   256,
+	Policy: OverflowResume,
+}
+
+// ParseSendQueueConfig override default config with queue size and overflow policy if they set.
+func ParseSendQueueConfig(size, policy string) (SendQueueConfig, error) {
+	config := DefaultSendQueueConfig
+
+	if len(size) > 0 {
+		s, err := strconv.Atoi(size)
+		if err != nil || s < 1 {
+			return config, fmt.Errorf("invalid send queue size %q", size)
+		}
+
+		config.Size = s
+	}
+
+	if len(policy) > 0 {
+		switch p := OverflowPolicy(policy); p {
+		case OverflowDrop, OverflowDisconnect, OverflowResume:
+			config.Policy = p
+		default:
+			return config, fmt.Errorf("invalid send queue overflow policy %q", policy)
+		}
+	}
+
+	return config, nil
+}
+
+// Send queues metrics, exposed on /debug/vars:
+//   - queued: events and replies put in queues
+//   - written: events and replies written to clients
+//   - dropped: events and replies dropped on overflow
+//   - evicted: consumers disconnected on overflow
+//   - paused: subscriptions paused on overflow
+//   - resumed: subscriptions resumed from the stream
+var sendQueueMetrics = expvar.NewMap("send_queue")
+
+// outbound is a pending event or reply to the client.
+type outbound struct {
+	// JSON channel message.
+	data []byte
+
+	// Stream sequence, zero for replies.
+	seq uint64
+
+	// Event kicks the consumer.
+	kick bool
+}
+
+// eviction is a reason to close consumer connection from the writer.
+type eviction struct {
+	code   int
+	reason string
+}
+
+var (
+	evictKicked = eviction{websocket.ClosePolicyViolation, "kicked"}
+	evictSlow   = eviction{websocket.CloseTryAgainLater, "slow consumer"}
+)
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testConsumer build consumer with one event queue and no connection.
+func testConsumer(policy OverflowPolicy) *Consumer {
+	hub := NewConsumersHub(SendQueueConfig{Size: 1, Policy: policy}, DefaultMessageLimits)
+
+	return NewConsumer("general", NewUser("Jon Snow", ""), nil, hub, nil, nil, nil)
+}
+
+// testEvent build text message event with sequence.
+func testEvent(seq uint64) Event {
+	return Event{
+		Seq:  seq,
+		Kind: EventMessage,
+		Data: []byte(`{"type":"message"}`),
+	}
+}
+
+func TestSendQueueDrop(t *testing.T) {
+	c := testConsumer(OverflowDrop)
+
+	c.enqueueEvent(c.gen, testEvent(1))
+	c.enqueueEvent(c.gen, testEvent(2))
+
+	assert.Len(t, c.queue, 1)
+	assert.Equal(t, uint64(1), (<-c.queue).seq)
+	assert.Len(t, c.evict, 0)
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	c := testConsumer(OverflowDisconnect)
+
+	c.enqueueEvent(c.gen, testEvent(1))
+	c.enqueueEvent(c.gen, testEvent(2))
+	c.enqueueEvent(c.gen, testEvent(3))
+
+	assert.True(t, c.evicted)
+	if assert.Len(t, c.evict, 1) {
+		assert.Equal(t, evictSlow, <-c.evict)
+	}
+}
+
+func TestSendQueueResume(t *testing.T) {
+	c := testConsumer(OverflowResume)
+
+	c.enqueueEvent(c.gen, testEvent(1))
+	c.enqueueEvent(c.gen, testEvent(2))
+	c.enqueueEvent(c.gen, testEvent(3))
+
+	assert.True(t, c.paused)
+	assert.Equal(t, uint64(2), c.resumeSeq)
+	assert.Len(t, c.resume, 1)
+	assert.Len(t, c.queue, 1)
+}
+
+func TestSendQueueKickOverflow(t *testing.T) {
+	c := testConsumer(OverflowDrop)
+
+	kick := testEvent(2)
+	kick.Kind = EventPresence
+	kick.Data = []byte(fmt.Sprintf(`{"type":"kick","target":{"id":"%s"}}`, c.User.Id))
+
+	c.enqueueEvent(c.gen, testEvent(1))
+	c.enqueueEvent(c.gen, kick)
+
+	if assert.Len(t, c.evict, 1) {
+		assert.Equal(t, evictKicked, <-c.evict)
+	}
+}
+
+func TestSendQueueStaleSubscription(t *testing.T) {
+	c := testConsumer(OverflowDrop)
+
+	c.enqueueEvent(c.gen-1, testEvent(1))
+
+	assert.Len(t, c.queue, 0)
+}
+
+func TestParseSendQueueConfig(t *testing.T) {
+	config, err := ParseSendQueueConfig("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultSendQueueConfig, config)
+
+	config, err = ParseSendQueueConfig("16", "drop")
+	assert.NoError(t, err)
+	assert.Equal(t, SendQueueConfig{Size: 16, Policy: OverflowDrop}, config)
+
+	_, err = ParseSendQueueConfig("0", "")
+	assert.Error(t, err)
+
+	_, err = ParseSendQueueConfig("", "block")
+	assert.Error(t, err)
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis backend configuration.
+const (
+	// Prefix of all keys and Pub/Sub channels.
+	redisPrefix = "chitchat:"
+
+	// History is read from Redis Stream by pages.
+	redisPageSize = 500
+
+	// Presence keys are removed after channel is idle this long.
+	redisPresenceTTL = 24 * time.Hour
+
+	// Time to wait for Pub/Sub subscription confirmation.
+	redisSubscribeTimeout = 5 * time.Second
+)
+
+// redisBansKey is a hash of bans by BanKey, eg. HSET chitchat:bans general.<user-id> '{"reason":"spam"}'.
+const redisBansKey = redisPrefix + "bans"
+
+// Event is put in channel Redis Stream with sequence as ID and published to Pub/Sub as "<seq> <kind> <data>" at once.
+// With dedup key the sequence is kept for the window, so duplicates return it negated instead of publishing.
+var redisPublishScript = redis.NewScript(`
+if KEYS[4] then
+	local dup = redis.call('GET', KEYS[4])
+	if dup then
+		return -tonumber(dup)
+	end
+end
+local seq = redis.call('INCR', KEYS[2])
+redis.call('XADD', KEYS[1], seq .. '-0', 'kind', ARGV[1], 'data', ARGV[2])
+redis.call('PUBLISH', KEYS[3], seq .. ' ' .. ARGV[1] .. ' ' .. ARGV[2])
+if KEYS[4] then
+	redis.call('SET', KEYS[4], seq, 'EX', ARGV[3])
+end
+return seq
+`)
+
+// Connection key is put in heartbeats sorted set with its deadline as score, new ones are counted by user
+// and user is put in presence hash on the first one. Returns number of user connections if connection is new.
+// Heartbeat of the expired connection puts it back.
+var redisJoinScript = redis.NewScript(`
+local conns = 0
+if redis.call('ZADD', KEYS[3], ARGV[4], ARGV[2]) == 1 then
+	conns = redis.call('HINCRBY', KEYS[2], ARGV[1], 1)
+	if conns == 1 then
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+	end
+end
+for i = 1, 3 do
+	redis.call('EXPIRE', KEYS[i], ARGV[5])
+end
+return conns
+`)
+
+// User is removed from presence hash with the last connection, expired connection is already removed.
+var redisLeaveScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[3], ARGV[2]) == 0 then
+	return 0
+end
+if redis.call('HINCRBY', KEYS[2], ARGV[1], -1) > 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1
+`)
+
+// Connections past deadline are removed the same way as with leave, users without other connections are returned.
+// Script is atomic, so each user is returned to one server.
+var redisExpireScript = redis.NewScript(`
+local left = {}
+for _, key in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[1])) do
+	redis.call('ZREM', KEYS[3], key)
+	local uid = string.match(key, '^(.*)%.')
+	if redis.call('HINCRBY', KEYS[2], uid, -1) <= 0 then
+		local user = redis.call('HGET', KEYS[1], uid)
+		if user then
+			table.insert(left, user)
+		end
+		redis.call('HDEL', KEYS[1], uid)
+		redis.call('HDEL', KEYS[2], uid)
+	end
+end
+return left
+`)
+
+// redisKey of the channel data, eg. "chitchat:general:events".
+// Pub/Sub channel is just "chitchat:general".
+func redisKey(channel, name string) string {
+	return redisPrefix + channel + ":" + name
+}
+
+// redisStore keep channel events in Redis Streams, deliver them with Pub/Sub
+// and presence in hashes. All subscriptions of the server share one Pub/Sub connection.
+// Connections are kept in a sorted set by heartbeat deadline, expired ones are swept by servers with connections in the channel.
+type redisStore struct {
+	client *redis.Client
+	pubsub *redis.PubSub
+
+	mu sync.Mutex
+
+	// Local subscriptions by channel
+	subs map[string]map[*redisSubscription]bool
+
+	// Closed when Redis confirmed channel subscription
+	ready map[string]chan bool
+
+	// Sweepers of channels with connections of this server
+	sweepers map[string]*redisSweeper
+
+	presence PresenceConfig
+}
+
+// redisSweeper expire channel connections and publish leave for their users.
+type redisSweeper struct {
+	refs int
+	done chan bool
+}
+
+type redisSubscription struct {
+	store   *redisStore
+	channel string
+	handler func(Event)
+
+	// Guards delivery, so handler is called in order
+	mu sync.Mutex
+
+	// Live events are buffered until stored ones are replayed
+	replaying bool
+	pending   []Event
+	lastSeq   uint64
+}
+
+// NewRedisStorage connect to Redis by URL, eg. "redis://localhost:6379/0", and build Storage with all backends on top of it.
+func NewRedisStorage(redisURL string) (*Storage, error) {
+	if len(redisURL) == 0 {
+		redisURL = "redis://localhost:6379/0"
+	}
+
+	opts, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opts)
+
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		return nil, err
+	}
+
+	s := &redisStore{
+		client: client,
+		pubsub: client.Subscribe(context.Background()),
+		subs:   make(map[string]map[*redisSubscription]bool),
+		ready:  make(map[string]chan bool),
+
+		sweepers: make(map[string]*redisSweeper),
+		presence: DefaultPresenceConfig,
+	}
+
+	go s.dispatch()
+
+	return &Storage{
+		Messages: s,
+		Broker:   s,
+		Presence: s,
+		Bans:     s,
+
+		PresenceHeartbeat: s.presence.Heartbeat,
+	}, nil
+}
+
+// Close Pub/Sub and Redis connections.
+func (s *redisStore) Close() error {
+	s.pubsub.Close()
+
+	return s.client.Close()
+}
+
+// dispatch Pub/Sub messages to local subscriptions.
+func (s *redisStore) dispatch() {
+	for msg := range s.pubsub.ChannelWithSubscriptions() {
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind != "subscribe" {
+				continue
+			}
+
+			channel := strings.TrimPrefix(msg.Channel, redisPrefix)
+
+			s.mu.Lock()
+			if ready, ok := s.ready[channel]; ok {
+				select {
+				case <-ready:
+				default:
+					close(ready)
+				}
+			}
+			s.mu.Unlock()
+		case *redis.Message:
+			e, err := parseRedisEvent(msg.Payload)
+			if err != nil {
+				continue
+			}
+
+			channel := strings.TrimPrefix(msg.Channel, redisPrefix)
+
+			s.mu.Lock()
+			subs := make([]*redisSubscription, 0, len(s.subs[channel]))
+			for sub := range s.subs[channel] {
+				subs = append(subs, sub)
+			}
+			s.mu.Unlock()
+
+			for _, sub := range subs {
+				sub.deliver(e)
+			}
+		}
+	}
+}
+
+// parseRedisEvent from Pub/Sub payload "<seq> <kind> <data>".
+func parseRedisEvent(payload string) (Event, error) {
+	parts := strings.SplitN(payload, " ", 3)
+	if len(parts) != 3 {
+		return Event{}, errors.New("invalid event payload")
+	}
+
+	seq, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{Seq: seq, Kind: parts[1], Data: []byte(parts[2])}, nil
+}
+
+// parseRedisId return sequence from stream entry ID "<seq>-0".
+func parseRedisId(id string) uint64 {
+	seq, _, _ := strings.Cut(id, "-")
+	n, _ := strconv.ParseUint(seq, 10, 64)
+
+	return n
+}
+
+func (s *redisStore) Publish(channel, kind string, msg ChannelMessage) error {
+	_, err := s.PublishAck(channel, kind, msg, PublishOptions{})
+
+	return err
+}
+
+func (s *redisStore) PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return PublishAck{}, err
+	}
+
+	keys := []string{redisKey(channel, "events"), redisKey(channel, "seq"), redisPrefix + channel}
+	if len(opts.DedupKey) > 0 {
+		keys = append(keys, redisKey(channel, "dedup:"+opts.DedupKey))
+	}
+
+	seq, err := redisPublishScript.Run(context.Background(), s.client, keys, kind, data, int(dedupWindow.Seconds())).Int64()
+	if err != nil {
+		return PublishAck{}, err
+	}
+
+	if seq < 0 {
+		return PublishAck{Seq: uint64(-seq), Duplicate: true}, nil
+	}
+
+	return PublishAck{Seq: uint64(seq)}, nil
+}
+
+// Subscribe to channel Pub/Sub, stored events starting from the sequence are replayed from the stream first.
+func (s *redisStore) Subscribe(channel string, opts SubscribeOptions, handler func(Event)) (Subscription, error) {
+	sub := &redisSubscription{
+		store:     s,
+		channel:   channel,
+		handler:   handler,
+		replaying: opts.StartSeq > 0,
+	}
+
+	s.mu.Lock()
+	if s.subs[channel] == nil {
+		s.subs[channel] = make(map[*redisSubscription]bool)
+		s.ready[channel] = make(chan bool)
+
+		if err := s.pubsub.Subscribe(context.Background(), redisPrefix+channel); err != nil {
+			delete(s.subs, channel)
+			delete(s.ready, channel)
+			s.mu.Unlock()
+
+			return nil, err
+		}
+	}
+
+	s.subs[channel][sub] = true
+	ready := s.ready[channel]
+	s.mu.Unlock()
+
+	// Events published before Redis subscribed us are only in the stream
+	select {
+	case <-ready:
+	case <-time.After(redisSubscribeTimeout):
+		sub.Unsubscribe()
+		return nil, fmt.Errorf("redis subscription to %s timed out", channel)
+	}
+
+	if opts.StartSeq > 0 {
+		if err := sub.replay(opts.StartSeq); err != nil {
+			sub.Unsubscribe()
+			return nil, err
+		}
+	}
+
+	return sub, nil
+}
+
+// replay stored events starting from the sequence, then buffered live ones.
+func (sub *redisSubscription) replay(start uint64) error {
+	err := sub.store.rangeEvents(sub.channel, start, func(e Event) {
+		sub.mu.Lock()
+		sub.lastSeq = e.Seq
+		sub.handler(e)
+		sub.mu.Unlock()
+	})
+
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	sub.replaying = false
+
+	for _, e := range sub.pending {
+		if e.Seq > sub.lastSeq {
+			sub.lastSeq = e.Seq
+			sub.handler(e)
+		}
+	}
+
+	sub.pending = nil
+
+	return err
+}
+
+// deliver live event, skipping already replayed ones.
+func (sub *redisSubscription) deliver(e Event) {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.replaying {
+		sub.pending = append(sub.pending, e)
+		return
+	}
+
+	if e.Seq <= sub.lastSeq {
+		return
+	}
+
+	sub.lastSeq = e.Seq
+	sub.handler(e)
+}
+
+func (sub *redisSubscription) Unsubscribe() error {
+	s := sub.store
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	subs, ok := s.subs[sub.channel]
+	if !ok || !subs[sub] {
+		return nil
+	}
+
+	delete(subs, sub)
+
+	if len(subs) > 0 {
+		return nil
+	}
+
+	delete(s.subs, sub.channel)
+	delete(s.ready, sub.channel)
+
+	return s.pubsub.Unsubscribe(context.Background(), redisPrefix+sub.channel)
+}
+
+// rangeEvents read channel events starting from the sequence with XRANGE by pages.
+func (s *redisStore) rangeEvents(channel string, start uint64, fn func(Event)) error {
+	ctx := context.Background()
+	key := redisKey(channel, "events")
+
+	for {
+		entries, err := s.client.XRangeN(ctx, key, fmt.Sprintf("%d-0", start), "+", redisPageSize).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			kind, _ := entry.Values["kind"].(string)
+			data, _ := entry.Values["data"].(string)
+
+			seq := parseRedisId(entry.ID)
+			fn(Event{Seq: seq, Kind: kind, Data: []byte(data)})
+
+			start = seq + 1
+		}
+
+		if len(entries) < redisPageSize {
+			return nil
+		}
+	}
+}
+
+func (s *redisStore) Messages(channel string, query MessageQuery) ([]ChannelMessage, error) {
+	history := newMessageHistory()
+
+	var decodeErr error
+
+	err := s.rangeEvents(channel, 1, func(e Event) {
+		if e.Kind != EventMessage || decodeErr != nil {
+			return
+		}
+
+		msg := ChannelMessage{}
+		if decodeErr = json.Unmarshal(e.Data, &msg); decodeErr != nil {
+			return
+		}
+
+		if msg.SentAt.Before(query.Since) {
+			return
+		}
+
+		history.add(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return pageMessages(history.result(), query), nil
+}
+
+func (s *redisStore) Message(channel, id string) (*ChannelMessage, error) {
+	return lookupMessage(s, channel, id)
+}
+
+// redisPresenceKeys of the channel: presence hash, connections count hash and heartbeats sorted set.
+func redisPresenceKeys(channel string) []string {
+	return []string{redisKey(channel, "presence"), redisKey(channel, "conns"), redisKey(channel, "heartbeats")}
+}
+
+func (s *redisStore) Join(channel, connId string, user *User) (bool, error) {
+	conns, err := s.heartbeat(channel, connId, user)
+	if err != nil {
+		return false, err
+	}
+
+	s.sweep(channel)
+
+	return conns == 1, nil
+}
+
+func (s *redisStore) Heartbeat(channel, connId string, user *User) error {
+	_, err := s.heartbeat(channel, connId, user)
+
+	return err
+}
+
+func (s *redisStore) heartbeat(channel, connId string, user *User) (int, error) {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return 0, err
+	}
+
+	deadline := time.Now().Add(s.presence.TTL).UnixMilli()
+
+	return redisJoinScript.Run(context.Background(), s.client, redisPresenceKeys(channel),
+		user.Id, presenceKey(user.Id, connId), data, deadline, int(redisPresenceTTL.Seconds())).Int()
+}
+
+func (s *redisStore) Leave(channel, connId string, user *User) (bool, error) {
+	s.unsweep(channel)
+
+	left, err := redisLeaveScript.Run(context.Background(), s.client, redisPresenceKeys(channel), user.Id, presenceKey(user.Id, connId)).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return left == 1, nil
+}
+
+// Expire channel connections without heartbeats, users whose last connection expired are returned.
+func (s *redisStore) Expire(channel string) ([]User, error) {
+	values, err := redisExpireScript.Run(context.Background(), s.client, redisPresenceKeys(channel), time.Now().UnixMilli()).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+
+	for _, value := range values {
+		user := User{}
+		if err := json.Unmarshal([]byte(value), &user); err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+// sweep start expiring channel connections with the first connection of this server.
+func (s *redisStore) sweep(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sweeper, ok := s.sweepers[channel]; ok {
+		sweeper.refs++
+		return
+	}
+
+	sweeper := &redisSweeper{refs: 1, done: make(chan bool)}
+	s.sweepers[channel] = sweeper
+
+	go func() {
+		ticker := time.NewTicker(s.presence.Heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-sweeper.done:
+				return
+			case <-ticker.C:
+			}
+
+			users, err := s.Expire(channel)
+			if err != nil {
+				continue
+			}
+
+			for i := range users {
+				s.Publish(channel, EventPresence, NewChannelLeaveMessage(&users[i], time.Now()))
+			}
+		}
+	}()
+}
+
+// unsweep stop expiring channel connections with the last connection of this server.
+func (s *redisStore) unsweep(channel string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sweeper, ok := s.sweepers[channel]
+	if !ok {
+		return
+	}
+
+	sweeper.refs--
+	if sweeper.refs > 0 {
+		return
+	}
+
+	delete(s.sweepers, channel)
+	close(sweeper.done)
+}
+
+func (s *redisStore) Update(channel string, user *User) error {
+	data, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	return s.client.HSet(context.Background(), redisKey(channel, "presence"), user.Id, data).Err()
+}
+
+func (s *redisStore) Users(channel string) ([]User, error) {
+	values, err := s.client.HVals(context.Background(), redisKey(channel, "presence")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []User
+
+	for _, value := range values {
+		user := User{}
+		if err := json.Unmarshal([]byte(value), &user); err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, nil
+}
+
+func (s *redisStore) IsBanned(channel, userId string) (bool, error) {
+	return s.client.HExists(context.Background(), redisBansKey, chitchat.BanKey(channel, userId)).Result()
+}
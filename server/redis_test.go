@@ -0,0 +1,186 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testRedisStorage build Redis storage on top of miniredis.
+func testRedisStorage(t *testing.T) (*Storage, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+
+	store, err := NewRedisStorage("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		store.Broker.(*redisStore).Close()
+	})
+
+	return store, mr
+}
+
+func TestRedisPublishSubscribe(t *testing.T) {
+	store, _ := testRedisStorage(t)
+	user := NewUser("Jon Snow", "")
+
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "one")))
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "two")))
+
+	events := make(chan Event, 8)
+	sub, err := store.Broker.Subscribe("general", SubscribeOptions{StartSeq: 2}, chanHandler(events))
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	assert.NoError(t, store.Broker.Publish("general", EventPresence, NewChannelJoinMessage(user, time.Now())))
+	assert.NoError(t, store.Broker.Publish("lobby", EventMessage, NewChannelMessage(user, time.Now(), "other")))
+
+	received := receive(events, 2)
+	if assert.Len(t, received, 2) {
+		assert.Equal(t, uint64(2), received[0].Seq)
+		assert.Contains(t, string(received[0].Data), "two")
+
+		assert.Equal(t, uint64(3), received[1].Seq)
+		assert.Equal(t, EventPresence, received[1].Kind)
+	}
+
+	assert.NoError(t, sub.Unsubscribe())
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "three")))
+
+	assert.Len(t, receive(events, 1), 0)
+}
+
+func TestRedisMessages(t *testing.T) {
+	store, _ := testRedisStorage(t)
+	user := NewUser("Jon Snow", "")
+
+	// More than one XRANGE page
+	for i := 0; i < redisPageSize+10; i++ {
+		store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Unix(1000, 0), "old"))
+	}
+
+	store.Broker.Publish("general", EventPresence, NewChannelJoinMessage(user, time.Unix(2000, 0)))
+
+	msg := NewChannelMessage(user, time.Unix(3000, 0), "new")
+	store.Broker.Publish("general", EventMessage, msg)
+	store.Broker.Publish("general", EventMessage, NewChannelMessageUpdatedMessage(time.Unix(3001, 0), msg.Id, []LinkPreview{{Title: "Preview"}}))
+
+	messages, err := store.Messages.Messages("general", MessageQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, messages, redisPageSize+11)
+
+	messages, err = store.Messages.Messages("general", MessageQuery{Since: time.Unix(2000, 0)})
+	if assert.NoError(t, err) && assert.Len(t, messages, 1) {
+		assert.Equal(t, "new", messages[0].Text)
+		assert.Len(t, messages[0].Previews, 1)
+	}
+}
+
+func TestRedisPresence(t *testing.T) {
+	store, mr := testRedisStorage(t)
+	user := NewUser("Jon Snow", "")
+
+	joined, err := store.Presence.Join("general", "first", user)
+	assert.NoError(t, err)
+	assert.True(t, joined)
+
+	// Second connection
+	joined, err = store.Presence.Join("general", "second", user)
+	assert.NoError(t, err)
+	assert.False(t, joined)
+
+	assert.True(t, mr.TTL(redisKey("general", "presence")) > 0)
+
+	user.Name = "Lord Snow"
+	assert.NoError(t, store.Presence.Update("general", user))
+
+	users, err := store.Presence.Users("general")
+	if assert.NoError(t, err) && assert.Len(t, users, 1) {
+		assert.Equal(t, "Lord Snow", users[0].Name)
+	}
+
+	left, err := store.Presence.Leave("general", "second", user)
+	assert.NoError(t, err)
+	assert.False(t, left)
+
+	left, err = store.Presence.Leave("general", "first", user)
+	assert.NoError(t, err)
+	assert.True(t, left)
+
+	users, err = store.Presence.Users("general")
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+}
+
+func TestRedisPresenceExpire(t *testing.T) {
+	store, _ := testRedisStorage(t)
+	redis := store.Presence.(*redisStore)
+
+	jon, arya := NewUser("Jon Snow", ""), NewUser("Arya Stark", "")
+
+	redis.presence.TTL = 50 * time.Millisecond
+
+	// Connections of the crashed server
+	redis.Join("general", "crashed", jon)
+	redis.Join("general", "crashed", arya)
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Jon is still connected to other server
+	redis.Heartbeat("general", "alive", jon)
+
+	users, err := redis.Expire("general")
+	if assert.NoError(t, err) && assert.Len(t, users, 1) {
+		assert.Equal(t, arya.Id, users[0].Id)
+	}
+
+	// Expired only once
+	users, err = redis.Expire("general")
+	assert.NoError(t, err)
+	assert.Len(t, users, 0)
+
+	users, err = store.Presence.Users("general")
+	if assert.NoError(t, err) && assert.Len(t, users, 1) {
+		assert.Equal(t, jon.Id, users[0].Id)
+	}
+
+	// Expired connection is already gone
+	left, err := redis.Leave("general", "crashed", arya)
+	assert.NoError(t, err)
+	assert.False(t, left)
+}
+
+func TestRedisBans(t *testing.T) {
+	store, mr := testRedisStorage(t)
+
+	banned, err := store.Bans.IsBanned("general", "jon")
+	assert.NoError(t, err)
+	assert.False(t, banned)
+
+	mr.HSet(redisBansKey, "general.jon", `{"reason":"spam"}`)
+
+	banned, err = store.Bans.IsBanned("general", "jon")
+	assert.NoError(t, err)
+	assert.True(t, banned)
+
+	banned, _ = store.Bans.IsBanned("lobby", "jon")
+	assert.False(t, banned)
+}
+
+func TestRedisPostMessage(t *testing.T) {
+	store, _ := testRedisStorage(t)
+
+	// Handlers work the same with any storage
+	testPostMessage(t, store)
+}
+
+func TestRedisSendMessageDedup(t *testing.T) {
+	store, _ := testRedisStorage(t)
+
+	testSendMessageDedup(t, store)
+}
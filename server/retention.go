@@ -0,0 +1,588 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+)
+
+// Time to wait for JetStream API while enforcing policies.
+const retentionRequestTimeout = 5 * time.Second
+
+// Time to wait for the next pending channel event.
+const retentionFetchWait = 5 * time.Second
+
+// RetentionPolicy limit history of the channel, zero limits keep history forever.
+// All set limits are applied, the oldest events are removed first.
+type RetentionPolicy struct {
+	MaxAge      time.Duration `json:"max_age,omitempty"`
+	MaxMessages int64         `json:"max_messages,omitempty"`
+	MaxBytes    int64         `json:"max_bytes,omitempty"`
+}
+
+// Size units of the max bytes limit, from the largest.
+var retentionSizeUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"B", 1},
+}
+
+// ParseRetentionPolicy parse limits from command arguments, eg. "30d", "1000 messages", "10MB" or "forever".
+// Limits could be combined, eg. "7d 500MB".
+func ParseRetentionPolicy(args []string) (RetentionPolicy, error) {
+	policy := RetentionPolicy{}
+
+	if len(args) == 0 {
+		return policy, errors.New("Retention limits are missing")
+	}
+
+	if len(args) == 1 && strings.EqualFold(args[0], "forever") {
+		return policy, nil
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i])
+
+		// "1000 messages" is the same as "1000messages"
+		if i+1 < len(args) && isMessagesUnit(args[i+1]) {
+			i++
+			arg += "messages"
+		}
+
+		var err error
+
+		switch {
+		case strings.HasSuffix(arg, "messages") || strings.HasSuffix(arg, "msgs"):
+			policy.MaxMessages, err = parseRetentionCount(strings.TrimSuffix(strings.TrimSuffix(arg, "messages"), "msgs"))
+		case strings.HasSuffix(arg, "d"):
+			var days int64
+			if days, err = parseRetentionCount(strings.TrimSuffix(arg, "d")); err == nil {
+				policy.MaxAge = time.Duration(days) * 24 * time.Hour
+			}
+		case strings.HasSuffix(arg, "b"):
+			policy.MaxBytes, err = parseRetentionSize(arg)
+		default:
+			policy.MaxAge, err = time.ParseDuration(arg)
+			if err == nil && policy.MaxAge <= 0 {
+				err = errors.New("not positive")
+			}
+		}
+
+		if err != nil {
+			return RetentionPolicy{}, fmt.Errorf("Invalid retention limit %q", args[i])
+		}
+	}
+
+	return policy, nil
+}
+
+func isMessagesUnit(s string) bool {
+	s = strings.ToLower(s)
+
+	return s == "messages" || s == "message" || s == "msgs"
+}
+
+// parseRetentionCount parse positive integer.
+func parseRetentionCount(s string) (int64, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n <= 0 {
+		err = errors.New("not positive")
+	}
+
+	return n, err
+}
+
+// parseRetentionSize parse size with unit, eg. "512kb".
+func parseRetentionSize(s string) (int64, error) {
+	s = strings.ToUpper(s)
+
+	for _, unit := range retentionSizeUnits {
+		if strings.HasSuffix(s, unit.suffix) {
+			n, err := parseRetentionCount(strings.TrimSuffix(s, unit.suffix))
+
+			return n * unit.size, err
+		}
+	}
+
+	return 0, errors.New("unknown unit")
+}
+
+// IsForever check if policy has no limits.
+func (p RetentionPolicy) IsForever() bool {
+	return p == RetentionPolicy{}
+}
+
+// String format policy the same way it's parsed, eg. "30d 1000 messages".
+func (p RetentionPolicy) String() string {
+	if p.IsForever() {
+		return "forever"
+	}
+
+	var limits []string
+
+	if p.MaxAge > 0 {
+		day := 24 * time.Hour
+
+		if p.MaxAge%day == 0 {
+			limits = append(limits, fmt.Sprintf("%dd", p.MaxAge/day))
+		} else {
+			limits = append(limits, p.MaxAge.String())
+		}
+	}
+
+	if p.MaxMessages > 0 {
+		limits = append(limits, fmt.Sprintf("%d messages", p.MaxMessages))
+	}
+
+	if p.MaxBytes > 0 {
+		for _, unit := range retentionSizeUnits {
+			if p.MaxBytes%unit.size == 0 {
+				limits = append(limits, fmt.Sprintf("%d%s", p.MaxBytes/unit.size, unit.suffix))
+				break
+			}
+		}
+	}
+
+	return strings.Join(limits, " ")
+}
+
+func (s *jetStreamStore) Retention(channel string) (RetentionPolicy, error) {
+	policy := RetentionPolicy{}
+
+	bucket, err := s.js.RetentionBucket()
+	if err != nil {
+		return policy, err
+	}
+
+	entry, err := bucket.Get(channel)
+	if err == nats.ErrKeyNotFound {
+		return policy, nil
+	}
+
+	if err != nil {
+		return policy, err
+	}
+
+	return policy, json.Unmarshal(entry.Value(), &policy)
+}
+
+// SetRetention keep policy in the bucket, channel stream limits are updated right away.
+// Shared stream is purged by RetentionWorker.
+func (s *jetStreamStore) SetRetention(channel string, policy RetentionPolicy) error {
+	bucket, err := s.js.RetentionBucket()
+	if err != nil {
+		return err
+	}
+
+	if policy.IsForever() {
+		if err := bucket.Purge(channel); err != nil {
+			return err
+		}
+	} else {
+		data, err := json.Marshal(policy)
+		if err != nil {
+			return err
+		}
+
+		if _, err := bucket.Put(channel, data); err != nil {
+			return err
+		}
+	}
+
+	if s.config.Topology != TopologyChannel {
+		return nil
+	}
+
+	info, err := s.js.StreamInfo(chitchat.ChannelStreamName(channel))
+	if err == nats.ErrStreamNotFound {
+		// Policy is applied with the stream creation
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	limits := s.config.channelStream(channel, policy)
+
+	config := info.Config
+	config.MaxAge = limits.MaxAge
+	config.MaxBytes = limits.MaxBytes
+	config.MaxMsgsPerSubject = limits.MaxMsgsPerSubject
+
+	// Duplicates window can't be longer than messages are kept
+	if config.MaxAge > 0 && config.Duplicates > config.MaxAge {
+		config.Duplicates = config.MaxAge
+	}
+
+	_, err = s.js.UpdateStream(&config)
+
+	return err
+}
+
+// RetentionWorker enforce retention policies of channels in the shared stream by purging subjects.
+// Stream per channel has policies applied as stream limits, so worker isn't needed.
+type RetentionWorker struct {
+	js       *JetStream
+	interval time.Duration
+	logger   echo.Logger
+	done     chan bool
+
+	// Sizes of channel events, so only new ones are read to enforce size limits
+	sizes map[string]*channelSize
+}
+
+// channelSize is a running size of channel events.
+type channelSize struct {
+	// All channel events up to the sequence are read
+	lastSeq uint64
+	events  []eventSize
+	total   int64
+}
+
+// eventSize is an approximate size of the stored event.
+type eventSize struct {
+	seq     uint64
+	subject string
+	size    int64
+}
+
+// keep only events matching f.
+func (s *channelSize) keep(f func(e eventSize) bool) {
+	events := s.events[:0]
+	s.total = 0
+
+	for _, e := range s.events {
+		if f(e) {
+			events = append(events, e)
+			s.total += e.size
+		}
+	}
+
+	s.events = events
+}
+
+// keepLast n events of every subject, same as purge with keep.
+func (s *channelSize) keepLast(n int) {
+	later := make(map[string]int)
+	for _, e := range s.events {
+		later[e.subject]++
+	}
+
+	s.keep(func(e eventSize) bool {
+		later[e.subject]--
+		return later[e.subject] < n
+	})
+}
+
+// NewRetentionWorker enforce policies every interval, eg. every hour.
+func NewRetentionWorker(js *JetStream, interval time.Duration, logger echo.Logger) *RetentionWorker {
+	return &RetentionWorker{
+		js:       js,
+		interval: interval,
+		logger:   logger,
+		done:     make(chan bool),
+		sizes:    make(map[string]*channelSize),
+	}
+}
+
+func (w *RetentionWorker) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.enforce()
+
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Shutdown stop enforcing policies.
+func (w *RetentionWorker) Shutdown() {
+	close(w.done)
+}
+
+// enforce policies of all channels, the other server instances could do the same, purging is idempotent.
+func (w *RetentionWorker) enforce() {
+	bucket, err := w.js.RetentionBucket()
+	if err != nil {
+		w.logger.Errorf("retention: %s", err)
+		return
+	}
+
+	channels, err := bucket.Keys()
+	if err != nil {
+		// No policies yet
+		return
+	}
+
+	for _, channel := range channels {
+		entry, err := bucket.Get(channel)
+		if err != nil {
+			continue
+		}
+
+		policy := RetentionPolicy{}
+		if err := json.Unmarshal(entry.Value(), &policy); err != nil {
+			continue
+		}
+
+		if err := w.Enforce(channel, policy); err != nil {
+			w.logger.Errorf("retention of %s: %s", channel, err)
+		}
+	}
+}
+
+// Enforce purge channel events out of policy limits.
+func (w *RetentionWorker) Enforce(channel string, policy RetentionPolicy) error {
+	if policy.MaxMessages > 0 {
+		// Messages and presence events are limited separately, same as with stream per channel
+		for _, subject := range []string{chitchat.MessageSubject(channel), chitchat.PresenceSubject(channel)} {
+			if err := w.purge(purgeRequest{Subject: subject, Keep: uint64(policy.MaxMessages)}); err != nil {
+				return err
+			}
+		}
+
+		if size := w.sizes[channel]; size != nil {
+			size.keepLast(int(policy.MaxMessages))
+		}
+	}
+
+	if policy.MaxAge > 0 {
+		seq, err := w.purgeBefore(channel, nats.StartTime(time.Now().Add(-policy.MaxAge)))
+		if err != nil {
+			return err
+		}
+
+		if size := w.sizes[channel]; size != nil {
+			size.keep(func(e eventSize) bool { return e.seq >= seq })
+		}
+	}
+
+	if policy.MaxBytes > 0 {
+		seq, err := w.firstSeqWithin(channel, policy.MaxBytes)
+		if err != nil {
+			return err
+		}
+
+		if seq > 0 {
+			return w.purge(purgeRequest{Subject: chitchat.ChannelSubject(channel), Sequence: seq})
+		}
+	}
+
+	return nil
+}
+
+// purgeBefore purge channel events before the first one delivered with start option, returns its sequence.
+func (w *RetentionWorker) purgeBefore(channel string, start nats.SubOpt) (uint64, error) {
+	info, err := w.js.StreamInfo(StreamName)
+	if err != nil {
+		return 0, err
+	}
+
+	sub, err := w.js.SubscribeSync(chitchat.ChannelSubject(channel), nats.OrderedConsumer(), start)
+	if err != nil {
+		return 0, err
+	}
+	defer sub.Unsubscribe()
+
+	pending, err := hasPending(sub)
+	if err != nil {
+		return 0, err
+	}
+
+	// Without newer events everything published before the stream info is purged
+	seq := info.State.LastSeq + 1
+
+	if pending {
+		// Slow response isn't a reason to purge newer events, so timeout is an error
+		msg, err := sub.NextMsg(retentionFetchWait)
+		if err != nil {
+			return 0, err
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return 0, err
+		}
+
+		seq = meta.Sequence.Stream
+	}
+
+	return seq, w.purge(purgeRequest{Subject: chitchat.ChannelSubject(channel), Sequence: seq})
+}
+
+// firstSeqWithin find the oldest channel event to keep, so newer events size is within max bytes.
+// Zero is returned when all events are within the limit.
+func (w *RetentionWorker) firstSeqWithin(channel string, maxBytes int64) (uint64, error) {
+	count, lastSeq, err := w.channelState(channel)
+	if err != nil {
+		return 0, err
+	}
+
+	// Only events published since the last time are read
+	size := w.sizes[channel]
+	if size != nil {
+		err = w.readSizes(channel, size, lastSeq)
+	}
+
+	// Events deleted or purged by others are noticed by count, sizes are read again then
+	if size == nil || err != nil || uint64(len(size.events)) != count {
+		size = &channelSize{}
+
+		if err := w.readSizes(channel, size, lastSeq); err != nil {
+			delete(w.sizes, channel)
+			return 0, err
+		}
+	}
+
+	w.sizes[channel] = size
+
+	var seq uint64
+
+	for size.total > maxBytes {
+		seq = size.events[0].seq + 1
+		size.total -= size.events[0].size
+		size.events = size.events[1:]
+	}
+
+	return seq, nil
+}
+
+// readSizes of channel events published after the last read one, up to the sequence.
+func (w *RetentionWorker) readSizes(channel string, size *channelSize, upTo uint64) error {
+	if size.lastSeq >= upTo {
+		return nil
+	}
+
+	sub, err := w.js.SubscribeSync(chitchat.ChannelSubject(channel), nats.OrderedConsumer(), nats.StartSequence(size.lastSeq+1))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	pending, err := hasPending(sub)
+	if err != nil {
+		return err
+	}
+
+	for pending {
+		msg, err := sub.NextMsg(retentionFetchWait)
+		if err != nil {
+			return err
+		}
+
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+
+		if meta.Sequence.Stream > upTo {
+			break
+		}
+
+		e := eventSize{seq: meta.Sequence.Stream, subject: msg.Subject, size: int64(len(msg.Subject) + len(msg.Data))}
+		size.events = append(size.events, e)
+		size.total += e.size
+
+		pending = meta.NumPending > 0
+	}
+
+	size.lastSeq = upTo
+
+	return nil
+}
+
+// channelState return count of channel events and the last sequence of the stream.
+func (w *RetentionWorker) channelState(channel string) (uint64, uint64, error) {
+	resp := struct {
+		State struct {
+			LastSeq  uint64            `json:"last_seq"`
+			Subjects map[string]uint64 `json:"subjects"`
+		} `json:"state"`
+	}{}
+
+	req := struct {
+		SubjectsFilter string `json:"subjects_filter"`
+	}{chitchat.ChannelSubject(channel)}
+
+	if err := w.request("STREAM.INFO."+StreamName, req, &resp); err != nil {
+		return 0, 0, err
+	}
+
+	var count uint64
+	for _, n := range resp.State.Subjects {
+		count += n
+	}
+
+	return count, resp.State.LastSeq, nil
+}
+
+// hasPending check if consumer has events to deliver, delivered ones count too.
+func hasPending(sub *nats.Subscription) (bool, error) {
+	info, err := sub.ConsumerInfo()
+	if err != nil {
+		return false, err
+	}
+
+	return info.NumPending > 0 || info.Delivered.Consumer > 0, nil
+}
+
+// purgeRequest of the JetStream API, client doesn't expose subject filter.
+type purgeRequest struct {
+	Subject  string `json:"filter"`
+	Sequence uint64 `json:"seq,omitempty"`
+	Keep     uint64 `json:"keep,omitempty"`
+}
+
+func (w *RetentionWorker) purge(req purgeRequest) error {
+	return w.request("STREAM.PURGE."+StreamName, req, nil)
+}
+
+// request JetStream API, resp could be nil when only error matters.
+func (w *RetentionWorker) request(api string, req, resp interface{}) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	msg, err := w.js.nc.Request("$JS.API."+api, data, retentionRequestTimeout)
+	if err != nil {
+		return err
+	}
+
+	apiResp := struct {
+		Error *struct {
+			Description string `json:"description"`
+		} `json:"error"`
+	}{}
+
+	if err := json.Unmarshal(msg.Data, &apiResp); err != nil {
+		return err
+	}
+
+	if apiResp.Error != nil {
+		return errors.New(apiResp.Error.Description)
+	}
+
+	if resp == nil {
+		return nil
+	}
+
+	return json.Unmarshal(msg.Data, resp)
+}
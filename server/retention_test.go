@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := ParseRetentionPolicy([]string{"forever"})
+	assert.NoError(t, err)
+	assert.True(t, policy.IsForever())
+
+	policy, err = ParseRetentionPolicy([]string{"30d", "1000", "messages", "10MB"})
+	assert.NoError(t, err)
+	assert.Equal(t, RetentionPolicy{MaxAge: 30 * 24 * time.Hour, MaxMessages: 1000, MaxBytes: 10 << 20}, policy)
+	assert.Equal(t, "30d 1000 messages 10MB", policy.String())
+
+	policy, err = ParseRetentionPolicy([]string{"12h", "500msgs"})
+	assert.NoError(t, err)
+	assert.Equal(t, RetentionPolicy{MaxAge: 12 * time.Hour, MaxMessages: 500}, policy)
+
+	for _, args := range [][]string{{}, {"month"}, {"0d"}, {"-5", "messages"}, {"10XB"}} {
+		_, err = ParseRetentionPolicy(args)
+		assert.Error(t, err, args)
+	}
+}
+
+func TestRetentionWorker(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err := testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	nc, _ := nats.Connect(embedded.URL())
+	defer nc.Close()
+
+	user := NewUser("Jon Snow", "")
+	worker := NewRetentionWorker(js, time.Hour, log.New("test"))
+
+	publish := func(channel string, n int) {
+		for i := 0; i < n; i++ {
+			testPublishCore(t, embedded.URL(), channel, NewChannelMessage(user, time.Now(), fmt.Sprintf("Message #%d", i)))
+		}
+	}
+
+	count := func(channel string) int {
+		messages, err := FetchMessages(js, StreamName, channel)
+		assert.NoError(t, err)
+
+		return len(messages)
+	}
+
+	publish("general", 5)
+	publish("lobby", 2)
+
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxMessages: 3}))
+	assert.Equal(t, 3, count("general"))
+	assert.Equal(t, 2, count("lobby"))
+
+	// Messages are the same size
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxBytes: 1}))
+	assert.Equal(t, 0, count("general"))
+
+	publish("general", 2)
+	time.Sleep(500 * time.Millisecond)
+	publish("general", 1)
+
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxAge: 250 * time.Millisecond}))
+	assert.Equal(t, 1, count("general"))
+	assert.Equal(t, 2, count("lobby"))
+
+	// Without newer events the whole channel history is out of limits
+	assert.NoError(t, worker.Enforce("lobby", RetentionPolicy{MaxAge: 250 * time.Millisecond}))
+	assert.Equal(t, 0, count("lobby"))
+	assert.Equal(t, 1, count("general"))
+}
+
+func TestRetentionWorkerMaxBytes(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err := testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	user := NewUser("Jon Snow", "")
+	sentAt := time.Now()
+	worker := NewRetentionWorker(js, time.Hour, log.New("test"))
+
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			testPublishCore(t, embedded.URL(), "general", NewChannelMessage(user, sentAt, fmt.Sprintf("Message #%d", i)))
+		}
+	}
+
+	count := func() int {
+		messages, err := FetchMessages(js, StreamName, "general")
+		assert.NoError(t, err)
+
+		return len(messages)
+	}
+
+	publish(5)
+
+	// Everything fits, sizes are remembered
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxBytes: 1 << 20}))
+	assert.Equal(t, 5, count())
+
+	size := worker.sizes["general"]
+	if !assert.NotNil(t, size) || !assert.Len(t, size.events, 5) {
+		return
+	}
+
+	// Messages are the same size
+	limit := size.events[0].size * 3
+
+	publish(2)
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxBytes: limit}))
+	assert.Equal(t, 3, count())
+	assert.Equal(t, limit, worker.sizes["general"].total)
+
+	// Sizes are kept in sync with other limits
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxMessages: 2, MaxBytes: limit}))
+	assert.Equal(t, 2, count())
+	assert.Len(t, worker.sizes["general"].events, 2)
+
+	// Deleted message is noticed and sizes are read again
+	info, err := js.StreamInfo(StreamName)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, js.DeleteMsg(StreamName, info.State.FirstSeq))
+
+	publish(2)
+	assert.NoError(t, worker.Enforce("general", RetentionPolicy{MaxBytes: limit}))
+	assert.Equal(t, 3, count())
+	assert.Len(t, worker.sizes["general"].events, 3)
+}
+
+func TestChannelStreamRetention(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	config := StreamConfig{Topology: TopologyChannel, MaxAge: time.Hour}
+
+	js, err := testNewStream(t, embedded.URL(), config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store := NewJetStreamStorage(js)
+
+	// Policy of the new channel is applied with stream creation
+	assert.NoError(t, store.Retention.SetRetention("general", RetentionPolicy{MaxMessages: 100}))
+
+	sub, err := store.Broker.Subscribe("general", SubscribeOptions{}, func(Event) {})
+	if assert.NoError(t, err) {
+		sub.Unsubscribe()
+	}
+
+	info, err := js.StreamInfo(chitchat.ChannelStreamName("general"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(100), info.Config.MaxMsgsPerSubject)
+		assert.Equal(t, time.Hour, info.Config.MaxAge)
+	}
+
+	// Existing stream is updated
+	assert.NoError(t, store.Retention.SetRetention("general", RetentionPolicy{MaxAge: 24 * time.Hour}))
+
+	info, err = js.StreamInfo(chitchat.ChannelStreamName("general"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(-1), info.Config.MaxMsgsPerSubject)
+		assert.Equal(t, 24*time.Hour, info.Config.MaxAge)
+	}
+
+	policy, err := store.Retention.Retention("general")
+	assert.NoError(t, err)
+	assert.Equal(t, RetentionPolicy{MaxAge: 24 * time.Hour}, policy)
+
+	// Policy isn't loaded for the ready stream
+	assert.NoError(t, js.DeleteKeyValue(chitchat.RetentionBucket))
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(NewUser("Jon Snow", ""), time.Now(), "hello")))
+}
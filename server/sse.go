@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Default configuration for SSE connections.
+const (
+	// Client reconnection time sent with the stream.
+	sseRetry = 3 * time.Second
+
+	// Pending events buffer per SSE connection.
+	sseBuffer = 64
+)
+
+// Events stream channel events over Server-Sent Events.
+// Each event id is a stream sequence, so on reconnect EventSource sends Last-Event-ID
+// and client gets all missed events. Initial position could be set by "last_event_id" query param.
+//
+//	const events = new EventSource("/channel/events?token=" + token);
+//	events.onmessage = (event) => console.log(JSON.parse(event.data));
+func (h channelHandler) Events(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
+
+	// Start from the next event after last seen or from new ones
+	opts := SubscribeOptions{}
+
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if len(lastEventID) == 0 {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+
+	if len(lastEventID) > 0 {
+		seq, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID is not valid")
+		}
+
+		opts.StartSeq = seq + 1
+	}
+
+	presence := Join(h.store, auth.Channel, auth.User)
+	defer presence.Leave()
+
+	events := make(chan Event, sseBuffer)
+
+	// Sequence of the first event dropped on full buffer, stream is closed before it,
+	// so EventSource reconnects from the last written event and gets the rest.
+	var dropped atomic.Uint64
+	overflow := make(chan bool, 1)
+
+	sub, err := h.store.Broker.Subscribe(auth.Channel, opts, func(e Event) {
+		select {
+		case events <- e:
+		default:
+			if dropped.CompareAndSwap(0, e.Seq) {
+				overflow <- true
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// Disable proxy buffering, eg. for nginx
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(res, "retry: %d\n\n", sseRetry.Milliseconds())
+	res.Flush()
+
+	// write event, false if stream should be closed
+	write := func(e Event) bool {
+		if d := dropped.Load(); d > 0 && e.Seq >= d {
+			return false
+		}
+
+		fmt.Fprintf(res, "id: %d\ndata: %s\n\n", e.Seq, e.Data)
+		res.Flush()
+
+		return !isKick(e, auth.User)
+	}
+
+	// Keep connection alive through proxies
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-h.hub.done:
+			return nil
+		case <-ticker.C:
+			fmt.Fprint(res, ": ping\n\n")
+			res.Flush()
+		case e := <-events:
+			if !write(e) {
+				return nil
+			}
+		case <-overflow:
+			// Write events before the dropped one and close
+			for {
+				select {
+				case e := <-events:
+					if !write(e) {
+						return nil
+					}
+				default:
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// PostMessage publish text message to the channel, for clients without WebSocket.
+func (h channelHandler) PostMessage(c echo.Context) error {
+	auth := ExtactAuth(c)
+
+	text := c.FormValue("text")
+	if len(text) == 0 {
+		return echo.NewHTTPError(http.StatusUnprocessableEntity, "Text can't be blank")
+	}
+
+	if err := h.hub.limits.Check(auth.Channel, text); err != nil {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	banned, err := h.store.Bans.IsBanned(auth.Channel, auth.User.Id)
+	if err != nil {
+		return err
+	}
+
+	if banned {
+		return echo.NewHTTPError(http.StatusForbidden, "You are banned in this channel")
+	}
+
+	// Retries with the same Idempotency-Key are stored once
+	msg, duplicate, err := SendMessage(h.store, auth.Channel, auth.User, text, c.Request().Header.Get("Idempotency-Key"))
+	if err != nil {
+		c.Logger().Errorf("Publish error: %v", err)
+
+		return echo.NewHTTPError(http.StatusServiceUnavailable, ErrMessageNotSent.Error())
+	}
+
+	if duplicate {
+		return c.JSON(http.StatusOK, msg)
+	}
+
+	return c.JSON(http.StatusCreated, msg)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSSE open events stream of the user in "general" channel, query is appended to the path.
+func testSSE(t *testing.T, h *channelHandler, user *User, query, lastEventID string) *http.Response {
+	e := echo.New()
+	e.GET("/channel/events", h.Events, func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set("token", &jwt.Token{Claims: &Auth{User: user, Channel: "general"}})
+			return next(c)
+		}
+	})
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/channel/events"+query, nil)
+	if len(lastEventID) > 0 {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	res, err := client.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { res.Body.Close() })
+
+	return res
+}
+
+// testSSEEvent is a parsed Server-Sent Event.
+type testSSEEvent struct {
+	Id  string
+	Msg ChannelMessage
+}
+
+// testReadSSE read events until one of the type, blocks without data have empty type, eg. retry.
+// Nil is returned when stream is closed.
+func testReadSSE(t *testing.T, r *bufio.Reader, messageType string) *testSSEEvent {
+	e := &testSSEEvent{}
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			e.Id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &e.Msg))
+		case len(line) == 0:
+			if e.Msg.Type == messageType {
+				return e
+			}
+
+			e = &testSSEEvent{}
+		}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	res := testSSE(t, h, user, "", "")
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get(echo.HeaderContentType))
+
+	r := bufio.NewReader(res.Body)
+
+	// Retry is written once events are subscribed
+	testReadSSE(t, r, "")
+
+	ack, err := store.Broker.PublishAck("general", EventMessage, NewChannelMessage(user, time.Now(), "hello"), PublishOptions{})
+	assert.NoError(t, err)
+
+	e := testReadSSE(t, r, chitchat.TypeMessage)
+	if assert.NotNil(t, e) {
+		assert.Equal(t, fmt.Sprint(ack.Seq), e.Id)
+		assert.Equal(t, "hello", e.Msg.Text)
+	}
+}
+
+func TestEventsResume(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	var acks []PublishAck
+
+	for _, text := range []string{"first", "second", "third"} {
+		ack, err := store.Broker.PublishAck("general", EventMessage, NewChannelMessage(user, time.Now(), text), PublishOptions{})
+		assert.NoError(t, err)
+
+		acks = append(acks, ack)
+	}
+
+	// EventSource reconnects with Last-Event-ID header, initial position is set by query param
+	for _, res := range []*http.Response{
+		testSSE(t, h, user, "", fmt.Sprint(acks[0].Seq)),
+		testSSE(t, h, user, fmt.Sprintf("?last_event_id=%d", acks[0].Seq), ""),
+	} {
+		r := bufio.NewReader(res.Body)
+
+		for i, text := range []string{"second", "third"} {
+			e := testReadSSE(t, r, chitchat.TypeMessage)
+			if assert.NotNil(t, e) {
+				assert.Equal(t, fmt.Sprint(acks[i+1].Seq), e.Id)
+				assert.Equal(t, text, e.Msg.Text)
+			}
+		}
+	}
+
+	res := testSSE(t, h, user, "?last_event_id=first", "")
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestEventsKick(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	res := testSSE(t, h, user, "", "")
+	r := bufio.NewReader(res.Body)
+
+	testReadSSE(t, r, "")
+
+	store.Broker.Publish("general", EventPresence, NewChannelKickMessage(NewUser("Ned Stark", ""), time.Now(), user))
+
+	// Kick is written and stream is closed
+	assert.NotNil(t, testReadSSE(t, r, chitchat.TypeKick))
+	assert.Nil(t, testReadSSE(t, r, chitchat.TypeMessage))
+}
+
+func TestEventsBanned(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	store.Bans.(*memoryStore).Ban("general", user.Id)
+
+	res := testSSE(t, h, user, "", "")
+	assert.Equal(t, http.StatusForbidden, res.StatusCode)
+}
+
+func TestEventsOverflow(t *testing.T) {
+	store := NewMemoryStorage()
+	h := testChannelHandler(store)
+	user := NewUser("Jon Snow", "")
+
+	var last PublishAck
+
+	for i := 0; i < sseBuffer+10; i++ {
+		last, _ = store.Broker.PublishAck("general", EventMessage, NewChannelMessage(user, time.Now(), fmt.Sprint(i)), PublishOptions{})
+	}
+
+	// Replay doesn't fit the buffer, stream is closed after buffered events
+	c, rec := testContext(httptest.NewRequest(http.MethodGet, "/channel/events?last_event_id=0", nil), user)
+	assert.NoError(t, h.Events(c))
+
+	ids := strings.Count(rec.Body.String(), "id: ")
+	assert.Equal(t, sseBuffer, ids)
+	assert.Contains(t, rec.Body.String(), fmt.Sprintf("id: %d\n", last.Seq-10))
+	assert.NotContains(t, rec.Body.String(), fmt.Sprintf("id: %d\n", last.Seq-9))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/nats-io/nuid"
+)
+
+// Kinds of channel events, text messages are kept in history, presence ones are not.
+const (
+	EventMessage  = "message"
+	EventPresence = "presence"
+)
+
+// Event is a published channel message with its sequence in the channel log.
+type Event struct {
+	// Sequence of the event, growing, used for resuming subscriptions.
+	Seq uint64
+
+	// Event kind, EventMessage or EventPresence.
+	Kind string
+
+	// JSON encoded ChannelMessage.
+	Data []byte
+}
+
+// SubscribeOptions of Broker subscription.
+type SubscribeOptions struct {
+	// Deliver events starting from the sequence, only new ones if it's zero.
+	StartSeq uint64
+}
+
+// Events published with the same dedup key within the window are stored once, same as JetStream default.
+const dedupWindow = 2 * time.Minute
+
+// PublishOptions of acknowledged publishing.
+type PublishOptions struct {
+	// Events with the same key are stored once within dedupWindow, eg. client retries.
+	DedupKey string
+}
+
+// PublishAck confirm that event is stored.
+type PublishAck struct {
+	// Sequence of the stored event, of the first one for duplicates.
+	Seq uint64
+
+	// Event with the same key is already stored, nothing is published.
+	Duplicate bool
+}
+
+// Subscription to channel events.
+type Subscription interface {
+	Unsubscribe() error
+}
+
+// Broker deliver channel events to all subscribers, on all servers.
+type Broker interface {
+	// Publish channel message of the kind.
+	Publish(channel, kind string, msg ChannelMessage) error
+
+	// PublishAck publish channel message of the kind and return its sequence once it's stored.
+	PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error)
+
+	// Subscribe to all channel events, handler is called for each event in order and should not block.
+	Subscribe(channel string, opts SubscribeOptions, handler func(Event)) (Subscription, error)
+}
+
+// chanHandler send events to the channel, dropping them if it's full, so Broker is never blocked.
+func chanHandler(events chan Event) func(Event) {
+	return func(e Event) {
+		select {
+		case events <- e:
+		default:
+		}
+	}
+}
+
+// ErrMessageNotFound is returned by MessageStore when there is no message with given id.
+var ErrMessageNotFound = errors.New("message not found")
+
+// MessageQuery filter channel history.
+type MessageQuery struct {
+	// Messages sent at or after, all if zero.
+	Since time.Time
+
+	// Messages before the message with this id, for paging back in history.
+	Before string
+
+	// Last messages only, all if zero.
+	Limit int
+}
+
+// MessageStore keep channel history.
+type MessageStore interface {
+	// Messages of the channel in order, with updates applied, see messageHistory.
+	Messages(channel string, query MessageQuery) ([]ChannelMessage, error)
+
+	// Message of the channel by id, with updates applied.
+	Message(channel, id string) (*ChannelMessage, error)
+}
+
+// MessageRecorder is a MessageStore written separately from Broker, eg. SQL database.
+type MessageRecorder interface {
+	MessageStore
+
+	// Record text message or apply update to recorded one.
+	Record(channel string, msg ChannelMessage) error
+}
+
+// recordingBroker record text messages before publishing them.
+type recordingBroker struct {
+	Broker
+
+	recorder MessageRecorder
+}
+
+// Publish record message first, so it's never delivered without being in history.
+// Recorded messages need an id, eg. actions and topics don't have it.
+func (b *recordingBroker) Publish(channel, kind string, msg ChannelMessage) error {
+	_, err := b.PublishAck(channel, kind, msg, PublishOptions{})
+
+	return err
+}
+
+// PublishAck record message first, retried messages have the same id, so they're recorded once.
+// Updates of recorded messages, eg. edits, are recorded after publish, so history isn't changed when it fails.
+func (b *recordingBroker) PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error) {
+	if kind != EventMessage {
+		return b.Broker.PublishAck(channel, kind, msg, opts)
+	}
+
+	if isMessageUpdate(msg) {
+		ack, err := b.Broker.PublishAck(channel, kind, msg, opts)
+		if err != nil {
+			return ack, err
+		}
+
+		return ack, b.recorder.Record(channel, msg)
+	}
+
+	if len(msg.Id) == 0 {
+		msg.Id = nuid.Next()
+	}
+
+	if err := b.record(channel, msg, opts); err != nil {
+		return PublishAck{}, err
+	}
+
+	return b.Broker.PublishAck(channel, kind, msg, opts)
+}
+
+// isMessageUpdate tells if message changes already recorded one.
+func isMessageUpdate(msg ChannelMessage) bool {
+	switch msg.Type {
+	case chitchat.TypeMessageUpdated, chitchat.TypeAttachmentUpdated, chitchat.TypeMessageEdited, chitchat.TypeMessageDeleted:
+		return true
+	}
+
+	return false
+}
+
+func (b *recordingBroker) record(channel string, msg ChannelMessage, opts PublishOptions) error {
+	if len(opts.DedupKey) > 0 {
+		if _, err := b.recorder.Message(channel, msg.Id); err == nil {
+			return nil
+		}
+	}
+
+	return b.recorder.Record(channel, msg)
+}
+
+// WithMessageRecorder keep channel history in recorder, events are still delivered by storage Broker.
+// Recorded history isn't purged, so retention policies are disabled.
+func (s *Storage) WithMessageRecorder(recorder MessageRecorder) {
+	s.Messages = recorder
+	s.Broker = &recordingBroker{Broker: s.Broker, recorder: recorder}
+	s.Retention = nil
+}
+
+// PresenceStore keep users online in channels.
+// User could have many connections, eg. browser tabs, so Join and Leave are called for each of them with connection id.
+// Connections are kept with heartbeats, backends shared by server instances expire ones without them
+// and publish leave message when the last user connection expired, see PresenceConn.
+type PresenceStore interface {
+	// Join put user connection in channel, true if it's the first user connection.
+	Join(channel, connId string, user *User) (bool, error)
+
+	// Heartbeat keep user connection present for PresenceConfig TTL.
+	Heartbeat(channel, connId string, user *User) error
+
+	// Leave remove user connection from channel, true if it was the last user connection.
+	Leave(channel, connId string, user *User) (bool, error)
+
+	// Update present user, eg. on nick change.
+	Update(channel string, user *User) error
+
+	// Users present in the channel.
+	Users(channel string) ([]User, error)
+}
+
+// BanStore keep banned users, bans are managed by chitchatctl.
+type BanStore interface {
+	IsBanned(channel, userId string) (bool, error)
+}
+
+// RetentionStore keep channel history retention policies, backend enforce them.
+type RetentionStore interface {
+	Retention(channel string) (RetentionPolicy, error)
+	SetRetention(channel string, policy RetentionPolicy) error
+}
+
+// Storage is a set of backends used by handlers.
+type Storage struct {
+	Messages MessageStore
+	Broker   Broker
+	Presence PresenceStore
+	Bans     BanStore
+
+	// Channel history retention, nil if backend doesn't support it.
+	Retention RetentionStore
+
+	// Interval of connections heartbeats, zero if backend doesn't expire connections.
+	PresenceHeartbeat time.Duration
+}
+
+// messageHistory build channel history from text messages, folding updates into original messages.
+type messageHistory struct {
+	messages []ChannelMessage
+
+	// Index of the message by attachment and message id, to apply updates
+	attachments map[string]int
+	ids         map[string]int
+
+	// Indexes of deleted messages, they are skipped in result
+	deleted map[int]bool
+}
+
+func newMessageHistory() *messageHistory {
+	return &messageHistory{
+		attachments: make(map[string]int),
+		ids:         make(map[string]int),
+		deleted:     make(map[int]bool),
+	}
+}
+
+// result messages without deleted ones.
+func (h *messageHistory) result() []ChannelMessage {
+	if len(h.deleted) == 0 {
+		return h.messages
+	}
+
+	var messages []ChannelMessage
+
+	for i, msg := range h.messages {
+		if !h.deleted[i] {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages
+}
+
+// add message to history or apply it to the original one if it's an update.
+func (h *messageHistory) add(msg ChannelMessage) {
+	if msg.Attachment != nil {
+		if msg.Type == chitchat.TypeAttachmentUpdated {
+			if i, ok := h.attachments[msg.Attachment.Id]; ok {
+				h.messages[i].Attachment = msg.Attachment
+			}
+
+			return
+		}
+
+		h.attachments[msg.Attachment.Id] = len(h.messages)
+	}
+
+	switch msg.Type {
+	case chitchat.TypeMessageUpdated:
+		if i, ok := h.ids[msg.Id]; ok {
+			h.messages[i].Previews = msg.Previews
+		}
+
+		return
+	case chitchat.TypeMessageEdited:
+		if i, ok := h.ids[msg.Id]; ok {
+			applyEdit(&h.messages[i], msg)
+		}
+
+		return
+	case chitchat.TypeMessageDeleted:
+		if i, ok := h.ids[msg.Id]; ok {
+			h.deleted[i] = true
+		}
+
+		return
+	}
+
+	if len(msg.Id) > 0 {
+		h.ids[msg.Id] = len(h.messages)
+	}
+
+	h.messages = append(h.messages, msg)
+}
+
+// applyEdit put edited text in the message.
+func applyEdit(msg *ChannelMessage, edit ChannelMessage) {
+	editedAt := edit.SentAt
+
+	msg.Text = edit.Text
+	msg.EditedAt = &editedAt
+}
+
+// pageMessages apply Before and Limit of the query to the channel history.
+func pageMessages(messages []ChannelMessage, query MessageQuery) []ChannelMessage {
+	if len(query.Before) > 0 {
+		i := findMessage(messages, query.Before)
+		if i < 0 {
+			return nil
+		}
+
+		messages = messages[:i]
+	}
+
+	if query.Limit > 0 && len(messages) > query.Limit {
+		messages = messages[len(messages)-query.Limit:]
+	}
+
+	return messages
+}
+
+// findMessage index by id, -1 if there is no such message.
+func findMessage(messages []ChannelMessage, id string) int {
+	for i := range messages {
+		if messages[i].Id == id {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// lookupMessage find message by id in the whole channel history, for stores without index.
+func lookupMessage(store MessageStore, channel, id string) (*ChannelMessage, error) {
+	messages, err := store.Messages(channel, MessageQuery{})
+	if err != nil {
+		return nil, err
+	}
+
+	i := findMessage(messages, id)
+	if i < 0 {
+		return nil, ErrMessageNotFound
+	}
+
+	return &messages[i], nil
+}
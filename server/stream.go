@@ -1,82 +1,544 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
 	"github.com/nats-io/nats.go"
 )
 
-const StreamName = "CHITCHAT"
+// StreamName of channels stream, see chitchat package for subjects naming.
+const StreamName = chitchat.StreamName
 
-// NewStream connect to Nats and create new JetStream stream
+// StreamTopology is a way channels are kept in JetStream.
+type StreamTopology string
+
+const (
+	// TopologyShared keep all channels in one stream, subject per channel.
+	TopologyShared StreamTopology = "shared"
+
+	// TopologyChannel keep each channel in own stream with own limits, created with the first channel event.
+	TopologyChannel StreamTopology = "channel"
+)
+
+// StreamConfig configure channels streams.
+type StreamConfig struct {
+	Topology StreamTopology
+
+	// Limits of each channel stream, zero is unlimited.
+	MaxAge   time.Duration
+	MaxBytes int64
+	Replicas int
+
+	// Maximum channels with streams or presence buckets, zero is unlimited.
+	// Servers check it before creating a new channel, so it could be exceeded by concurrent ones a bit.
+	MaxChannels int
+}
+
+var (
+	// ErrInvalidChannel is returned for channel names not allowed in subjects and stream names, see chitchat.ValidChannel.
+	ErrInvalidChannel = errors.New("Channel name is not valid")
+
+	// ErrTooManyChannels is returned when a new channel would exceed StreamConfig.MaxChannels.
+	ErrTooManyChannels = errors.New("Too many channels")
+)
+
+// DefaultStreamConfig keep all channels in one stream.
+var DefaultStreamConfig = StreamConfig{Topology: TopologyShared}
+
+// ParseStreamConfig override default config with topology, channel stream limits and channels limit if they set.
+// Stream limits are applied only to streams of the channel topology.
+func ParseStreamConfig(topology, maxAge, maxBytes, replicas, maxChannels string) (StreamConfig, error) {
+	config := DefaultStreamConfig
+
+	if len(topology) > 0 {
+		switch t := StreamTopology(topology); t {
+		case TopologyShared, TopologyChannel:
+			config.Topology = t
+		default:
+			return config, fmt.Errorf("invalid stream topology %q", topology)
+		}
+	}
+
+	if len(maxAge) > 0 {
+		age, err := time.ParseDuration(maxAge)
+		if err != nil || age < 0 {
+			return config, fmt.Errorf("invalid channel stream max age %q", maxAge)
+		}
+
+		config.MaxAge = age
+	}
+
+	if len(maxBytes) > 0 {
+		size, err := strconv.ParseInt(maxBytes, 10, 64)
+		if err != nil || size < 0 {
+			return config, fmt.Errorf("invalid channel stream max bytes %q", maxBytes)
+		}
+
+		config.MaxBytes = size
+	}
+
+	if len(replicas) > 0 {
+		n, err := strconv.Atoi(replicas)
+		if err != nil || n < 1 || n > 5 {
+			return config, fmt.Errorf("invalid channel stream replicas %q", replicas)
+		}
+
+		config.Replicas = n
+	}
+
+	if len(maxChannels) > 0 {
+		n, err := strconv.Atoi(maxChannels)
+		if err != nil || n < 0 {
+			return config, fmt.Errorf("invalid max channels %q", maxChannels)
+		}
+
+		config.MaxChannels = n
+	}
+
+	return config, nil
+}
+
+// channelStream config of the channel stream, same subjects as in the shared stream.
+// Channel retention policy override deployment limits.
+func (c StreamConfig) channelStream(channel string, policy RetentionPolicy) *nats.StreamConfig {
+	maxAge, maxBytes := c.MaxAge, c.MaxBytes
+
+	if policy.MaxAge > 0 {
+		maxAge = policy.MaxAge
+	}
+
+	if policy.MaxBytes > 0 {
+		maxBytes = policy.MaxBytes
+	}
+
+	if maxBytes == 0 {
+		maxBytes = -1
+	}
+
+	maxMessages := policy.MaxMessages
+	if maxMessages == 0 {
+		maxMessages = -1
+	}
+
+	return &nats.StreamConfig{
+		Name:     chitchat.ChannelStreamName(channel),
+		Subjects: []string{chitchat.ChannelSubject(channel)},
+		MaxAge:   maxAge,
+		MaxBytes: maxBytes,
+		Replicas: c.Replicas,
+
+		// Messages and presence events are limited separately
+		MaxMsgsPerSubject: maxMessages,
+	}
+}
+
+// streamName of the channel events.
+func (c StreamConfig) streamName(channel string) string {
+	if c.Topology == TopologyChannel {
+		return chitchat.ChannelStreamName(channel)
+	}
+
+	return StreamName
+}
+
+// NewStream create new JetStream streams and buckets on Nats connection
 // There is a few models that we could use Streams for chat:
 // - Stream per channel - could be usefull with massive channels, expensive
 // - One stream, Subject per channel - lightwight solution, but could reach JetStream limits
 // See https://docs.nats.io/using-nats/developer/develop_jetstream/model_deep_dive
-func NewStream() (nats.JetStreamContext, error) {
-	nc, err := nats.Connect(os.Getenv("NATS_URL"))
+// Both are supported, see StreamConfig. Channel streams are created by jetStreamStore.
+// Existing streams and buckets are updated to the config, see JetStream.
+func NewStream(nc *nats.Conn, streams StreamConfig, config JetStreamConfig, logger echo.Logger) (*JetStream, error) {
+	// Use the JetStream context to produce and consumer messages
+	// that have been persisted.
+	jsc, err := nc.JetStream()
 	if err != nil {
 		return nil, err
 	}
 
-	// Use the JetStream context to produce and consumer messages
-	// that have been persisted.
-	js, err := nc.JetStream()
+	js := &JetStream{
+		JetStreamContext: jsc,
+		nc:               nc,
+		streams:          streams,
+		config:           config,
+		logger:           logger,
+		ready:            make(map[string]bool),
+		buckets:          make(map[string]nats.KeyValue),
+		objects:          make(map[string]nats.ObjectStore),
+	}
+
+	if err := js.bootstrap(); err != nil {
+		return nil, err
+	}
+
+	return js, nil
+}
+
+// jetStreamStore keep channels in JetStream streams, presence and bans in KeyValue buckets.
+// Presence bucket has a key per user connection, see presenceKey, expired ones are followed by presenceWatcher.
+type jetStreamStore struct {
+	js     *JetStream
+	config StreamConfig
+
+	mu sync.Mutex
+
+	// Watchers of channels with connections of this server
+	watchers map[string]*presenceWatcher
+
+	// Join revisions of connections of this server by "<channel>/<presence key>"
+	since map[string]uint64
+
+	// Channels checked by ensureChannel
+	channels map[string]bool
+}
+
+// NewJetStreamStorage build Storage with all backends on top of JetStream.
+func NewJetStreamStorage(js *JetStream) *Storage {
+	s := &jetStreamStore{
+		js:       js,
+		config:   js.streams,
+		watchers: make(map[string]*presenceWatcher),
+		since:    make(map[string]uint64),
+		channels: make(map[string]bool),
+	}
+
+	return &Storage{
+		Messages:  s,
+		Broker:    s,
+		Presence:  s,
+		Bans:      s,
+		Retention: s,
+
+		PresenceHeartbeat: js.config.Presence.Heartbeat,
+	}
+}
+
+// eventSubject of the channel events of the kind.
+func eventSubject(channel, kind string) string {
+	if kind == EventPresence {
+		return chitchat.PresenceSubject(channel)
+	}
+
+	return chitchat.MessageSubject(channel)
+}
+
+// toEvent convert stream message to Event, kind is the last subject token.
+func toEvent(msg *nats.Msg) Event {
+	e := Event{Data: msg.Data, Kind: EventMessage}
+
+	if meta, err := msg.Metadata(); err == nil {
+		e.Seq = meta.Sequence.Stream
+	}
+
+	if strings.HasSuffix(msg.Subject, "."+EventPresence) {
+		e.Kind = EventPresence
+	}
+
+	return e
+}
+
+// ensureChannel check channel name and channels limit before its stream or presence bucket is created.
+// Channels are checked once per process.
+func (s *jetStreamStore) ensureChannel(channel string) error {
+	if !chitchat.ValidChannel(channel) {
+		return ErrInvalidChannel
+	}
+
+	s.mu.Lock()
+	known := s.channels[channel]
+	s.mu.Unlock()
+
+	if known || s.config.MaxChannels == 0 {
+		return nil
+	}
+
+	channels := s.js.Channels()
+	if !channels[channel] && len(channels) >= s.config.MaxChannels {
+		return ErrTooManyChannels
+	}
+
+	s.mu.Lock()
+	s.channels[channel] = true
+	s.mu.Unlock()
+
+	return nil
+}
+
+// presenceBucket of the checked channel.
+func (s *jetStreamStore) presenceBucket(channel string) (nats.KeyValue, error) {
+	if err := s.ensureChannel(channel); err != nil {
+		return nil, err
+	}
+
+	return s.js.PresenceBucket(channel)
+}
+
+// ensureStream create the channel stream with channel topology or update it to config and retention policy.
+// Streams are checked once per process, so policy is loaded only before that.
+func (s *jetStreamStore) ensureStream(channel string) error {
+	if err := s.ensureChannel(channel); err != nil {
+		return err
+	}
+
+	if s.config.Topology != TopologyChannel || s.js.StreamReady(chitchat.ChannelStreamName(channel)) {
+		return nil
+	}
+
+	policy, err := s.Retention(channel)
+	if err != nil {
+		return err
+	}
+
+	return s.js.Stream(s.config.channelStream(channel, policy))
+}
+
+func (s *jetStreamStore) Publish(channel, kind string, msg ChannelMessage) error {
+	_, err := s.PublishAck(channel, kind, msg, PublishOptions{})
+
+	return err
+}
+
+// PublishAck wait for the stream ack, dedup key is passed as Nats-Msg-Id header.
+func (s *jetStreamStore) PublishAck(channel, kind string, msg ChannelMessage, opts PublishOptions) (PublishAck, error) {
+	if err := s.ensureStream(channel); err != nil {
+		return PublishAck{}, err
+	}
+
+	var pubOpts []nats.PubOpt
+	if len(opts.DedupKey) > 0 {
+		pubOpts = append(pubOpts, nats.MsgId(opts.DedupKey))
+	}
+
+	ack, err := PublishMsg(s.js, eventSubject(channel, kind), msg, pubOpts...)
 	if err != nil {
+		return PublishAck{}, err
+	}
+
+	return PublishAck{Seq: ack.Sequence, Duplicate: ack.Duplicate}, nil
+}
+
+// Subscribe create ephemeral stream consumer.
+func (s *jetStreamStore) Subscribe(channel string, opts SubscribeOptions, handler func(Event)) (Subscription, error) {
+	start := nats.DeliverNew()
+	if opts.StartSeq > 0 {
+		start = nats.StartSequence(opts.StartSeq)
+	}
+
+	if err := s.ensureStream(channel); err != nil {
 		return nil, err
 	}
 
-	// Adding a stream is an idempotent function
-	// which means that if a stream does not exist,
-	// it will be created, and if a stream already exists,
-	// then the add operation will succeed only
-	// if the existing stream matches exactly the attributes specified in the 'add' call.
-	// Default Retention policy: LimitsPolicy
-	js.AddStream(&nats.StreamConfig{
-		Name:     StreamName,
-		Subjects: []string{StreamName + ".*.*"},
-		NoAck:    true,
-	})
+	return s.js.Subscribe(chitchat.ChannelSubject(channel), func(msg *nats.Msg) {
+		handler(toEvent(msg))
+	}, start)
+}
 
-	return js, nil
+func (s *jetStreamStore) Messages(channel string, query MessageQuery) ([]ChannelMessage, error) {
+	var opts []nats.SubOpt
+	if !query.Since.IsZero() {
+		opts = append(opts, nats.StartTime(query.Since))
+	}
+
+	if err := s.ensureStream(channel); err != nil {
+		return nil, err
+	}
+
+	messages, err := FetchMessages(s.js, s.config.streamName(channel), channel, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pageMessages(messages, query), nil
+}
+
+func (s *jetStreamStore) Message(channel, id string) (*ChannelMessage, error) {
+	return lookupMessage(s, channel, id)
 }
 
-func GetConsumersDescription(js nats.JetStreamContext) []string {
-	cs := js.ConsumersInfo(StreamName)
+// Join put user connection in presence bucket, it's the first one if no other user connection was present at its revision.
+// Replicas order connections by revisions the same way, so only one of simultaneous first connections is the first.
+// Channel presence is watched while server has connections in it.
+func (s *jetStreamStore) Join(channel, connId string, user *User) (bool, error) {
+	presence, err := s.presenceBucket(channel)
+	if err != nil {
+		return false, err
+	}
+
+	key := presenceKey(user.Id, connId)
+
+	rev, err := putPresence(presence, key, user, 0)
+	if err != nil {
+		return false, err
+	}
 
-	var cd []string
+	s.mu.Lock()
+	s.since[channel+"/"+key] = rev
+	s.mu.Unlock()
 
-	for c := range cs {
-		cd = append(cd, c.Config.Description)
+	if err := s.watch(channel, presence); err != nil {
+		s.Leave(channel, connId, user)
+		return false, err
 	}
 
-	return cd
+	conns, err := userIntervals(presence, user.Id)
+	if err != nil {
+		return false, err
+	}
+
+	return !presentAt(conns, key, rev), nil
 }
 
-// GetPresenceBucket create if not exists and return KeyValue presence bucket.
-func GetPresenceBucket(js nats.JetStreamContext, channel string) (nats.KeyValue, error) {
-	return js.CreateKeyValue(&nats.KeyValueConfig{
-		Bucket: channel + "-presence",
-	})
+// Heartbeat put user connection again, so it doesn't expire.
+func (s *jetStreamStore) Heartbeat(channel, connId string, user *User) error {
+	presence, err := s.presenceBucket(channel)
+	if err != nil {
+		return err
+	}
+
+	key := presenceKey(user.Id, connId)
+
+	s.mu.Lock()
+	since := s.since[channel+"/"+key]
+	s.mu.Unlock()
+
+	_, err = putPresence(presence, key, user, since)
+
+	return err
 }
 
-// Generate subject based on channel and message
-func subject(c, m string) string {
-	return fmt.Sprintf("%s.%s.%s", StreamName, c, m)
+// Leave delete user connection from presence bucket, it's the last one if no other user connection was present
+// at the delete revision, so only one of simultaneous last connections is the last.
+func (s *jetStreamStore) Leave(channel, connId string, user *User) (bool, error) {
+	s.unwatch(channel)
+
+	key := presenceKey(user.Id, connId)
+
+	s.mu.Lock()
+	delete(s.since, channel+"/"+key)
+	s.mu.Unlock()
+
+	presence, err := s.presenceBucket(channel)
+	if err != nil {
+		return false, err
+	}
+
+	if err := presence.Delete(key); err != nil {
+		return false, err
+	}
+
+	conns, err := userIntervals(presence, user.Id)
+	if err != nil {
+		return false, err
+	}
+
+	// Delete marker is always there, but without it any present connection counts
+	rev := uint64(math.MaxUint64)
+	if conn, ok := conns[key]; ok && conn.end > 0 {
+		rev = conn.end
+	}
+
+	return !presentAt(conns, key, rev), nil
 }
 
-// PresenceSubject for presence messages
-func PresenceSubject(channel string) string {
-	return subject(channel, "presence")
+// Update all user connections, eg. on nick change.
+func (s *jetStreamStore) Update(channel string, user *User) error {
+	presence, err := s.presenceBucket(channel)
+	if err != nil {
+		return err
+	}
+
+	conns, err := userIntervals(presence, user.Id)
+	if err != nil {
+		return err
+	}
+
+	for key, conn := range conns {
+		if conn.end > 0 {
+			continue
+		}
+
+		if _, err := putPresence(presence, key, user, conn.since); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
-// MessageSubject for text messages
-func MessageSubject(channel string) string {
-	return subject(channel, "message")
+func (s *jetStreamStore) Users(channel string) ([]User, error) {
+	presence, err := s.presenceBucket(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetPresentUsers(presence)
 }
 
-// ChannelSubject for all channel messages
-func ChannelSubject(channel string) string {
-	return subject(channel, "*")
+// IsBanned check if user is banned in channel.
+func (s *jetStreamStore) IsBanned(channel, userId string) (bool, error) {
+	bans, err := s.js.BansBucket()
+	if err != nil {
+		return false, err
+	}
+
+	_, err = bans.Get(chitchat.BanKey(channel, userId))
+	if err == nats.ErrKeyNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// PublishMsg marshal channel message, publish it to the subject and wait for the stream ack.
+func PublishMsg(js nats.JetStreamContext, subject string, msg ChannelMessage, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return js.Publish(subject, data, opts...)
+}
+
+// FetchMessages read text messages of the channel from the stream.
+func FetchMessages(js nats.JetStreamContext, stream, channel string, opts ...nats.SubOpt) ([]ChannelMessage, error) {
+	sub, err := js.SubscribeSync(chitchat.MessageSubject(channel), append([]nats.SubOpt{nats.OrderedConsumer()}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Unsubscribe()
+
+	info, err := js.StreamInfo(stream)
+	if err != nil {
+		return nil, err
+	}
+	// We need to know how much to iterate until the end
+	lastSeq := info.State.LastSeq
+
+	// Geeting all messages from the stream
+	history := newMessageHistory()
+
+	for i := uint64(0); i < lastSeq; i++ {
+		m, err := sub.NextMsg(1 * time.Second)
+		if err != nil {
+			break
+		}
+
+		msg := ChannelMessage{}
+		if err := json.Unmarshal(m.Data, &msg); err != nil {
+			return nil, err
+		}
+
+		history.add(msg)
+	}
+
+	return history.result(), nil
 }
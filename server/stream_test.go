@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseStreamConfig(t *testing.T) {
+	config, err := ParseStreamConfig("", "", "", "", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultStreamConfig, config)
+
+	config, err = ParseStreamConfig("channel", "720h", "1048576", "3", "1000")
+	assert.NoError(t, err)
+	assert.Equal(t, StreamConfig{Topology: TopologyChannel, MaxAge: 720 * time.Hour, MaxBytes: 1048576, Replicas: 3, MaxChannels: 1000}, config)
+
+	_, err = ParseStreamConfig("subject", "", "", "", "")
+	assert.Error(t, err)
+
+	_, err = ParseStreamConfig("", "month", "", "", "")
+	assert.Error(t, err)
+
+	_, err = ParseStreamConfig("", "", "", "7", "")
+	assert.Error(t, err)
+
+	_, err = ParseStreamConfig("", "", "", "", "many")
+	assert.Error(t, err)
+}
+
+func TestChannelStreams(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	config := StreamConfig{Topology: TopologyChannel, MaxAge: time.Hour}
+
+	js, err := testNewStream(t, embedded.URL(), config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store := NewJetStreamStorage(js)
+
+	// Stream is created with the channel
+	sub, err := store.Broker.Subscribe("general", SubscribeOptions{}, func(Event) {})
+	if assert.NoError(t, err) {
+		sub.Unsubscribe()
+	}
+
+	info, err := js.StreamInfo(chitchat.ChannelStreamName("general"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{chitchat.ChannelSubject("general")}, info.Config.Subjects)
+		assert.Equal(t, time.Hour, info.Config.MaxAge)
+	}
+
+	messages, err := store.Messages.Messages("lobby", MessageQuery{})
+	assert.NoError(t, err)
+	assert.Len(t, messages, 0)
+
+}
+
+func TestChannelsLimit(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	config := StreamConfig{Topology: TopologyChannel, MaxChannels: 2}
+
+	js, err := testNewStream(t, embedded.URL(), config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store := NewJetStreamStorage(js)
+	user := NewUser("Jon Snow", "")
+
+	// Channels are counted by streams and presence buckets
+	assert.NoError(t, store.Broker.Publish("general", EventMessage, NewChannelMessage(user, time.Now(), "hello")))
+
+	lobby := Join(store, "lobby", user)
+	assert.True(t, lobby.Joined())
+	lobby.Leave()
+
+	assert.Equal(t, ErrTooManyChannels, store.Broker.Publish("random", EventMessage, NewChannelMessage(user, time.Now(), "hello")))
+	assert.Equal(t, ErrInvalidChannel, store.Broker.Publish("general.*", EventMessage, NewChannelMessage(user, time.Now(), "hello")))
+
+	// Existing channels are still available to other servers
+	js, err = testNewStream(t, embedded.URL(), config)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store = NewJetStreamStorage(js)
+	assert.NoError(t, store.Broker.Publish("lobby", EventMessage, NewChannelMessage(user, time.Now(), "hello")))
+}
+
+func TestChannelStreamsSharedExists(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	_, err = testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	assert.NoError(t, err)
+
+	// Shared stream should be migrated first, its subjects overlap with channel streams
+	_, err = testNewStream(t, embedded.URL(), StreamConfig{Topology: TopologyChannel})
+	assert.Error(t, err)
+}
+
+func TestJetStreamSendMessageDedup(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err := testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	testSendMessageDedup(t, NewJetStreamStorage(js))
+}
+
+// testJetStreamReplicas build storages of server instances sharing NATS.
+func testJetStreamReplicas(t *testing.T, url string, config JetStreamConfig, n int) []*Storage {
+	var stores []*Storage
+
+	for i := 0; i < n; i++ {
+		nc, err := nats.Connect(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(nc.Close)
+
+		js, err := NewStream(nc, DefaultStreamConfig, config, log.New("test"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stores = append(stores, NewJetStreamStorage(js))
+	}
+
+	return stores
+}
+
+func TestJetStreamPresenceReplicas(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	stores := testJetStreamReplicas(t, embedded.URL(), DefaultJetStreamConfig, 2)
+	user := NewUser("Jon Snow", "")
+
+	// Each round user connects to both servers at once, and disconnects the same way
+	for round := 0; round < 5; round++ {
+		var wg sync.WaitGroup
+		var joined, left [2]bool
+
+		for i := range stores {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				joined[i], _ = stores[i].Presence.Join("general", fmt.Sprintf("%d-%d", round, i), user)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.True(t, joined[0] != joined[1], "one join in round %d", round)
+
+		for i := range stores {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				left[i], _ = stores[i].Presence.Leave("general", fmt.Sprintf("%d-%d", round, i), user)
+			}(i)
+		}
+		wg.Wait()
+
+		assert.True(t, left[0] != left[1], "one leave in round %d", round)
+	}
+}
+
+func TestJetStreamPresenceExpire(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	config := DefaultJetStreamConfig
+	config.Presence = PresenceConfig{Heartbeat: 100 * time.Millisecond, TTL: 300 * time.Millisecond}
+
+	// Two server instances
+	stores := testJetStreamReplicas(t, embedded.URL(), config, 2)
+
+	jon, arya := NewUser("Jon Snow", ""), NewUser("Arya Stark", "")
+
+	var mu sync.Mutex
+	var leaves []string
+
+	sub, err := stores[1].Broker.Subscribe("general", SubscribeOptions{}, func(e Event) {
+		msg := ChannelMessage{}
+		json.Unmarshal(e.Data, &msg)
+
+		if msg.Type == chitchat.TypeLeave {
+			mu.Lock()
+			leaves = append(leaves, msg.FromUser.Id)
+			mu.Unlock()
+		}
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Unsubscribe()
+
+	// Jon is on both servers
+	jonFirst := Join(stores[0], "general", jon)
+	assert.True(t, jonFirst.Joined())
+
+	jonSecond := Join(stores[1], "general", jon)
+	assert.False(t, jonSecond.Joined())
+	defer jonSecond.Leave()
+
+	// Arya's connection is on the server which crashed, so there are no heartbeats and leave
+	joined, err := stores[0].Presence.Join("general", "crashed", arya)
+	assert.NoError(t, err)
+	assert.True(t, joined)
+
+	users, err := stores[1].Presence.Users("general")
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+
+	// Jon leaves one server, but he's still on the other
+	assert.False(t, jonFirst.Leave())
+
+	// Both servers watch the channel, leave is published once
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return len(leaves) > 0
+	}, 5*time.Second, config.Presence.Heartbeat)
+
+	time.Sleep(3 * config.Presence.Heartbeat)
+
+	mu.Lock()
+	assert.Equal(t, []string{arya.Id}, leaves)
+	mu.Unlock()
+
+	users, err = stores[0].Presence.Users("general")
+	if assert.NoError(t, err) && assert.Len(t, users, 1) {
+		assert.Equal(t, jon.Id, users[0].Id)
+	}
+}
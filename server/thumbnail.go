@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"time"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Thumbnails generation configuration.
+const (
+	// Durable pull consumer shared by all server instances.
+	thumbnailWorkerName = "thumbnails"
+
+	// Images with more pixels are not decoded, to not run out of memory.
+	maxThumbnailPixels = 50_000_000
+
+	// JPEG quality of thumbnails.
+	thumbnailQuality = 80
+
+	// Blurhash is computed from small image with 4x3 components.
+	blurhashSize        = 32
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+
+	// Time to wait for new jobs before checking for shutdown.
+	thumbnailFetchWait = 5 * time.Second
+
+	// Failed jobs are retried after AckWait, up to MaxDeliver times.
+	thumbnailAckWait    = time.Minute
+	thumbnailMaxDeliver = 3
+)
+
+// Longest side of thumbnails, smaller images get only smaller thumbnails.
+var thumbnailSizes = []int{160, 480}
+
+// errNotImage is a permanent job error, such jobs are not retried.
+var errNotImage = errors.New("attachment is not an image")
+
+// thumbnailJob is an image attachment waiting for previews.
+type thumbnailJob struct {
+	Channel string `json:"channel"`
+	Id      string `json:"id"`
+}
+
+// thumbnailKey of the resized image in BlobStore.
+func thumbnailKey(channel, id string, size int) string {
+	return fmt.Sprintf("%s.%d.jpg", attachmentKey(channel, id), size)
+}
+
+// jobsStreamConfig of work-queue stream for background jobs, it's created by NewStream.
+func jobsStreamConfig() *nats.StreamConfig {
+	return &nats.StreamConfig{
+		Name:      chitchat.JobsStreamName,
+		Subjects:  []string{chitchat.JobsStreamName + ".*"},
+		Retention: nats.WorkQueuePolicy,
+	}
+}
+
+// EnqueueThumbnail ask workers to generate previews of image attachment.
+func EnqueueThumbnail(js nats.JetStreamContext, channel, id string) error {
+	data, err := json.Marshal(thumbnailJob{Channel: channel, Id: id})
+	if err != nil {
+		return err
+	}
+
+	_, err = js.Publish(chitchat.ThumbnailJobSubject, data)
+
+	return err
+}
+
+// ThumbnailWorker generate thumbnails and blurhash of image attachments from jobs stream,
+// then publish attachment_updated message to the channel.
+type ThumbnailWorker struct {
+	stream nats.JetStreamContext
+	store  *Storage
+	blobs  BlobStore
+	logger echo.Logger
+	sub    *nats.Subscription
+	done   chan bool
+}
+
+// NewThumbnailWorker subscribe to thumbnail jobs.
+func NewThumbnailWorker(js nats.JetStreamContext, store *Storage, blobs BlobStore, logger echo.Logger) (*ThumbnailWorker, error) {
+	sub, err := js.PullSubscribe(chitchat.ThumbnailJobSubject, thumbnailWorkerName,
+		nats.AckExplicit(), nats.AckWait(thumbnailAckWait), nats.MaxDeliver(thumbnailMaxDeliver))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ThumbnailWorker{
+		stream: js,
+		store:  store,
+		blobs:  blobs,
+		logger: logger,
+		sub:    sub,
+		done:   make(chan bool),
+	}, nil
+}
+
+// run process jobs one by one until shutdown.
+func (w *ThumbnailWorker) run() {
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		msgs, err := w.sub.Fetch(1, nats.MaxWait(thumbnailFetchWait))
+		if err != nil {
+			if err != nats.ErrTimeout && err != context.DeadlineExceeded {
+				w.logger.Errorf("Thumbnail worker fetch error: %v", err)
+				time.Sleep(thumbnailFetchWait)
+			}
+
+			continue
+		}
+
+		for _, msg := range msgs {
+			job := thumbnailJob{}
+			if err := json.Unmarshal(msg.Data, &job); err != nil {
+				msg.Term()
+				continue
+			}
+
+			if err := w.process(job); err != nil {
+				w.logger.Errorf("Thumbnail job %s/%s error: %v", job.Channel, job.Id, err)
+
+				if err == errNotImage || err == ErrBlobNotFound {
+					msg.Term()
+				} else {
+					msg.Nak()
+				}
+
+				continue
+			}
+
+			msg.Ack()
+		}
+	}
+}
+
+// Enqueue generating previews of image attachment.
+func (w *ThumbnailWorker) Enqueue(channel, id string) error {
+	return EnqueueThumbnail(w.stream, channel, id)
+}
+
+// Shutdown stop processing jobs, current one is finished or redelivered.
+func (w *ThumbnailWorker) Shutdown() {
+	close(w.done)
+}
+
+// process generate previews, update attachment and notify channel.
+func (w *ThumbnailWorker) process(job thumbnailJob) error {
+	ctx := context.Background()
+
+	attachment, err := LoadAttachment(ctx, w.blobs, job.Channel, job.Id)
+	if err != nil {
+		return err
+	}
+
+	if attachment.Width == 0 || attachment.Height == 0 || attachment.Width*attachment.Height > maxThumbnailPixels {
+		return errNotImage
+	}
+
+	file, err := w.blobs.Get(ctx, attachmentKey(job.Channel, job.Id))
+	if err != nil {
+		return err
+	}
+
+	img, _, err := image.Decode(file)
+	file.Close()
+
+	if err != nil {
+		return errNotImage
+	}
+
+	attachment.Thumbnails = nil
+
+	for _, size := range thumbnailSizes {
+		if size >= attachment.Width && size >= attachment.Height {
+			break
+		}
+
+		thumbnail := resizeImage(img, size)
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return err
+		}
+
+		if err := w.blobs.Put(ctx, thumbnailKey(job.Channel, job.Id, size), &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+			return err
+		}
+
+		bounds := thumbnail.Bounds()
+
+		attachment.Thumbnails = append(attachment.Thumbnails, Thumbnail{
+			Width:  bounds.Dx(),
+			Height: bounds.Dy(),
+			URL:    fmt.Sprintf("%s/thumbnails/%d", attachment.URL, size),
+		})
+	}
+
+	attachment.Blurhash, err = blurhash.Encode(blurhashComponentsX, blurhashComponentsY, resizeImage(img, blurhashSize))
+	if err != nil {
+		return err
+	}
+
+	if err := SaveAttachment(ctx, w.blobs, job.Channel, attachment); err != nil {
+		return err
+	}
+
+	// Job is retried if channel isn't notified
+	return w.store.Broker.Publish(job.Channel, EventMessage, NewChannelAttachmentUpdatedMessage(time.Now(), attachment))
+}
+
+// resizeImage fit image into size x size square keeping aspect ratio.
+// Transparent images are put on white background, JPEG has no alpha.
+func resizeImage(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width >= height {
+		width, height = size, max(1, height*size/width)
+	} else {
+		width, height = max(1, width*size/height), size
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+
+	return dst
+}
+
+// NewChannelAttachmentUpdatedMessage build new attachment_updated ChannelMessage with updated Attachment.
+func NewChannelAttachmentUpdatedMessage(sentAt time.Time, attachment *Attachment) ChannelMessage {
+	return ChannelMessage{
+		Type:       chitchat.TypeAttachmentUpdated,
+		SentAt:     sentAt,
+		Attachment: attachment,
+	}
+}
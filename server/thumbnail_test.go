@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResizeImage(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 1000, 500))
+
+	thumbnail := resizeImage(img, 160)
+	assert.Equal(t, image.Rect(0, 0, 160, 80), thumbnail.Bounds())
+
+	// Transparent pixels are white, JPEG has no alpha
+	r, g, b, a := thumbnail.At(10, 10).RGBA()
+	assert.Equal(t, []uint32{0xffff, 0xffff, 0xffff, 0xffff}, []uint32{r, g, b, a})
+
+	thumbnail = resizeImage(image.NewNRGBA(image.Rect(0, 0, 10, 1000)), 160)
+	assert.Equal(t, image.Rect(0, 0, 1, 160), thumbnail.Bounds())
+}
+
+func TestThumbnailBlurhash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.NRGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+
+	hash, err := blurhash.Encode(blurhashComponentsX, blurhashComponentsY, resizeImage(img, blurhashSize))
+	assert.Nil(t, err)
+	assert.NotEmpty(t, hash)
+}
+
+func TestHasThumbnail(t *testing.T) {
+	attachment := &Attachment{Thumbnails: []Thumbnail{{URL: "/attachments/abc/thumbnails/160"}}}
+
+	assert.True(t, hasThumbnail(attachment, 160))
+	assert.False(t, hasThumbnail(attachment, 16))
+	assert.False(t, hasThumbnail(attachment, 480))
+}
+
+func TestThumbnailNotSent(t *testing.T) {
+	blobs, err := NewDiskBlobStore(t.TempDir())
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 300, 200))))
+	assert.NoError(t, blobs.Put(ctx, attachmentKey("general", "abc"), &buf, int64(buf.Len()), "image/png"))
+	assert.NoError(t, SaveAttachment(ctx, blobs, "general", &Attachment{Id: "abc", Width: 300, Height: 200}))
+
+	store := NewMemoryStorage()
+	store.Broker = failingBroker{store.Broker}
+
+	w := &ThumbnailWorker{store: store, blobs: blobs, logger: log.New("test")}
+
+	// Error is returned, so job is retried
+	assert.Error(t, w.process(thumbnailJob{Channel: "general", Id: "abc"}))
+}
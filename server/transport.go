@@ -0,0 +1,208 @@
+package main
+
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport is a consumer connection to the client, eg. WebSocket or WebTransport session.
+// It carries the same channel protocol: channel events to the client, texts and commands from it.
+type Transport interface {
+	// ReadMessage block until the next client message.
+	ReadMessage() ([]byte, error)
+
+	// WriteMessage send JSON channel event to the client, encoded to the wire format if any.
+	WriteMessage(data []byte) error
+
+	// WriteMessages send several pending events at once.
+	WriteMessages(messages [][]byte) error
+
+	// Ping client to keep connection alive.
+	Ping() error
+
+	// Close connection with WebSocket close code and reason.
+	Close(code int, reason string) error
+}
+
+// EventTransport is a Transport which sends stream sequence with each event, eg. gRPC ChatEvent id.
+type EventTransport interface {
+	Transport
+
+	// WriteEvents send pending events with their sequences, zero for replies.
+	WriteEvents(messages [][]byte, seqs []uint64) error
+}
+
+// DatagramTransport is a Transport with unreliable datagrams, used for volatile events like typing.
+type DatagramTransport interface {
+	Transport
+
+	SendDatagram(data []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// WSConfig tune WebSocket connections.
+type WSConfig struct {
+	// Read and write buffers size.
+	BufferSize int
+
+	// permessage-deflate level, from flate.HuffmanOnly to flate.BestCompression, flate.NoCompression disables it.
+	CompressionLevel int
+
+	// Messages smaller than threshold are sent uncompressed.
+	CompressionThreshold int
+}
+
+// DefaultWSConfig is a fast compression for messages worth it.
+var DefaultWSConfig = WSConfig{
+	BufferSize:           4096,
+	CompressionLevel:     flate.BestSpeed,
+	CompressionThreshold: 256,
+}
+
+// ParseWSConfig override default config with compression level and threshold if they set.
+func ParseWSConfig(level, threshold string) (WSConfig, error) {
+	config := DefaultWSConfig
+
+	if len(level) > 0 {
+		l, err := strconv.Atoi(level)
+		if err != nil || l < flate.HuffmanOnly || l > flate.BestCompression {
+			return config, fmt.Errorf("invalid compression level %q", level)
+		}
+
+		config.CompressionLevel = l
+	}
+
+	if len(threshold) > 0 {
+		t, err := strconv.Atoi(threshold)
+		if err != nil || t < 0 {
+			return config, fmt.Errorf("invalid compression threshold %q", threshold)
+		}
+
+		config.CompressionThreshold = t
+	}
+
+	return config, nil
+}
+
+// NewUpgrader build WebSocket upgrader for config.
+func NewUpgrader(config WSConfig) websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  config.BufferSize,
+		WriteBufferSize: config.BufferSize,
+		// Write buffers are shared between connections, idle ones don't hold them
+		WriteBufferPool:   &sync.Pool{},
+		EnableCompression: config.CompressionLevel != flate.NoCompression,
+		// Wire formats, see codec.go
+		Subprotocols: Subprotocols,
+		// For dev purpose only: if u want to skip origin checking
+		// CheckOrigin: func(r *http.Request) bool { return true },
+	}
+}
+
+// wsTransport is a WebSocket Transport.
+type wsTransport struct {
+	ws *websocket.Conn
+
+	// Wire format negotiated by subprotocol.
+	codec Codec
+
+	// Send several events in one frame.
+	batch bool
+
+	// Compress messages from this size, zero disables compression.
+	compressionThreshold int
+}
+
+// NewWSTransport wrap WebSocket connection, setting read limits, compression and pong handler.
+// Frames bigger than maxFrameSize close the connection with 1009.
+// Wire format is picked by negotiated subprotocol, see Subprotocols.
+// With batch several pending events are sent in one frame, delimited by the codec.
+func NewWSTransport(ws *websocket.Conn, config WSConfig, batch bool) *wsTransport {
+	ws.SetReadLimit(maxFrameSize)
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPongHandler(func(string) error { ws.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+
+	t := &wsTransport{
+		ws:    ws,
+		codec: GetCodec(ws.Subprotocol()),
+		batch: batch,
+	}
+
+	if config.CompressionLevel != flate.NoCompression && ws.SetCompressionLevel(config.CompressionLevel) == nil {
+		t.compressionThreshold = config.CompressionThreshold
+	}
+
+	return t
+}
+
+// ReadMessage read the next frame, one bigger than maxMessageSize is discarded with ErrMessageTooBig.
+func (t *wsTransport) ReadMessage() ([]byte, error) {
+	_, r, err := t.ws.NextReader()
+	if err != nil {
+		return nil, err
+	}
+
+	return readMessage(r)
+}
+
+func (t *wsTransport) WriteMessage(data []byte) error {
+	return t.WriteMessages([][]byte{data})
+}
+
+// WriteMessages send events in one frame for batch transport, one by one otherwise.
+func (t *wsTransport) WriteMessages(messages [][]byte) error {
+	encoded := make([][]byte, 0, len(messages))
+
+	for _, data := range messages {
+		data, err := t.codec.Encode(data)
+		if err != nil {
+			return err
+		}
+
+		encoded = append(encoded, data)
+	}
+
+	if t.batch {
+		return t.writeFrame(t.codec.Batch(encoded))
+	}
+
+	for _, data := range encoded {
+		if err := t.writeFrame(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFrame write single frame, compressed if it's big enough.
+func (t *wsTransport) writeFrame(data []byte) error {
+	messageType := websocket.TextMessage
+	if t.codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	t.ws.EnableWriteCompression(t.compressionThreshold > 0 && len(data) >= t.compressionThreshold)
+	t.ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return t.ws.WriteMessage(messageType, data)
+}
+
+func (t *wsTransport) Ping() error {
+	t.ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return t.ws.WriteMessage(websocket.PingMessage, nil)
+}
+
+// Close send close frame, empty one for websocket.CloseNoStatusReceived code.
+func (t *wsTransport) Close(code int, reason string) error {
+	t.ws.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return t.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"compress/flate"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/gommon/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// testWSTransport serve WebSocket and write messages with server transport.
+func testWSTransport(t *testing.T, config WSConfig, batch bool, messages [][]byte) *websocket.Conn {
+	upgrader := NewUpgrader(config)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		NewWSTransport(ws, config, batch).WriteMessages(messages)
+	}))
+	t.Cleanup(server.Close)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+
+	ws, res, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover", res.Header.Get("Sec-Websocket-Extensions"))
+
+	return ws
+}
+
+// testWSConsumer serve WebSocket with consumer of the user in "general" channel.
+func testWSConsumer(t *testing.T, store *Storage, user *User) *websocket.Conn {
+	hub := NewConsumersHub(DefaultSendQueueConfig, DefaultMessageLimits)
+	go hub.run()
+
+	upgrader := NewUpgrader(DefaultWSConfig)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+
+		consumer := NewConsumer("general", user, NewWSTransport(ws, DefaultWSConfig, false), hub, store, NewCommandsRegistry(nil, nil), log.New("test"))
+		consumer.Register()
+
+		go consumer.Listen()
+	}))
+	t.Cleanup(server.Close)
+
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	return ws
+}
+
+// testReadMessage read channel messages until one of the type.
+func testReadMessage(t *testing.T, ws *websocket.Conn, messageType string) ChannelMessage {
+	for {
+		msg := ChannelMessage{}
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Type == messageType {
+			return msg
+		}
+	}
+}
+
+func TestWSTransportMessageTooBig(t *testing.T) {
+	store := NewMemoryStorage()
+	ws := testWSConsumer(t, store, NewUser("Jon Snow", ""))
+
+	// Oversize paste is discarded and replied with error, connection stays open
+	assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("a", maxMessageSize+1))))
+
+	reply := testReadMessage(t, ws, chitchat.TypeError)
+	assert.Equal(t, ErrMessageTooBig.Error(), reply.Text)
+
+	data, _ := json.Marshal(chitchat.OutgoingMessage{Text: "hello", ClientId: "1"})
+	assert.NoError(t, ws.WriteMessage(websocket.TextMessage, data))
+
+	sent := testReadMessage(t, ws, chitchat.TypeSent)
+	assert.Equal(t, "1", sent.ClientId)
+
+	messages, _ := store.Messages.Messages("general", MessageQuery{})
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "hello", messages[0].Text)
+	}
+}
+
+func TestWSTransportBatch(t *testing.T) {
+	ws := testWSTransport(t, DefaultWSConfig, true, [][]byte{[]byte(`{"text":"one"}`), []byte(`{"text":"two"}`)})
+
+	messageType, data, err := ws.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, websocket.TextMessage, messageType)
+		assert.Equal(t, "{\"text\":\"one\"}\n{\"text\":\"two\"}", string(data))
+	}
+}
+
+func TestWSTransportWithoutBatch(t *testing.T) {
+	ws := testWSTransport(t, DefaultWSConfig, false, [][]byte{[]byte(`{"text":"one"}`), []byte(`{"text":"two"}`)})
+
+	for _, text := range []string{"one", "two"} {
+		_, data, err := ws.ReadMessage()
+		if assert.NoError(t, err) {
+			assert.Equal(t, `{"text":"`+text+`"}`, string(data))
+		}
+	}
+}
+
+func TestWSTransportCompression(t *testing.T) {
+	long := `{"text":"` + strings.Repeat("compress me ", 100) + `"}`
+
+	ws := testWSTransport(t, DefaultWSConfig, false, [][]byte{[]byte(long)})
+
+	_, data, err := ws.ReadMessage()
+	if assert.NoError(t, err) {
+		assert.Equal(t, long, string(data))
+	}
+}
+
+func TestParseWSConfig(t *testing.T) {
+	config, err := ParseWSConfig("", "")
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultWSConfig, config)
+
+	config, err = ParseWSConfig("0", "1024")
+	assert.NoError(t, err)
+	assert.Equal(t, flate.NoCompression, config.CompressionLevel)
+	assert.Equal(t, 1024, config.CompressionThreshold)
+
+	_, err = ParseWSConfig("10", "")
+	assert.Error(t, err)
+
+	_, err = ParseWSConfig("", "-1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+)
+
+// Link unfurling configuration.
+const (
+	// Durable pull consumer of channel messages, shared by all server instances.
+	unfurlWorkerName = chitchat.UnfurlConsumer
+
+	// Maximum previews per message.
+	maxPreviews = 3
+
+	// Maximum messages processed at once.
+	unfurlBatchSize = 8
+
+	// Time to wait for new messages before checking for shutdown.
+	unfurlFetchWait = 5 * time.Second
+
+	// New channel streams are looked up this often.
+	unfurlDiscoverInterval = 30 * time.Second
+
+	// Messages of crashed worker are redelivered after AckWait.
+	unfurlAckWait    = 30 * time.Second
+	unfurlMaxDeliver = 2
+
+	// Previews and failures are cached for a day.
+	previewsTTL = 24 * time.Hour
+)
+
+// Links in message text, trailing punctuation is trimmed later.
+var linkRe = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+// extractLinks return unique links from text, up to maxPreviews.
+func extractLinks(text string) []string {
+	var links []string
+
+	seen := make(map[string]bool)
+
+	for _, link := range linkRe.FindAllString(text, -1) {
+		link = strings.TrimRight(link, ".,;:!?)]}'")
+
+		if seen[link] || len(link) <= len("https://") {
+			continue
+		}
+
+		seen[link] = true
+		links = append(links, link)
+
+		if len(links) == maxPreviews {
+			break
+		}
+	}
+
+	return links
+}
+
+// previewKey of the link in previews bucket, links have characters not allowed in keys.
+func previewKey(link string) string {
+	hash := sha256.Sum256([]byte(link))
+
+	return hex.EncodeToString(hash[:])
+}
+
+// UnfurlWorker read text messages from the stream, fetch previews of their links
+// and publish message_updated message to the channel.
+type UnfurlWorker struct {
+	store   *Storage
+	fetcher *LinkFetcher
+	cache   nats.KeyValue
+	logger  echo.Logger
+	done    chan bool
+
+	js       nats.JetStreamContext
+	topology StreamTopology
+
+	// Pull subscriptions by stream, one for the shared stream or one per channel stream
+	subs map[string]*nats.Subscription
+}
+
+// NewUnfurlWorker subscribe to new messages of all channels.
+func NewUnfurlWorker(js *JetStream, store *Storage, fetcher *LinkFetcher, logger echo.Logger) (*UnfurlWorker, error) {
+	streams := js.streams
+
+	cache, err := js.Bucket(&nats.KeyValueConfig{
+		Bucket: chitchat.PreviewsBucket,
+		TTL:    previewsTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	w := &UnfurlWorker{
+		store:    store,
+		fetcher:  fetcher,
+		cache:    cache,
+		logger:   logger,
+		done:     make(chan bool),
+		js:       js,
+		topology: streams.Topology,
+		subs:     make(map[string]*nats.Subscription),
+	}
+
+	if streams.Topology == TopologyChannel {
+		w.discover()
+
+		return w, nil
+	}
+
+	sub, err := js.PullSubscribe(chitchat.MessageSubject("*"), unfurlWorkerName, nats.DeliverNew(),
+		nats.AckExplicit(), nats.AckWait(unfurlAckWait), nats.MaxDeliver(unfurlMaxDeliver))
+	if err != nil {
+		return nil, err
+	}
+
+	w.subs[StreamName] = sub
+
+	return w, nil
+}
+
+// discover channel streams and subscribe to new ones, returns new subscriptions.
+func (w *UnfurlWorker) discover() []*nats.Subscription {
+	var subs []*nats.Subscription
+
+	for name := range w.js.StreamNames() {
+		if !strings.HasPrefix(name, chitchat.ChannelStreamPrefix) || w.subs[name] != nil {
+			continue
+		}
+
+		sub, err := w.subscribeChannel(name, strings.TrimPrefix(name, chitchat.ChannelStreamPrefix))
+		if err != nil {
+			w.logger.Errorf("Unfurl worker subscribe to %s error: %v", name, err)
+			continue
+		}
+
+		w.subs[name] = sub
+		subs = append(subs, sub)
+	}
+
+	return subs
+}
+
+// subscribeChannel bind to the channel stream consumer or create it.
+func (w *UnfurlWorker) subscribeChannel(stream, channel string) (*nats.Subscription, error) {
+	subject := chitchat.MessageSubject(channel)
+
+	// Migrated streams have consumer starting from new messages, see chitchatctl migrate-streams
+	sub, err := w.js.PullSubscribe(subject, unfurlWorkerName, nats.Bind(stream, unfurlWorkerName))
+	if err != nats.ErrConsumerNotFound {
+		return sub, err
+	}
+
+	// Channel stream is created with the first event, so messages sent before discovery are processed too
+	return w.js.PullSubscribe(subject, unfurlWorkerName, nats.BindStream(stream), nats.DeliverAll(),
+		nats.AckExplicit(), nats.AckWait(unfurlAckWait), nats.MaxDeliver(unfurlMaxDeliver))
+}
+
+// run consume every stream concurrently, so idle channels don't delay busy ones, until shutdown.
+func (w *UnfurlWorker) run() {
+	for _, sub := range w.subs {
+		go w.consume(sub)
+	}
+
+	if w.topology != TopologyChannel {
+		<-w.done
+		return
+	}
+
+	ticker := time.NewTicker(unfurlDiscoverInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			for _, sub := range w.discover() {
+				go w.consume(sub)
+			}
+		}
+	}
+}
+
+// consume process stream messages in batches until shutdown.
+func (w *UnfurlWorker) consume(sub *nats.Subscription) {
+	for {
+		select {
+		case <-w.done:
+			return
+		default:
+		}
+
+		w.fetch(sub, unfurlFetchWait)
+	}
+}
+
+// fetch batch of messages and process them at once.
+func (w *UnfurlWorker) fetch(sub *nats.Subscription, wait time.Duration) {
+	msgs, err := sub.Fetch(unfurlBatchSize, nats.MaxWait(wait))
+	if err != nil {
+		if err != nats.ErrTimeout && err != context.DeadlineExceeded {
+			w.logger.Errorf("Unfurl worker fetch error: %v", err)
+			time.Sleep(wait)
+		}
+
+		return
+	}
+
+	var wg sync.WaitGroup
+
+	for _, msg := range msgs {
+		wg.Add(1)
+
+		go func(msg *nats.Msg) {
+			defer wg.Done()
+
+			// Message is redelivered if previews aren't published
+			if err := w.process(msg); err != nil {
+				w.logger.Errorf("Unfurl publish error: %v", err)
+				msg.Nak()
+
+				return
+			}
+
+			msg.Ack()
+		}(msg)
+	}
+
+	wg.Wait()
+}
+
+// Shutdown stop processing messages, current batch is finished or redelivered.
+func (w *UnfurlWorker) Shutdown() {
+	close(w.done)
+}
+
+// process publish previews of the text message links, if any.
+func (w *UnfurlWorker) process(msg *nats.Msg) error {
+	channelMsg := ChannelMessage{}
+	if err := json.Unmarshal(msg.Data, &channelMsg); err != nil {
+		return nil
+	}
+
+	if channelMsg.Type != chitchat.TypeMessage || len(channelMsg.Id) == 0 {
+		return nil
+	}
+
+	var previews []LinkPreview
+
+	for _, link := range extractLinks(channelMsg.Text) {
+		if preview := w.preview(link); preview != nil {
+			previews = append(previews, *preview)
+		}
+	}
+
+	if len(previews) == 0 {
+		return nil
+	}
+
+	// Subject is "CHITCHAT.<channel>.message"
+	channel := strings.TrimSuffix(strings.TrimPrefix(msg.Subject, StreamName+"."), "."+EventMessage)
+
+	return w.store.Broker.Publish(channel, EventMessage, NewChannelMessageUpdatedMessage(time.Now(), channelMsg.Id, previews))
+}
+
+// preview of the link from cache or fetcher, nil if link has no preview.
+func (w *UnfurlWorker) preview(link string) *LinkPreview {
+	key := previewKey(link)
+
+	if entry, err := w.cache.Get(key); err == nil {
+		var preview *LinkPreview
+		if err := json.Unmarshal(entry.Value(), &preview); err == nil {
+			return preview
+		}
+	}
+
+	preview, err := w.fetcher.Fetch(context.Background(), link)
+	if err != nil {
+		w.logger.Debugf("Link preview error: %v", err)
+	}
+
+	// Links without preview are cached as null, so they are not fetched on every message.
+	// Failures like timeouts could be temporary, those links are fetched again.
+	if err != nil && !isNoPreview(err) {
+		return nil
+	}
+
+	data, err := json.Marshal(preview)
+	if err == nil {
+		w.cache.Put(key, data)
+	}
+
+	return preview
+}
+
+// isNoPreview tells if link has no preview for sure, eg. it's not HTML page.
+func isNoPreview(err error) bool {
+	return errors.Is(err, errNotHTML) || errors.Is(err, errForbiddenAddress)
+}
+
+// NewChannelMessageUpdatedMessage build new message_updated ChannelMessage with link previews of the message.
+func NewChannelMessageUpdatedMessage(sentAt time.Time, id string, previews []LinkPreview) ChannelMessage {
+	return ChannelMessage{
+		Id:       id,
+		Type:     chitchat.TypeMessageUpdated,
+		SentAt:   sentAt,
+		Previews: previews,
+	}
+}
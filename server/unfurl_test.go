@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExtractLinks(t *testing.T) {
+	links := extractLinks("Look at https://example.com/a, (https://example.com/b) and https://example.com/a again. http://")
+	assert.Equal(t, []string{"https://example.com/a", "https://example.com/b"}, links)
+
+	links = extractLinks("https://a.com https://b.com https://c.com https://d.com")
+	assert.Len(t, links, maxPreviews)
+
+	assert.Empty(t, extractLinks("no links, ftp://example.com"))
+}
+
+func TestUnfurlPreviewCache(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err := testNewStream(t, embedded.URL(), DefaultStreamConfig)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cache, err := js.Bucket(&nats.KeyValueConfig{Bucket: chitchat.PreviewsBucket})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	server := testFetcherServer()
+	defer server.Close()
+
+	w := &UnfurlWorker{fetcher: testFetcher(), cache: cache, logger: log.New("test")}
+
+	cached := func(link string) bool {
+		_, err := cache.Get(previewKey(link))
+		return err == nil
+	}
+
+	assert.NotNil(t, w.preview(server.URL+"/og"))
+	assert.True(t, cached(server.URL+"/og"))
+
+	// Links without preview are cached
+	assert.Nil(t, w.preview(server.URL+"/untitled"))
+	assert.True(t, cached(server.URL+"/untitled"))
+
+	assert.Nil(t, w.preview(server.URL+"/image.png"))
+	assert.True(t, cached(server.URL+"/image.png"))
+
+	// Failed ones are fetched again
+	assert.Nil(t, w.preview(server.URL+"/missing"))
+	assert.False(t, cached(server.URL+"/missing"))
+}
+
+func TestUnfurlChannelStreams(t *testing.T) {
+	embedded, err := NewEmbeddedNATS("")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer embedded.Shutdown()
+
+	js, err := testNewStream(t, embedded.URL(), StreamConfig{Topology: TopologyChannel})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	store := NewJetStreamStorage(js)
+	user := NewUser("Jon Snow", "")
+
+	// Channel streams are created with the first message
+	channels := []string{"general", "random", "north", "south"}
+	for _, channel := range channels {
+		assert.NoError(t, store.Broker.Publish(channel, EventMessage, NewChannelMessage(user, time.Now(), "hello")))
+	}
+
+	server := testFetcherServer()
+	defer server.Close()
+
+	w, err := NewUnfurlWorker(js, store, testFetcher(), log.New("test"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Len(t, w.subs, len(channels))
+
+	go w.run()
+	defer w.Shutdown()
+
+	updated := make(chan ChannelMessage, 1)
+
+	sub, err := store.Broker.Subscribe("south", SubscribeOptions{}, func(e Event) {
+		msg := ChannelMessage{}
+		if json.Unmarshal(e.Data, &msg) == nil && msg.Type == chitchat.TypeMessageUpdated {
+			updated <- msg
+		}
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer sub.Unsubscribe()
+
+	// Idle channels don't delay the last one
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, store.Broker.Publish("south", EventMessage, NewChannelMessage(user, time.Now(), "Look "+server.URL+"/og")))
+
+	select {
+	case msg := <-updated:
+		assert.Len(t, msg.Previews, 1)
+	case <-time.After(time.Second):
+		t.Error("Previews aren't published")
+	}
+}
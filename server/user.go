@@ -1,38 +1,9 @@
 package main
 
-import (
-	"crypto/md5"
-	"fmt"
-)
+import "github.com/faustman/chitchat/server/chitchat"
 
-type User struct {
-	Id     string `json:"id"`
-	Name   string `json:"name"`
-	Email  string `json:"-"`
-	Avatar string `json:"avatar,omitempty"`
-}
+// User is a channel member, shared with clients.
+type User = chitchat.User
 
-// NewUser will generate new users based on name and email.
-// Id generating by name + email.
-// If email present, Avatar will be fullfiled with Gravatar url.
-func NewUser(name, email string) *User {
-	id := md5.Sum([]byte(name + email))
-
-	user := User{
-		Id:    fmt.Sprintf("%x", id),
-		Name:  name,
-		Email: email,
-	}
-
-	if len(email) > 0 {
-		user.Avatar = generateGravatar(email)
-	}
-
-	return &user
-}
-
-func generateGravatar(email string) string {
-	hashString := []byte(email)
-
-	return fmt.Sprintf("https://www.gravatar.com/avatar/%x?s=128", md5.Sum(hashString))
-}
+// NewUser will generate new users based on name and email, see chitchat.NewUser.
+var NewUser = chitchat.NewUser
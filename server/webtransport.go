@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// Default configuration for WebTransport sessions.
+const (
+	// Client datagram to notify channel that user is typing.
+	typingDatagram = "typing"
+
+	// QUIC keep-alive, idle sessions are closed after 30 seconds by default.
+	wtKeepAlivePeriod = 10 * time.Second
+
+	// Browsers accept self-signed certificates by serverCertificateHashes only if they valid less than 14 days.
+	wtCertValidity = 10 * 24 * time.Hour
+)
+
+// errFrameTooBig is returned for length prefix bigger than maxFrameSize, connection is closed.
+var errFrameTooBig = errors.New("frame is too big")
+
+// wtSession is a part of webtransport.Session used by wtTransport.
+type wtSession interface {
+	Context() context.Context
+	CloseWithError(code webtransport.SessionErrorCode, msg string) error
+	SendDatagram(data []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+}
+
+// wtStream is a part of webtransport.Stream used by wtTransport.
+type wtStream interface {
+	io.ReadWriter
+	SetWriteDeadline(t time.Time) error
+}
+
+// wtTransport is a WebTransport Transport.
+// Channel protocol is carried over bidirectional stream opened by the client,
+// each message is prefixed with its length as QUIC varint. Typing is sent over datagrams.
+type wtTransport struct {
+	session wtSession
+	stream  wtStream
+	reader  *bufio.Reader
+}
+
+// NewWTTransport wrap WebTransport session and its channel stream.
+func NewWTTransport(session wtSession, stream wtStream) *wtTransport {
+	return &wtTransport{
+		session: session,
+		stream:  stream,
+		reader:  bufio.NewReader(stream),
+	}
+}
+
+// ReadMessage read length-prefixed message, one bigger than maxMessageSize is discarded with ErrMessageTooBig.
+func (t *wtTransport) ReadMessage() ([]byte, error) {
+	size, err := binary.ReadUvarint(t.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if size > maxFrameSize {
+		return nil, errFrameTooBig
+	}
+
+	msg, err := readMessage(io.LimitReader(t.reader, int64(size)))
+	if err == nil && uint64(len(msg)) < size {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return msg, err
+}
+
+func (t *wtTransport) WriteMessage(data []byte) error {
+	return t.WriteMessages([][]byte{data})
+}
+
+// WriteMessages write length-prefixed messages at once.
+func (t *wtTransport) WriteMessages(messages [][]byte) error {
+	var frame []byte
+
+	for _, data := range messages {
+		frame = binary.AppendUvarint(frame, uint64(len(data)))
+		frame = append(frame, data...)
+	}
+
+	t.stream.SetWriteDeadline(time.Now().Add(writeWait))
+	_, err := t.stream.Write(frame)
+
+	return err
+}
+
+// Ping only check that session is alive, QUIC keep-alive does the rest.
+func (t *wtTransport) Ping() error {
+	return t.session.Context().Err()
+}
+
+func (t *wtTransport) Close(code int, reason string) error {
+	return t.session.CloseWithError(webtransport.SessionErrorCode(code), reason)
+}
+
+func (t *wtTransport) SendDatagram(data []byte) error {
+	return t.session.SendDatagram(data)
+}
+
+func (t *wtTransport) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	return t.session.ReceiveDatagram(ctx)
+}
+
+// NewWebTransportServer build experimental HTTP/3 server with WebTransport /channel endpoint,
+// eg. new WebTransport("https://localhost:4443/channel?token=" + token).
+// Without certFile and keyFile short-lived self-signed certificate is generated,
+// its hash is logged to be used in serverCertificateHashes option.
+func NewWebTransportServer(addr, certFile, keyFile string, h *channelHandler, auth *authHandler, logger echo.Logger) (*webtransport.Server, error) {
+	var cert tls.Certificate
+	var err error
+
+	if len(certFile) > 0 {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = selfSignedCert()
+		if err == nil {
+			hash := sha256.Sum256(cert.Certificate[0])
+			logger.Infof("WebTransport self-signed certificate sha-256: %s", hex.EncodeToString(hash[:]))
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+
+	server := &webtransport.Server{
+		H3: http3.Server{
+			Addr:       addr,
+			TLSConfig:  &tls.Config{Certificates: []tls.Certificate{cert}},
+			QUICConfig: &quic.Config{KeepAlivePeriod: wtKeepAlivePeriod},
+			Handler:    mux,
+		},
+		// For dev purpose only: if u want to skip origin checking
+		// CheckOrigin: func(r *http.Request) bool { return true },
+	}
+
+	mux.HandleFunc("/channel", h.ListenWebTransport(server, auth, logger))
+
+	return server, nil
+}
+
+// ListenWebTransport accept WebTransport session and register new consumer, same as Listen for WebSocket.
+// Client should open bidirectional stream right after session is established.
+func (h channelHandler) ListenWebTransport(server *webtransport.Server, auth *authHandler, logger echo.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a, err := auth.ParseToken(r.URL.Query().Get("token"))
+		if err != nil {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		banned, err := h.store.Bans.IsBanned(a.Channel, a.User.Id)
+		if err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		if banned {
+			http.Error(w, "You are banned in this channel", http.StatusForbidden)
+			return
+		}
+
+		session, err := server.Upgrade(w, r)
+		if err != nil {
+			logger.Errorf("WebTransport upgrade error: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(session.Context(), writeWait)
+		stream, err := session.AcceptStream(ctx)
+		cancel()
+
+		if err != nil {
+			session.CloseWithError(0, "channel stream expected")
+			return
+		}
+
+		consumer := NewConsumer(a.Channel, a.User, NewWTTransport(session, stream), h.hub, h.store, h.commands, logger)
+
+		consumer.Register()
+
+		consumer.Listen()
+	}
+}
+
+// selfSignedCert generate ECDSA certificate for localhost, suitable for serverCertificateHashes.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"ChitChat"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(wtCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
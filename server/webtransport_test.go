@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/faustman/chitchat/server/chitchat"
+	"github.com/labstack/gommon/log"
+	"github.com/quic-go/webtransport-go"
+	"github.com/stretchr/testify/assert"
+)
+
+// testWTSession is a fake WebTransport session, datagrams are passed through channels.
+type testWTSession struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Datagrams from the client and to the client.
+	received chan []byte
+	sent     chan []byte
+}
+
+func newTestWTSession() *testWTSession {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &testWTSession{
+		ctx:      ctx,
+		cancel:   cancel,
+		received: make(chan []byte),
+		sent:     make(chan []byte, 8),
+	}
+}
+
+func (s *testWTSession) Context() context.Context {
+	return s.ctx
+}
+
+func (s *testWTSession) CloseWithError(code webtransport.SessionErrorCode, msg string) error {
+	s.cancel()
+	return nil
+}
+
+// SendDatagram drop datagram when client doesn't read them, same as unreliable delivery.
+func (s *testWTSession) SendDatagram(data []byte) error {
+	select {
+	case s.sent <- data:
+	default:
+	}
+
+	return nil
+}
+
+func (s *testWTSession) ReceiveDatagram(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-s.received:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// testWTTransport build transport over in-memory pipe, client end of the channel stream is returned too.
+func testWTTransport(t *testing.T, session *testWTSession) (*wtTransport, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return NewWTTransport(session, server), client
+}
+
+// testWTFrame prefix data with its length.
+func testWTFrame(data []byte) []byte {
+	return append(binary.AppendUvarint(nil, uint64(len(data))), data...)
+}
+
+func TestWTTransportReadMessage(t *testing.T) {
+	conn, client := testWTTransport(t, newTestWTSession())
+
+	go func() {
+		client.Write(testWTFrame([]byte("hello")))
+		client.Write(testWTFrame(make([]byte, maxMessageSize+1)))
+		client.Write(testWTFrame([]byte("after")))
+		client.Write(binary.AppendUvarint(nil, maxFrameSize+1))
+	}()
+
+	msg, err := conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(msg))
+
+	// Message is discarded, the next one is read as usual
+	_, err = conn.ReadMessage()
+	assert.Equal(t, ErrMessageTooBig, err)
+
+	msg, err = conn.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "after", string(msg))
+
+	// Frame that big isn't read at all
+	_, err = conn.ReadMessage()
+	assert.Equal(t, errFrameTooBig, err)
+}
+
+func TestWTTransportReadMessageTruncated(t *testing.T) {
+	conn, client := testWTTransport(t, newTestWTSession())
+
+	go func() {
+		client.Write(append(binary.AppendUvarint(nil, 10), "short"...))
+		client.Close()
+	}()
+
+	_, err := conn.ReadMessage()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestWTTransportWriteMessages(t *testing.T) {
+	conn, client := testWTTransport(t, newTestWTSession())
+
+	written := make(chan error, 1)
+	go func() {
+		written <- conn.WriteMessages([][]byte{[]byte("first"), []byte("second")})
+	}()
+
+	reader := bufio.NewReader(client)
+
+	for _, expected := range []string{"first", "second"} {
+		size, err := binary.ReadUvarint(reader)
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		data := make([]byte, size)
+		_, err = io.ReadFull(reader, data)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	assert.NoError(t, <-written)
+}
+
+func TestWTTypingDatagram(t *testing.T) {
+	store := NewMemoryStorage()
+
+	hub := NewConsumersHub(DefaultSendQueueConfig, DefaultMessageLimits)
+	go hub.run()
+
+	consumer := func(channel string, user *User) (*Consumer, *testWTSession) {
+		session := newTestWTSession()
+		conn, client := testWTTransport(t, session)
+
+		// Events on the stream aren't checked here
+		go io.Copy(io.Discard, client)
+
+		c := NewConsumer(channel, user, conn, hub, store, NewCommandsRegistry(nil, nil), log.New("test"))
+		c.Register()
+
+		return c, session
+	}
+
+	jon, jonSession := consumer("general", NewUser("Jon Snow", ""))
+	_, aryaSession := consumer("general", NewUser("Arya Stark", ""))
+	_, sansaSession := consumer("north", NewUser("Sansa Stark", ""))
+
+	go jon.Listen()
+	defer jon.Shutdown()
+
+	jonSession.received <- []byte(typingDatagram)
+
+	select {
+	case data := <-aryaSession.sent:
+		msg := ChannelMessage{}
+		assert.NoError(t, json.Unmarshal(data, &msg))
+		assert.Equal(t, chitchat.TypeTyping, msg.Type)
+		assert.Equal(t, jon.User.Id, msg.FromUser.Id)
+	case <-time.After(time.Second):
+		t.Fatal("Typing isn't broadcasted")
+	}
+
+	// Hub is done with broadcast when it takes the next signal
+	hub.unregister <- &Consumer{}
+
+	// Typing isn't sent back or to other channels
+	assert.Empty(t, jonSession.sent)
+	assert.Empty(t, sansaSession.sent)
+}